@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strings"
+)
+
+// Label is a label with the given Name and Value.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a single sample returned by the collect callback passed to RegisterCollector.
+type Sample struct {
+	// Name is the metric name without labels. For example, `db_pool_connections`.
+	Name string
+
+	// Labels is an optional list of labels for the sample.
+	Labels []Label
+
+	// Type is the metric type, which is exposed in `# TYPE` metadata.
+	//
+	// The following values are supported: counter, gauge and untyped.
+	// Empty Type is treated as untyped.
+	Type string
+
+	// Value is the sample value.
+	Value float64
+}
+
+// RegisterCollector registers collect callback for including samples in the output generated by WritePrometheus.
+//
+// collect must append the samples to dst and return the result.
+// It is called on every WritePrometheus call, so it may return dynamic list of samples.
+// Samples are validated and merged into the sorted output of the default set.
+// Invalid samples and samples clashing with already registered metrics are skipped.
+//
+// collect must be safe for concurrent calls.
+//
+// It is OK to register multiple collect callbacks - all of them will be called at WritePrometheus.
+func RegisterCollector(collect func(dst []Sample) []Sample) {
+	defaultSet.RegisterCollector(collect)
+}
+
+// marshalMetricName returns Prometheus-compatible metric name with labels for the given name and labels.
+func marshalMetricName(name string, labels []Label) string {
+	if len(labels) == 0 {
+		return name
+	}
+	var sb strings.Builder
+	sb.WriteString(name)
+	sb.WriteByte('{')
+	for i, label := range labels {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(label.Name)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabelValue(label.Value))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// labelValueEscaper escapes label values according to Prometheus text exposition format.
+//
+// Contrary to Go quoting, only backslash, double quote and newline chars are escaped there.
+// See https://github.com/prometheus/docs/blob/main/content/docs/instrumenting/exposition_formats.md#text-format-details
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabelValue returns s escaped for putting inside double quotes in Prometheus text exposition format.
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+func validateSample(sample *Sample) error {
+	if err := validateIdent(sample.Name); err != nil {
+		return err
+	}
+	for _, label := range sample.Labels {
+		if err := validateIdent(label.Name); err != nil {
+			return fmt.Errorf("invalid label name: %w", err)
+		}
+	}
+	switch sample.Type {
+	case "", "counter", "gauge", "untyped":
+	default:
+		return fmt.Errorf("unsupported sample type %q; supported types: counter, gauge, untyped", sample.Type)
+	}
+	return nil
+}
+
+// collectSamples calls collectors and returns valid samples, which don't clash with registered metrics.
+//
+// Samples with the type, which differs from the type of other metrics in the same family, are skipped,
+// since a family must have a single type.
+func collectSamples(collectors []func(dst []Sample) []Sample, registered []*namedMetric) []*namedMetric {
+	var samples []Sample
+	for _, collect := range collectors {
+		samples = collect(samples)
+	}
+	if len(samples) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]struct{}, len(registered)+len(samples))
+	familyTypes := make(map[string]string, len(registered))
+	for _, nm := range registered {
+		seen[nm.name] = struct{}{}
+		familyTypes[getMetricFamily(nm.name)] = nm.metric.metricType()
+	}
+	a := make([]*namedMetric, 0, len(samples))
+	for i := range samples {
+		sample := &samples[i]
+		if err := validateSample(sample); err != nil {
+			log.Printf("ERROR: metrics: skipping invalid sample %q returned by collector: %s", sample.Name, err)
+			continue
+		}
+		name := marshalMetricName(sample.Name, sample.Labels)
+		if _, ok := seen[name]; ok {
+			log.Printf("ERROR: metrics: skipping duplicate sample %s returned by collector", name)
+			continue
+		}
+		metricType := sample.Type
+		if metricType == "" {
+			metricType = "untyped"
+		}
+		if familyType, ok := familyTypes[sample.Name]; ok && familyType != metricType {
+			log.Printf("ERROR: metrics: skipping sample %s returned by collector, since its type %q differs from the type %q of other metrics in the family", name, metricType, familyType)
+			continue
+		}
+		familyTypes[sample.Name] = metricType
+		seen[name] = struct{}{}
+		a = append(a, &namedMetric{
+			name: name,
+			metric: &sampleValue{
+				typ:   metricType,
+				value: sample.Value,
+			},
+		})
+	}
+	return a
+}
+
+// sampleValue is a metric for a sample returned by collector.
+type sampleValue struct {
+	typ   string
+	value float64
+}
+
+func (sv *sampleValue) marshalTo(prefix string, w io.Writer) {
+	v := sv.value
+	if float64(int64(v)) == v && !math.IsInf(v, 0) {
+		// Marshal integer values without scientific notation
+		fmt.Fprintf(w, "%s %d\n", prefix, int64(v))
+	} else {
+		fmt.Fprintf(w, "%s %g\n", prefix, v)
+	}
+}
+
+func (sv *sampleValue) metricType() string {
+	return sv.typ
+}
@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestSetRegisterCollector(t *testing.T) {
+	s := NewSet()
+	s.NewCounter(`db_pool_acquires_total{pool="main"}`).Add(10)
+	s.NewGauge("aaa", func() float64 { return 1 })
+
+	pools := []string{"replica", "main"}
+	s.RegisterCollector(func(dst []Sample) []Sample {
+		for i, pool := range pools {
+			dst = append(dst, Sample{
+				Name:   "db_pool_connections",
+				Labels: []Label{{Name: "pool", Value: pool}},
+				Type:   "gauge",
+				Value:  float64(i + 1),
+			})
+		}
+		dst = append(dst, Sample{
+			Name:   "db_pool_wait_seconds_total",
+			Labels: []Label{{Name: "pool", Value: "main"}, {Name: "path", Value: `a"b`}},
+			Type:   "counter",
+			Value:  1.5,
+		})
+		return dst
+	})
+	s.RegisterCollector(func(dst []Sample) []Sample {
+		// Invalid samples must be skipped
+		dst = append(dst, Sample{Name: "bad name", Value: 1})
+		dst = append(dst, Sample{Name: "bad_label", Labels: []Label{{Name: "a-b", Value: "x"}}})
+		dst = append(dst, Sample{Name: "bad_type", Type: "histogram"})
+		// Samples clashing with registered metrics must be skipped
+		dst = append(dst, Sample{Name: "db_pool_acquires_total", Labels: []Label{{Name: "pool", Value: "main"}}, Value: 42})
+		dst = append(dst, Sample{Name: "zzz", Value: math.Inf(1)})
+		return dst
+	})
+
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	result := bb.String()
+	expected := `aaa 1
+db_pool_acquires_total{pool="main"} 10
+db_pool_connections{pool="main"} 2
+db_pool_connections{pool="replica"} 1
+db_pool_wait_seconds_total{pool="main",path="a\"b"} 1.5
+zzz +Inf
+`
+	if result != expected {
+		t.Fatalf("unexpected output; got\n%s\nwant\n%s", result, expected)
+	}
+
+	ExposeMetadata(true)
+	bb.Reset()
+	s.WritePrometheus(&bb)
+	ExposeMetadata(false)
+	result = bb.String()
+	expected = `# HELP aaa
+# TYPE aaa gauge
+aaa 1
+# HELP db_pool_acquires_total
+# TYPE db_pool_acquires_total counter
+db_pool_acquires_total{pool="main"} 10
+# HELP db_pool_connections
+# TYPE db_pool_connections gauge
+db_pool_connections{pool="main"} 2
+db_pool_connections{pool="replica"} 1
+# HELP db_pool_wait_seconds_total
+# TYPE db_pool_wait_seconds_total counter
+db_pool_wait_seconds_total{pool="main",path="a\"b"} 1.5
+# HELP zzz
+# TYPE zzz untyped
+zzz +Inf
+`
+	if result != expected {
+		t.Fatalf("unexpected output with metadata; got\n%s\nwant\n%s", result, expected)
+	}
+
+	if names := s.ListMetricNames(); len(names) != 2 {
+		t.Fatalf("collected samples mustn't be listed; got %q", names)
+	}
+
+	s.UnregisterAllMetrics()
+	bb.Reset()
+	s.WritePrometheus(&bb)
+	if bb.Len() != 0 {
+		t.Fatalf("unexpected output after UnregisterAllMetrics:\n%s", bb.String())
+	}
+}
+
+func TestMarshalMetricName(t *testing.T) {
+	f := func(name string, labels []Label, expected string) {
+		t.Helper()
+		if result := marshalMetricName(name, labels); result != expected {
+			t.Fatalf("unexpected result; got %s; want %s", result, expected)
+		}
+	}
+	f("foo", nil, "foo")
+	f("foo", []Label{{Name: "a", Value: "b"}, {Name: "c", Value: ""}}, `foo{a="b",c=""}`)
+
+	// Only backslash, double quote and newline are escaped
+	f("foo", []Label{{Name: "a", Value: "x\\y\"z\nw"}}, `foo{a="x\\y\"z\nw"}`)
+	f("foo", []Label{{Name: "a", Value: "tab\tctrl\x01ünicode"}}, "foo{a=\"tab\tctrl\x01ünicode\"}")
+}
+
+func TestSetRegisterCollectorTypeConflict(t *testing.T) {
+	s := NewSet()
+	s.NewCounter(`requests_total{path="/"}`).Inc()
+	s.RegisterCollector(func(dst []Sample) []Sample {
+		dst = append(dst, Sample{Name: "requests_total", Labels: []Label{{Name: "path", Value: "/a"}}, Type: "gauge", Value: 2})
+		dst = append(dst, Sample{Name: "requests_total", Labels: []Label{{Name: "path", Value: "/b"}}, Type: "counter", Value: 3})
+		dst = append(dst, Sample{Name: "temperature", Labels: []Label{{Name: "room", Value: "a"}}, Type: "gauge", Value: 20})
+		dst = append(dst, Sample{Name: "temperature", Labels: []Label{{Name: "room", Value: "b"}}, Value: 21})
+		return dst
+	})
+
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	result := bb.String()
+	expected := `requests_total{path="/"} 1
+requests_total{path="/b"} 3
+temperature{room="a"} 20
+`
+	if result != expected {
+		t.Fatalf("unexpected output; got\n%s\nwant\n%s", result, expected)
+	}
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+)
+
+// Metric is the interface, which must be implemented by user-defined metric types
+// in order to register them in a Set via RegisterMetric.
+//
+// Registered metrics are exposed, sorted, listed and unregistered in the same way as the built-in metric types.
+type Metric interface {
+	// MarshalTo must write the metric to w in Prometheus text exposition format without timestamps and trailing comments.
+	//
+	// prefix is the metric name with optional labels, which has been passed to RegisterMetric.
+	// Every line written to w must end with \n.
+	MarshalTo(prefix string, w io.Writer)
+
+	// MetricType must return the metric type, which is exposed in `# TYPE` metadata.
+	//
+	// The following values are supported: counter, gauge, histogram, summary and untyped.
+	MetricType() string
+}
+
+// RegisterMetric registers user-defined metric m with the given name in the default set.
+//
+// name must be valid Prometheus-compatible metric with possible labels.
+// For instance,
+//
+//   - foo
+//   - foo{bar="baz"}
+//   - foo{bar="baz",aaa="b"}
+//
+// m must be safe for concurrent calls.
+func RegisterMetric(name string, m Metric) {
+	defaultSet.RegisterMetric(name, m)
+}
+
+// GetOrCreateMetric returns registered user-defined metric with the given name from the default set
+// or registers the metric returned by newMetric if the default set doesn't contain metric with the given name.
+//
+// name must be valid Prometheus-compatible metric with possible labels.
+// For instance,
+//
+//   - foo
+//   - foo{bar="baz"}
+//   - foo{bar="baz",aaa="b"}
+//
+// Performance tip: prefer RegisterMetric instead of GetOrCreateMetric.
+func GetOrCreateMetric(name string, newMetric func() Metric) Metric {
+	return defaultSet.GetOrCreateMetric(name, newMetric)
+}
+
+// customMetric adapts user-defined Metric to the internal metric interface.
+type customMetric struct {
+	m Metric
+}
+
+func newCustomMetric(m Metric) *customMetric {
+	if m == nil {
+		panic(fmt.Errorf("BUG: metric cannot be nil"))
+	}
+	if err := validateMetricType(m.MetricType()); err != nil {
+		panic(fmt.Errorf("BUG: invalid metric %T: %s", m, err))
+	}
+	return &customMetric{
+		m: m,
+	}
+}
+
+func (cm *customMetric) marshalTo(prefix string, w io.Writer) {
+	cm.m.MarshalTo(prefix, w)
+}
+
+func (cm *customMetric) metricType() string {
+	return cm.m.MetricType()
+}
+
+func validateMetricType(metricType string) error {
+	switch metricType {
+	case "counter", "gauge", "histogram", "summary", "untyped":
+		return nil
+	default:
+		return fmt.Errorf("unsupported metric type %q; supported types: counter, gauge, histogram, summary, untyped", metricType)
+	}
+}
@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// testStateSet is a state-set metric, which exposes 1 for the current state and 0 for the rest of states.
+type testStateSet struct {
+	mu     sync.Mutex
+	states []string
+	curr   string
+}
+
+func (ss *testStateSet) set(state string) {
+	ss.mu.Lock()
+	ss.curr = state
+	ss.mu.Unlock()
+}
+
+func (ss *testStateSet) MarshalTo(prefix string, w io.Writer) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, state := range ss.states {
+		v := 0
+		if state == ss.curr {
+			v = 1
+		}
+		fmt.Fprintf(w, "%s %d\n", addTag(prefix, fmt.Sprintf("state=%q", state)), v)
+	}
+}
+
+func (ss *testStateSet) MetricType() string {
+	return "gauge"
+}
+
+type testInvalidTypeMetric struct{}
+
+func (m *testInvalidTypeMetric) MarshalTo(prefix string, w io.Writer) {}
+
+func (m *testInvalidTypeMetric) MetricType() string {
+	return "foobar"
+}
+
+func TestSetRegisterMetric(t *testing.T) {
+	s := NewSet()
+	ss := &testStateSet{
+		states: []string{"running", "stopped"},
+	}
+	ss.set("running")
+	s.RegisterMetric(`service_state{name="foo"}`, ss)
+	s.NewCounter("aaa_total").Inc()
+	s.NewCounter("zzz_total").Add(2)
+
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	result := bb.String()
+	expected := `aaa_total 1
+service_state{name="foo",state="running"} 1
+service_state{name="foo",state="stopped"} 0
+zzz_total 2
+`
+	if result != expected {
+		t.Fatalf("unexpected output; got\n%s\nwant\n%s", result, expected)
+	}
+
+	ExposeMetadata(true)
+	bb.Reset()
+	s.WritePrometheus(&bb)
+	ExposeMetadata(false)
+	result = bb.String()
+	expected = `# HELP aaa_total
+# TYPE aaa_total counter
+aaa_total 1
+# HELP service_state
+# TYPE service_state gauge
+service_state{name="foo",state="running"} 1
+service_state{name="foo",state="stopped"} 0
+# HELP zzz_total
+# TYPE zzz_total counter
+zzz_total 2
+`
+	if result != expected {
+		t.Fatalf("unexpected output with metadata; got\n%s\nwant\n%s", result, expected)
+	}
+
+	names := s.ListMetricNames()
+	expectedNames := []string{"aaa_total", `service_state{name="foo"}`, "zzz_total"}
+	if fmt.Sprintf("%q", names) != fmt.Sprintf("%q", expectedNames) {
+		t.Fatalf("unexpected metric names; got %q; want %q", names, expectedNames)
+	}
+
+	if !s.UnregisterMetric(`service_state{name="foo"}`) {
+		t.Fatalf("UnregisterMetric must return true for registered user-defined metric")
+	}
+	bb.Reset()
+	s.WritePrometheus(&bb)
+	result = bb.String()
+	expected = "aaa_total 1\nzzz_total 2\n"
+	if result != expected {
+		t.Fatalf("unexpected output after unregistering; got\n%s\nwant\n%s", result, expected)
+	}
+}
+
+func TestSetRegisterMetricFailure(t *testing.T) {
+	s := NewSet()
+	ss := &testStateSet{}
+	expectPanic(t, "RegisterMetric(invalid name)", func() { s.RegisterMetric("foo{", ss) })
+	expectPanic(t, "RegisterMetric(nil)", func() { s.RegisterMetric("foo", nil) })
+	expectPanic(t, "RegisterMetric(invalid type)", func() { s.RegisterMetric("foo", &testInvalidTypeMetric{}) })
+
+	s.RegisterMetric("foo", ss)
+	expectPanic(t, "RegisterMetric(duplicate)", func() { s.RegisterMetric("foo", ss) })
+
+	s.NewCounter("bar")
+	expectPanic(t, "GetOrCreateMetric(counter)", func() {
+		s.GetOrCreateMetric("bar", func() Metric { return ss })
+	})
+}
+
+func TestSetGetOrCreateMetric(t *testing.T) {
+	s := NewSet()
+	newMetric := func() Metric {
+		return &testStateSet{
+			states: []string{"a", "b"},
+		}
+	}
+	m1 := s.GetOrCreateMetric("foo", newMetric)
+	m2 := s.GetOrCreateMetric("foo", newMetric)
+	if m1 != m2 {
+		t.Fatalf("GetOrCreateMetric must return the same metric for the same name")
+	}
+	m1.(*testStateSet).set("b")
+
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	result := bb.String()
+	expected := "foo{state=\"a\"} 0\nfoo{state=\"b\"} 1\n"
+	if result != expected {
+		t.Fatalf("unexpected output; got\n%s\nwant\n%s", result, expected)
+	}
+}
@@ -0,0 +1,155 @@
+// Package expvarbridge bridges metrics from github.com/itcomusic/metrics with the standard expvar package.
+//
+// The bridge lives in a separate package, since importing expvar registers `/debug/vars` handler
+// at http.DefaultServeMux and publishes `cmdline` and `memstats` vars. Only the applications,
+// which import expvarbridge, get these side effects.
+package expvarbridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/itcomusic/metrics"
+)
+
+// SetVar returns expvar.Var, which exposes metrics from s in JSON format.
+//
+// See metrics.Set.WriteJSON for the description of the JSON format.
+func SetVar(s *metrics.Set) expvar.Var {
+	return expvar.Func(func() interface{} {
+		var bb bytes.Buffer
+		s.WriteJSON(&bb)
+		return json.RawMessage(bb.Bytes())
+	})
+}
+
+// PublishSet publishes metrics from s under the given name via expvar package.
+//
+// The metrics are exposed in JSON format at `/debug/vars` page. See metrics.Set.WriteJSON for the description of the JSON format.
+//
+// PublishSet panics if the name is already published, like expvar.Publish does.
+func PublishSet(name string, s *metrics.Set) {
+	expvar.Publish(name, SetVar(s))
+}
+
+// RegisterGauges registers gauges in the default metrics set for all the integer and float vars published via expvar package.
+//
+// See RegisterSetGauges for details.
+func RegisterGauges(prefix string) {
+	registerGauges(defaultSet{}, prefix)
+}
+
+// RegisterSetGauges registers gauges in s for all the integer and float vars published via expvar package.
+//
+// Every *expvar.Int and *expvar.Float var is exposed as a gauge with `prefix+name` name, where name is the var name
+// with unsupported chars replaced with underscores.
+// Integer and float values of *expvar.Map vars are exposed as `prefix+name{key="<key>"}` gauges.
+// Other vars are ignored. Vars clashing with already registered metrics are skipped.
+//
+// The gauges read the current var values on every s.WritePrometheus call.
+// Vars published after the RegisterSetGauges call aren't exposed, so it is OK to call RegisterSetGauges
+// again after publishing new vars - already registered gauges are left as is.
+func RegisterSetGauges(s *metrics.Set, prefix string) {
+	registerGauges(s, prefix)
+}
+
+// gaugeSet is the subset of metrics.Set methods used for registering gauges.
+type gaugeSet interface {
+	GetOrCreateGauge(name string, f func() float64) *metrics.Gauge
+	ListMetricNames() []string
+}
+
+// defaultSet implements gaugeSet for the default metrics set.
+type defaultSet struct{}
+
+func (defaultSet) GetOrCreateGauge(name string, f func() float64) *metrics.Gauge {
+	return metrics.GetOrCreateGauge(name, f)
+}
+
+func (defaultSet) ListMetricNames() []string {
+	return metrics.ListMetricNames()
+}
+
+var (
+	// registeredGauges contains names of gauges registered by registerGauges per every gaugeSet.
+	//
+	// It is used for distinguishing already registered expvar gauges from clashing metrics.
+	registeredGauges     = make(map[gaugeSet]map[string]struct{})
+	registeredGaugesLock sync.Mutex
+)
+
+func registerGauges(s gaugeSet, prefix string) {
+	registeredGaugesLock.Lock()
+	defer registeredGaugesLock.Unlock()
+
+	registered := registeredGauges[s]
+	if registered == nil {
+		registered = make(map[string]struct{})
+		registeredGauges[s] = registered
+	}
+	existing := make(map[string]struct{})
+	for _, name := range s.ListMetricNames() {
+		existing[name] = struct{}{}
+	}
+	registerGauge := func(name string, v expvar.Var) {
+		if _, ok := existing[name]; ok {
+			if _, ok := registered[name]; !ok {
+				log.Printf("ERROR: metrics: skipping expvar gauge %q, since the metric with the same name is already registered", name)
+			}
+			return
+		}
+		var f func() float64
+		switch t := v.(type) {
+		case *expvar.Int:
+			f = func() float64 {
+				return float64(t.Value())
+			}
+		case *expvar.Float:
+			f = t.Value
+		}
+		s.GetOrCreateGauge(name, f)
+		registered[name] = struct{}{}
+	}
+
+	expvar.Do(func(kv expvar.KeyValue) {
+		name := sanitizeMetricName(kv.Key)
+		if name == "" {
+			// Skip vars with empty names.
+			return
+		}
+		name = prefix + name
+		switch v := kv.Value.(type) {
+		case *expvar.Int, *expvar.Float:
+			registerGauge(name, v)
+		case *expvar.Map:
+			v.Do(func(kvMap expvar.KeyValue) {
+				switch vMap := kvMap.Value.(type) {
+				case *expvar.Int, *expvar.Float:
+					registerGauge(name+`{key="`+labelValueEscaper.Replace(kvMap.Key)+`"}`, vMap)
+				}
+			})
+		}
+	})
+}
+
+// labelValueEscaper escapes label values according to Prometheus text exposition format.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sanitizeMetricName replaces chars unsupported in metric names with underscores.
+func sanitizeMetricName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == ':' {
+			continue
+		}
+		b[i] = '_'
+	}
+	if len(b) > 0 && b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
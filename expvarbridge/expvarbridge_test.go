@@ -0,0 +1,100 @@
+package expvarbridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"strings"
+	"testing"
+
+	"github.com/itcomusic/metrics"
+)
+
+func TestSetExpvarVar(t *testing.T) {
+	s := metrics.NewSet()
+	s.NewCounter("foo_total").Set(5)
+
+	v := SetVar(s)
+	var bb bytes.Buffer
+	s.WriteJSON(&bb)
+	var result, expected interface{}
+	if err := json.Unmarshal([]byte(v.String()), &result); err != nil {
+		t.Fatalf("cannot unmarshal expvar value %q: %s", v.String(), err)
+	}
+	if err := json.Unmarshal(bb.Bytes(), &expected); err != nil {
+		t.Fatalf("cannot unmarshal WriteJSON output: %s", err)
+	}
+	if !bytes.Equal(mustMarshalJSON(t, result), mustMarshalJSON(t, expected)) {
+		t.Fatalf("unexpected expvar value; got\n%s\nwant\n%s", v.String(), bb.String())
+	}
+
+	PublishSet("metrics_test_set", s)
+	if expvar.Get("metrics_test_set") == nil {
+		t.Fatalf("missing published expvar")
+	}
+}
+
+func TestSetRegisterExpvarGauges(t *testing.T) {
+	expvar.NewInt("metrics_test.requests-count").Set(42)
+	expvar.NewFloat("metrics_test_ratio").Set(0.5)
+	m := expvar.NewMap("metrics_test_map")
+	m.Add("a", 3)
+	m.AddFloat("b", 1.5)
+	m.Add("x\ty\"z", 4)
+	m.Set("c", expvar.Func(func() interface{} { return "ignored" }))
+	expvar.NewString("metrics_test_string").Set("ignored")
+
+	s := metrics.NewSet()
+	RegisterSetGauges(s, "expvar_")
+	RegisterSetGauges(s, "expvar_")
+
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	result := bb.String()
+	expected := `expvar_metrics_test_map{key="a"} 3
+expvar_metrics_test_map{key="b"} 1.5
+expvar_metrics_test_map{key="x	y\"z"} 4
+expvar_metrics_test_ratio 0.5
+expvar_metrics_test_requests_count 42
+`
+	if result != expected {
+		t.Fatalf("unexpected output; got\n%s\nwant\n%s", result, expected)
+	}
+}
+
+func TestSetRegisterExpvarGaugesNameClash(t *testing.T) {
+	expvar.NewInt("metrics_test_clash").Set(7)
+
+	s := metrics.NewSet()
+	s.NewCounter("clash_metrics_test_clash").Set(1)
+	RegisterSetGauges(s, "clash_")
+
+	var bb bytes.Buffer
+	s.WritePrometheus(&bb)
+	result := bb.String()
+	if !strings.Contains(result, "clash_metrics_test_clash 1\n") || strings.Contains(result, "clash_metrics_test_clash 7\n") {
+		t.Fatalf("unexpected output; the counter must be left as is\n%s", result)
+	}
+}
+
+func TestSanitizeMetricName(t *testing.T) {
+	f := func(name, expected string) {
+		t.Helper()
+		if result := sanitizeMetricName(name); result != expected {
+			t.Fatalf("unexpected result for %q; got %q; want %q", name, result, expected)
+		}
+	}
+	f("", "")
+	f("foo_bar:baz", "foo_bar:baz")
+	f("foo.bar-baz/1", "foo_bar_baz_1")
+	f("1foo", "_1foo")
+}
+
+func mustMarshalJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("cannot marshal %v: %s", v, err)
+	}
+	return data
+}
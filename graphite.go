@@ -0,0 +1,559 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GraphiteOptions is the list of options, which may be applied to InitGraphiteWithOptions().
+type GraphiteOptions struct {
+	// Prefix is an optional prefix to add to all the Graphite paths. For example, `myapp.`.
+	Prefix string
+
+	// Template is an optional template for building Graphite paths from metric names and labels.
+	//
+	// The template may contain `{__name__}` placeholder, which is substituted with metric name,
+	// and `{label_name}` placeholders, which are substituted with the corresponding label values.
+	// For example, `{env}.{instance}.{__name__}`. Empty path components are removed.
+	// Labels, which aren't referenced in the template, are appended to the path as `.<label_name>.<label_value>`.
+	//
+	// By default the path consists of metric name followed by `.<label_name>.<label_value>` for every label.
+	//
+	// Template is ignored if UseTags is set.
+	Template string
+
+	// UseTags enables Graphite tags syntax `name;label_name=label_value` instead of putting labels into paths.
+	//
+	// See https://graphite.readthedocs.io/en/latest/tags.html
+	UseTags bool
+
+	// Pickle enables Graphite pickle protocol instead of plaintext protocol.
+	//
+	// See https://graphite.readthedocs.io/en/latest/feeding-carbon.html#the-pickle-protocol
+	Pickle bool
+
+	// DialTimeout is the timeout for establishing TCP connection to Graphite.
+	//
+	// By default the DialTimeout is 5 seconds.
+	DialTimeout time.Duration
+
+	// Optional WaitGroup for waiting until all the push workers created with this WaitGroup are stopped.
+	WaitGroup *sync.WaitGroup
+}
+
+// InitGraphiteWithOptions sets up periodic push for globally registered metrics to Graphite at the given TCP addr with the given interval.
+//
+// The periodic push is stopped when ctx is canceled.
+// It is possible to wait until the background metrics push worker is stopped on a WaitGroup passed via opts.WaitGroup.
+//
+// If pushProcessMetrics is set to true, then 'process_*' and `go_*` metrics are also pushed to addr.
+//
+// opts may contain additional configuration options if non-nil.
+//
+// The metrics are sent over a persistent TCP connection, which is re-established on errors.
+func InitGraphiteWithOptions(ctx context.Context, addr string, interval time.Duration, pushProcessMetrics bool, opts *GraphiteOptions) error {
+	writeMetrics := func(w io.Writer) {
+		WritePrometheus(w, pushProcessMetrics)
+	}
+	return InitGraphiteExtWithOptions(ctx, addr, interval, writeMetrics, opts)
+}
+
+// InitGraphiteWithOptions sets up periodic push for metrics from s to Graphite at the given TCP addr with the given interval.
+//
+// The periodic push is stopped when ctx is canceled.
+// It is possible to wait until the background metrics push worker is stopped on a WaitGroup passed via opts.WaitGroup.
+//
+// opts may contain additional configuration options if non-nil.
+//
+// The metrics are sent over a persistent TCP connection, which is re-established on errors.
+func (s *Set) InitGraphiteWithOptions(ctx context.Context, addr string, interval time.Duration, opts *GraphiteOptions) error {
+	return InitGraphiteExtWithOptions(ctx, addr, interval, s.WritePrometheus, opts)
+}
+
+// InitGraphiteExtWithOptions sets up periodic push for metrics obtained by calling writeMetrics to Graphite at the given TCP addr
+// with the given interval.
+//
+// The writeMetrics callback must write metrics to w in Prometheus text exposition format without timestamps and trailing comments.
+// See https://github.com/prometheus/docs/blob/main/content/docs/instrumenting/exposition_formats.md#text-based-format
+//
+// The periodic push is stopped when ctx is canceled.
+// It is possible to wait until the background metrics push worker is stopped on a WaitGroup passed via opts.WaitGroup.
+//
+// opts may contain additional configuration options if non-nil.
+//
+// The metrics are sent over a persistent TCP connection, which is re-established on errors.
+func InitGraphiteExtWithOptions(ctx context.Context, addr string, interval time.Duration, writeMetrics func(w io.Writer), opts *GraphiteOptions) error {
+	gc, err := newGraphiteContext(addr, opts)
+	if err != nil {
+		return err
+	}
+
+	// validate interval
+	if interval <= 0 {
+		return fmt.Errorf("interval must be positive; got %s", interval)
+	}
+	pushMetricsSet.GetOrCreateFloatCounter(fmt.Sprintf(`metrics_push_interval_seconds{url=%q}`, gc.pushURL)).Set(interval.Seconds())
+
+	var wg *sync.WaitGroup
+	if opts != nil {
+		wg = opts.WaitGroup
+	}
+	startPeriodicPush(ctx, interval, nil, wg, func(ctx context.Context) error {
+		return gc.pushMetrics(ctx, writeMetrics)
+	}, gc.close)
+
+	return nil
+}
+
+type graphiteContext struct {
+	addr        string
+	pushURL     string
+	prefix      string
+	template    []graphiteTemplatePart
+	useTags     bool
+	pickle      bool
+	dialTimeout time.Duration
+
+	connLock sync.Mutex
+	conn     net.Conn
+
+	// hasConnected is set after the first successful connection, so only subsequent connections are counted as reconnects.
+	hasConnected bool
+
+	pushesTotal      *Counter
+	bytesPushedTotal *Counter
+	pushDuration     *Histogram
+	pushErrors       *Counter
+	reconnectsTotal  *Counter
+}
+
+func newGraphiteContext(addr string, opts *GraphiteOptions) (*graphiteContext, error) {
+	if opts == nil {
+		opts = &GraphiteOptions{}
+	}
+
+	// validate addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid Graphite addr=%q; expecting `host:port`: %w", addr, err)
+	}
+
+	// validate Template
+	template, err := parseGraphiteTemplate(opts.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Template=%q: %w", opts.Template, err)
+	}
+
+	dialTimeout := opts.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = 5 * time.Second
+	}
+
+	pushURL := "tcp://" + addr
+	return &graphiteContext{
+		addr:        addr,
+		pushURL:     pushURL,
+		prefix:      opts.Prefix,
+		template:    template,
+		useTags:     opts.UseTags,
+		pickle:      opts.Pickle,
+		dialTimeout: dialTimeout,
+
+		pushesTotal:      pushMetricsSet.GetOrCreateCounter(fmt.Sprintf(`metrics_push_total{url=%q}`, pushURL)),
+		bytesPushedTotal: pushMetricsSet.GetOrCreateCounter(fmt.Sprintf(`metrics_push_bytes_pushed_total{url=%q}`, pushURL)),
+		pushDuration:     pushMetricsSet.GetOrCreateHistogram(fmt.Sprintf(`metrics_push_duration_seconds{url=%q}`, pushURL)),
+		pushErrors:       pushMetricsSet.GetOrCreateCounter(fmt.Sprintf(`metrics_push_errors_total{url=%q}`, pushURL)),
+		reconnectsTotal:  pushMetricsSet.GetOrCreateCounter(fmt.Sprintf(`metrics_push_reconnects_total{url=%q}`, pushURL)),
+	}, nil
+}
+
+func (gc *graphiteContext) pushMetrics(ctx context.Context, writeMetrics func(w io.Writer)) error {
+	bb := getBytesBuffer()
+	defer putBytesBuffer(bb)
+
+	writeMetrics(bb)
+	points := gc.getPoints(bb.B, time.Now())
+	if len(points) == 0 {
+		return nil
+	}
+
+	bb.B = bb.B[:0]
+	if gc.pickle {
+		bb.B = appendGraphitePickle(bb.B, points, graphitePickleMaxFrameSize)
+	} else {
+		bb.B = appendGraphitePlaintext(bb.B, points)
+	}
+
+	// Update metrics
+	gc.pushesTotal.Inc()
+	gc.bytesPushedTotal.Add(len(bb.B))
+
+	startTime := time.Now()
+	err := gc.write(ctx, bb.B)
+	gc.pushDuration.UpdateDuration(startTime)
+	if err != nil {
+		gc.pushErrors.Inc()
+		return fmt.Errorf("cannot push metrics to %q: %w", gc.pushURL, err)
+	}
+	return nil
+}
+
+// write writes data to the persistent connection.
+//
+// The connection is re-established once if the write fails, since the previous connection may be closed by Graphite.
+// Only the records, which weren't fully written to the previous connection, are written to the new connection.
+func (gc *graphiteContext) write(ctx context.Context, data []byte) error {
+	gc.connLock.Lock()
+	defer gc.connLock.Unlock()
+
+	var err error
+	for i := 0; i < 2; i++ {
+		if gc.conn == nil {
+			if err = gc.dialLocked(ctx); err != nil {
+				return err
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = gc.conn.SetWriteDeadline(deadline)
+		}
+		var n int
+		n, err = gc.conn.Write(data)
+		if err == nil {
+			return nil
+		}
+		_ = gc.conn.Close()
+		gc.conn = nil
+
+		// The partially written record is dropped by Graphite together with the closed connection,
+		// so it must be written again, while fully written records mustn't be duplicated.
+		data = data[gc.getWrittenRecordsLen(data[:n]):]
+		if len(data) == 0 {
+			return nil
+		}
+	}
+	return err
+}
+
+// getWrittenRecordsLen returns the length of fully written records at the start of written.
+//
+// Records are lines for plaintext protocol and frames for pickle protocol.
+func (gc *graphiteContext) getWrittenRecordsLen(written []byte) int {
+	if !gc.pickle {
+		return bytes.LastIndexByte(written, '\n') + 1
+	}
+	n := 0
+	for len(written)-n >= 4 {
+		frameLen := 4 + int(binary.BigEndian.Uint32(written[n:]))
+		if len(written)-n < frameLen {
+			break
+		}
+		n += frameLen
+	}
+	return n
+}
+
+func (gc *graphiteContext) dialLocked(ctx context.Context) error {
+	d := net.Dialer{
+		Timeout: gc.dialTimeout,
+	}
+	conn, err := d.DialContext(ctx, "tcp", gc.addr)
+	if err != nil {
+		return fmt.Errorf("cannot connect to %q: %w", gc.addr, err)
+	}
+	gc.conn = conn
+	if gc.hasConnected {
+		gc.reconnectsTotal.Inc()
+	}
+	gc.hasConnected = true
+	return nil
+}
+
+func (gc *graphiteContext) close() {
+	gc.connLock.Lock()
+	if gc.conn != nil {
+		_ = gc.conn.Close()
+		gc.conn = nil
+	}
+	gc.connLock.Unlock()
+}
+
+type graphitePoint struct {
+	path      string
+	value     float64
+	timestamp int64
+}
+
+// getPoints converts metrics in Prometheus text exposition format from src to Graphite points with the given timestamp.
+//
+// NaN and Inf values are skipped, since Graphite doesn't support them.
+func (gc *graphiteContext) getPoints(src []byte, ts time.Time) []graphitePoint {
+	var points []graphitePoint
+	timestamp := ts.Unix()
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ps, err := parseSampleLine(line)
+		if err != nil {
+			log.Printf("ERROR: metrics: cannot convert sample to Graphite format: %s", err)
+			continue
+		}
+		if math.IsNaN(ps.value) || math.IsInf(ps.value, 0) {
+			continue
+		}
+		var path string
+		if gc.useTags {
+			path = getGraphiteTaggedPath(gc.prefix, ps)
+		} else {
+			path = getGraphitePath(gc.prefix, gc.template, ps)
+		}
+		points = append(points, graphitePoint{
+			path:      path,
+			value:     ps.value,
+			timestamp: timestamp,
+		})
+	}
+	return points
+}
+
+// graphiteTemplatePart is either a literal text or a placeholder for label value in Graphite path template.
+type graphiteTemplatePart struct {
+	text        string
+	isLabelName bool
+}
+
+func parseGraphiteTemplate(s string) ([]graphiteTemplatePart, error) {
+	var parts []graphiteTemplatePart
+	for len(s) > 0 {
+		n := strings.IndexByte(s, '{')
+		if n < 0 {
+			parts = append(parts, graphiteTemplatePart{
+				text: s,
+			})
+			break
+		}
+		if n > 0 {
+			parts = append(parts, graphiteTemplatePart{
+				text: s[:n],
+			})
+		}
+		s = s[n+1:]
+		n = strings.IndexByte(s, '}')
+		if n < 0 {
+			return nil, fmt.Errorf("missing closing curly brace")
+		}
+		labelName := s[:n]
+		if labelName != "__name__" {
+			if err := validateIdent(labelName); err != nil {
+				return nil, err
+			}
+		}
+		parts = append(parts, graphiteTemplatePart{
+			text:        labelName,
+			isLabelName: true,
+		})
+		s = s[n+1:]
+	}
+	return parts, nil
+}
+
+func getGraphitePath(prefix string, template []graphiteTemplatePart, ps *parsedSample) string {
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	var usedLabels map[string]struct{}
+	if len(template) == 0 {
+		sb.WriteString(ps.name)
+	} else {
+		usedLabels = make(map[string]struct{}, len(template))
+		var path strings.Builder
+		for _, part := range template {
+			if !part.isLabelName {
+				path.WriteString(part.text)
+				continue
+			}
+			if part.text == "__name__" {
+				path.WriteString(ps.name)
+				continue
+			}
+			usedLabels[part.text] = struct{}{}
+			for _, label := range ps.labels {
+				if label.Name == part.text {
+					path.WriteString(sanitizeGraphitePathNode(label.Value))
+					break
+				}
+			}
+		}
+		// Remove empty path components, which may appear for missing labels.
+		var nodes []string
+		for _, node := range strings.Split(path.String(), ".") {
+			if len(node) > 0 {
+				nodes = append(nodes, node)
+			}
+		}
+		sb.WriteString(strings.Join(nodes, "."))
+	}
+	for _, label := range ps.labels {
+		if _, ok := usedLabels[label.Name]; ok {
+			continue
+		}
+		sb.WriteByte('.')
+		sb.WriteString(label.Name)
+		sb.WriteByte('.')
+		sb.WriteString(sanitizeGraphitePathNode(label.Value))
+	}
+	return sb.String()
+}
+
+func getGraphiteTaggedPath(prefix string, ps *parsedSample) string {
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	sb.WriteString(ps.name)
+	labels := append([]Label{}, ps.labels...)
+	sort.SliceStable(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	for _, label := range labels {
+		if len(label.Value) == 0 {
+			// Graphite doesn't support empty tag values.
+			continue
+		}
+		sb.WriteByte(';')
+		sb.WriteString(label.Name)
+		sb.WriteByte('=')
+		sb.WriteString(sanitizeGraphiteTagValue(label.Value))
+	}
+	return sb.String()
+}
+
+// sanitizeGraphitePathNode replaces chars, which cannot be used in Graphite path node, with underscores.
+func sanitizeGraphitePathNode(s string) string {
+	if len(s) == 0 {
+		return "_"
+	}
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == ':' {
+			continue
+		}
+		b[i] = '_'
+	}
+	return string(b)
+}
+
+// sanitizeGraphiteTagValue replaces chars, which cannot be used in Graphite tag value, with underscores.
+func sanitizeGraphiteTagValue(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c == ';' || c == ' ' || c == '\t' || c == '\n' || c == '~' && i == 0 {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func appendGraphitePlaintext(dst []byte, points []graphitePoint) []byte {
+	for _, p := range points {
+		dst = append(dst, p.path...)
+		dst = append(dst, ' ')
+		dst = strconv.AppendFloat(dst, p.value, 'g', -1, 64)
+		dst = append(dst, ' ')
+		dst = strconv.AppendInt(dst, p.timestamp, 10)
+		dst = append(dst, '\n')
+	}
+	return dst
+}
+
+// graphitePickleMaxFrameSize is the maximum payload size for a single pickle frame.
+//
+// Carbon drops frames exceeding MAX_LENGTH, which equals to 1MiB.
+// See https://github.com/graphite-project/carbon/blob/master/lib/carbon/protocols.py
+const graphitePickleMaxFrameSize = 1024 * 1024
+
+// appendGraphitePickle appends points to dst in Graphite pickle protocol.
+//
+// Every frame is a pickled list of `(path, (timestamp, value))` tuples prefixed with 4-byte big-endian payload length.
+// Points are split into multiple frames, so the payload of every frame doesn't exceed maxFrameSize.
+// A point, which doesn't fit maxFrameSize on its own, is sent in a separate frame.
+// See https://docs.python.org/3/library/pickle.html for the description of pickle opcodes.
+func appendGraphitePickle(dst []byte, points []graphitePoint, maxFrameSize int) []byte {
+	const (
+		opProto      = 0x80
+		opEmptyList  = ']'
+		opMark       = '('
+		opBinUnicode = 'X'
+		opBinInt     = 'J'
+		opLong1      = 0x8a
+		opBinFloat   = 'G'
+		opTuple2     = 0x86
+		opAppends    = 'e'
+		opStop       = '.'
+	)
+	frameHeader := []byte{opProto, 2, opEmptyList, opMark}
+	frameTrailer := []byte{opAppends, opStop}
+
+	headerOffset := -1
+	finishFrame := func() {
+		dst = append(dst, frameTrailer...)
+		binary.BigEndian.PutUint32(dst[headerOffset:], uint32(len(dst)-headerOffset-4))
+	}
+	var point []byte
+	for _, p := range points {
+		point = point[:0]
+		point = append(point, opBinUnicode)
+		point = appendUint32LE(point, uint32(len(p.path)))
+		point = append(point, p.path...)
+		if p.timestamp >= math.MinInt32 && p.timestamp <= math.MaxInt32 {
+			point = append(point, opBinInt)
+			point = appendUint32LE(point, uint32(int32(p.timestamp)))
+		} else {
+			point = append(point, opLong1, 8)
+			point = appendUint64LE(point, uint64(p.timestamp))
+		}
+		point = append(point, opBinFloat)
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], math.Float64bits(p.value))
+		point = append(point, buf[:]...)
+		point = append(point, opTuple2, opTuple2)
+
+		if headerOffset >= 0 {
+			frameSize := len(dst) - headerOffset - 4
+			if frameSize+len(point)+len(frameTrailer) > maxFrameSize {
+				finishFrame()
+				headerOffset = -1
+			}
+		}
+		if headerOffset < 0 {
+			headerOffset = len(dst)
+			dst = append(dst, 0, 0, 0, 0)
+			dst = append(dst, frameHeader...)
+		}
+		dst = append(dst, point...)
+	}
+	if headerOffset >= 0 {
+		finishFrame()
+	}
+	return dst
+}
+
+func appendUint32LE(dst []byte, n uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], n)
+	return append(dst, buf[:]...)
+}
+
+func appendUint64LE(dst []byte, n uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], n)
+	return append(dst, buf[:]...)
+}
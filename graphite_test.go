@@ -0,0 +1,310 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGraphiteGetPoints(t *testing.T) {
+	f := func(opts *GraphiteOptions, src, expectedResult string) {
+		t.Helper()
+		gc, err := newGraphiteContext("localhost:2003", opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		points := gc.getPoints([]byte(src), time.Unix(1700000000, 0))
+		result := appendGraphitePlaintext(nil, points)
+		if string(result) != expectedResult {
+			t.Fatalf("unexpected result; got\n%s\nwant\n%s", result, expectedResult)
+		}
+	}
+
+	// default paths
+	f(nil, "", "")
+	f(nil, "# TYPE foo counter\nfoo 123\n", "foo 123 1700000000\n")
+	f(nil, `foo{bar="baz",x="a.b c"} 1.5`, "foo.bar.baz.x.a_b_c 1.5 1700000000\n")
+	f(nil, `foo{bar=""} 1`, "foo.bar._ 1 1700000000\n")
+	f(nil, "foo NaN\nbar +Inf\nbaz 2\n", "baz 2 1700000000\n")
+
+	// prefix
+	f(&GraphiteOptions{
+		Prefix: "app.",
+	}, `foo{bar="baz"} 1`, "app.foo.bar.baz 1 1700000000\n")
+
+	// template
+	f(&GraphiteOptions{
+		Template: "{env}.{instance}.{__name__}",
+	}, `foo{env="prod",instance="host:80",path="/a"} 1`, "prod.host:80.foo.path._a 1 1700000000\n")
+	f(&GraphiteOptions{
+		Template: "{env}.{instance}.{__name__}",
+	}, `foo{instance="host"} 1`, "host.foo 1 1700000000\n")
+	f(&GraphiteOptions{
+		Prefix:   "app.",
+		Template: "{__name__}_total",
+	}, `foo 1`, "app.foo_total 1 1700000000\n")
+
+	// tags
+	f(&GraphiteOptions{
+		UseTags: true,
+	}, `foo{x="a;b",bar="baz",empty=""} 1`, "foo;bar=baz;x=a_b 1 1700000000\n")
+}
+
+func TestGraphiteInvalidOptions(t *testing.T) {
+	f := func(addr string, opts *GraphiteOptions) {
+		t.Helper()
+		if _, err := newGraphiteContext(addr, opts); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	f("", nil)
+	f("localhost", nil)
+	f("localhost:2003", &GraphiteOptions{
+		Template: "{foo",
+	})
+	f("localhost:2003", &GraphiteOptions{
+		Template: "{foo-bar}",
+	})
+}
+
+func TestAppendGraphitePickle(t *testing.T) {
+	points := []graphitePoint{
+		{
+			path:      "foo.bar",
+			value:     1.5,
+			timestamp: 1700000000,
+		},
+	}
+	result := appendGraphitePickle(nil, points, graphitePickleMaxFrameSize)
+	frame := "\x00\x00\x00\x22" +
+		"\x80\x02](" +
+		"X\x07\x00\x00\x00foo.bar" +
+		"J\x00\xf1\x53\x65" +
+		"G\x3f\xf8\x00\x00\x00\x00\x00\x00" +
+		"\x86\x86e."
+	if string(result) != frame {
+		t.Fatalf("unexpected result; got\n%q\nwant\n%q", result, frame)
+	}
+
+	// no points
+	if result := appendGraphitePickle(nil, nil, graphitePickleMaxFrameSize); len(result) != 0 {
+		t.Fatalf("unexpected result for empty points: %q", result)
+	}
+
+	// Every frame mustn't exceed maxFrameSize, so the points are split into frames.
+	points = append(points, points[0], points[0])
+	result = appendGraphitePickle(nil, points, 0x22)
+	if string(result) != frame+frame+frame {
+		t.Fatalf("unexpected result; got\n%q\nwant\n%q", result, frame+frame+frame)
+	}
+	frames2 := "\x00\x00\x00\x3e" +
+		"\x80\x02](" +
+		"X\x07\x00\x00\x00foo.bar" +
+		"J\x00\xf1\x53\x65" +
+		"G\x3f\xf8\x00\x00\x00\x00\x00\x00" +
+		"\x86\x86" +
+		"X\x07\x00\x00\x00foo.bar" +
+		"J\x00\xf1\x53\x65" +
+		"G\x3f\xf8\x00\x00\x00\x00\x00\x00" +
+		"\x86\x86e."
+	result = appendGraphitePickle(nil, points, 0x3e)
+	if string(result) != frames2+frame {
+		t.Fatalf("unexpected result; got\n%q\nwant\n%q", result, frames2+frame)
+	}
+
+	// The point exceeding maxFrameSize is sent in a separate frame.
+	result = appendGraphitePickle(nil, points[:1], 10)
+	if string(result) != frame {
+		t.Fatalf("unexpected result; got\n%q\nwant\n%q", result, frame)
+	}
+}
+
+func TestInitGraphiteWithOptions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer ln.Close()
+
+	linesCh := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				sc := bufio.NewScanner(conn)
+				for sc.Scan() {
+					linesCh <- sc.Text()
+				}
+			}()
+		}
+	}()
+
+	s := NewSet()
+	s.NewCounter(`foo{bar="baz"}`).Set(42)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if err := s.InitGraphiteWithOptions(ctx, ln.Addr().String(), 10*time.Millisecond, &GraphiteOptions{
+		Prefix:    "test.",
+		WaitGroup: &wg,
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	select {
+	case line := <-linesCh:
+		if !strings.HasPrefix(line, "test.foo.bar.baz 42 ") {
+			t.Fatalf("unexpected line: %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for metrics")
+	}
+	cancel()
+	wg.Wait()
+
+	// The first connection isn't a reconnect.
+	if n := pushMetricsSet.GetOrCreateCounter(`metrics_push_reconnects_total{url="tcp://` + ln.Addr().String() + `"}`).Get(); n != 0 {
+		t.Fatalf("unexpected number of reconnects; got %d; want 0", n)
+	}
+}
+
+func TestInitGraphiteWithOptionsPickle(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer ln.Close()
+
+	payloadCh := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var header [4]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[:]))
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return
+		}
+		payloadCh <- payload
+	}()
+
+	s := NewSet()
+	s.NewGauge(`foo`, nil).Set(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if err := s.InitGraphiteWithOptions(ctx, ln.Addr().String(), 10*time.Millisecond, &GraphiteOptions{
+		Pickle:    true,
+		WaitGroup: &wg,
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	select {
+	case payload := <-payloadCh:
+		if !strings.HasPrefix(string(payload), "\x80\x02](X\x03\x00\x00\x00foo") {
+			t.Fatalf("unexpected payload: %q", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for metrics")
+	}
+	cancel()
+	wg.Wait()
+}
+
+func TestGraphiteWritePartial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer ln.Close()
+
+	dataCh := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			data, _ := io.ReadAll(conn)
+			conn.Close()
+			dataCh <- data
+		}
+	}()
+
+	f := func(pickle bool, data []byte, written int, expected string) {
+		t.Helper()
+		gc, err := newGraphiteContext(ln.Addr().String(), &GraphiteOptions{
+			Pickle: pickle,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		gc.conn = &partialWriteConn{
+			n: written,
+		}
+		gc.hasConnected = true
+		reconnects := gc.reconnectsTotal.Get()
+		if err := gc.write(context.Background(), data); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		gc.close()
+		if n := gc.reconnectsTotal.Get() - reconnects; n != 1 {
+			t.Fatalf("unexpected number of reconnects; got %d; want 1", n)
+		}
+		select {
+		case result := <-dataCh:
+			if string(result) != expected {
+				t.Fatalf("unexpected data written after reconnect; got %q; want %q", result, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for data")
+		}
+	}
+
+	// The partially written line is written again, while the fully written line isn't duplicated.
+	f(false, []byte("foo 1 1700000000\nbar 2 1700000000\n"), 20, "bar 2 1700000000\n")
+
+	// The partially written frame is written again, while the fully written frame isn't duplicated.
+	points := []graphitePoint{
+		{
+			path:      "foo",
+			value:     1,
+			timestamp: 1700000000,
+		},
+	}
+	frame := appendGraphitePickle(nil, points, graphitePickleMaxFrameSize)
+	data := append(append([]byte{}, frame...), frame...)
+	f(true, data, len(frame)+5, string(frame))
+}
+
+// partialWriteConn is net.Conn, which writes only n bytes and then returns an error.
+type partialWriteConn struct {
+	net.Conn
+	n int
+}
+
+func (c *partialWriteConn) Write(p []byte) (int, error) {
+	return c.n, io.ErrClosedPipe
+}
+
+func (c *partialWriteConn) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
+
+func (c *partialWriteConn) Close() error {
+	return nil
+}
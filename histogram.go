@@ -153,6 +153,11 @@ func (h *Histogram) Merge(src *Histogram) {
 // with `le` (less or equal) labels.
 func (h *Histogram) VisitNonZeroBuckets(f func(vmrange string, count uint64)) {
 	h.mu.Lock()
+	h.visitNonZeroBucketsLocked(f)
+	h.mu.Unlock()
+}
+
+func (h *Histogram) visitNonZeroBucketsLocked(f func(vmrange string, count uint64)) {
 	if h.lower > 0 {
 		f(lowerBucketRange, h.lower)
 	}
@@ -171,7 +176,6 @@ func (h *Histogram) VisitNonZeroBuckets(f func(vmrange string, count uint64)) {
 	if h.upper > 0 {
 		f(upperBucketRange, h.upper)
 	}
-	h.mu.Unlock()
 }
 
 // NewHistogram creates and returns new histogram with the given name.
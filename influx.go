@@ -0,0 +1,225 @@
+package metrics
+
+import (
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WriteInfluxLine writes metrics from the default set and all the sets registered via RegisterSet to w
+// in InfluxDB line protocol with the given timestamp.
+//
+// If exposeProcessMetrics is true, then various `go_*` and `process_*` metrics are also written to w.
+//
+// See Set.WriteInfluxLine for details on how metrics are mapped to InfluxDB line protocol.
+func WriteInfluxLine(w io.Writer, ts time.Time, exposeProcessMetrics bool) {
+	bb := getBytesBuffer()
+	defer putBytesBuffer(bb)
+
+	WritePrometheus(bb, exposeProcessMetrics)
+	writeInfluxLine(w, bb.B, ts)
+}
+
+// WriteInfluxLine writes all the metrics from s to w in InfluxDB line protocol with the given timestamp.
+//
+// See https://docs.influxdata.com/influxdb/v2/reference/syntax/line-protocol/
+//
+// Metrics are mapped to InfluxDB line protocol in the following way:
+//
+//   - metric family name becomes measurement name
+//   - metric labels become tags
+//   - counter, gauge and untyped value becomes `value` field
+//   - histogram buckets become fields named by `le` or `vmrange` label values, while histogram sum and count
+//     become `sum` and `count` fields
+//   - summary quantiles become fields named by `quantile` label values, while summary sum and count
+//     become `sum` and `count` fields
+//
+// All the fields are written as floats. NaN and Inf values are skipped, since InfluxDB doesn't support them.
+// The timestamp is written with nanosecond precision.
+func (s *Set) WriteInfluxLine(w io.Writer, ts time.Time) {
+	bb := getBytesBuffer()
+	defer putBytesBuffer(bb)
+
+	s.WritePrometheus(bb)
+	writeInfluxLine(w, bb.B, ts)
+}
+
+func writeInfluxLine(w io.Writer, src []byte, ts time.Time) {
+	bb := getBytesBuffer()
+	defer putBytesBuffer(bb)
+
+	bb.B = appendInfluxLines(bb.B, src, ts)
+	w.Write(bb.B)
+}
+
+// appendInfluxLines converts metrics in Prometheus text exposition format from src to InfluxDB line protocol
+// with the given timestamp and appends the result to dst.
+func appendInfluxLines(dst, src []byte, ts time.Time) []byte {
+	var samples []*parsedSample
+	histogramFamilies := make(map[string]struct{})
+	summaryFamilies := make(map[string]struct{})
+	for _, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ps, err := parseSampleLine(line)
+		if err != nil {
+			log.Printf("ERROR: metrics: cannot convert sample to InfluxDB line protocol: %s", err)
+			continue
+		}
+		samples = append(samples, ps)
+		if isHistogramBucket(ps) {
+			histogramFamilies[strings.TrimSuffix(ps.name, "_bucket")] = struct{}{}
+		}
+		if hasLabel(ps.labels, "quantile") {
+			summaryFamilies[ps.name] = struct{}{}
+		}
+	}
+
+	isComplexFamily := func(family string) bool {
+		if _, ok := histogramFamilies[family]; ok {
+			return true
+		}
+		_, ok := summaryFamilies[family]
+		return ok
+	}
+
+	// Group fields by measurement and tags, while preserving the original order of series.
+	var points []*influxPoint
+	pointsByKey := make(map[string]*influxPoint)
+	for _, ps := range samples {
+		measurement := ps.name
+		fieldKey := "value"
+		labels := ps.labels
+		switch {
+		case isHistogramBucket(ps):
+			measurement = strings.TrimSuffix(ps.name, "_bucket")
+			fieldKey, labels = extractLabel(labels, "le", "vmrange")
+		case hasLabel(labels, "quantile"):
+			fieldKey, labels = extractLabel(labels, "quantile")
+		case strings.HasSuffix(ps.name, "_sum") && isComplexFamily(strings.TrimSuffix(ps.name, "_sum")):
+			measurement = strings.TrimSuffix(ps.name, "_sum")
+			fieldKey = "sum"
+		case strings.HasSuffix(ps.name, "_count") && isComplexFamily(strings.TrimSuffix(ps.name, "_count")):
+			measurement = strings.TrimSuffix(ps.name, "_count")
+			fieldKey = "count"
+		}
+		if math.IsNaN(ps.value) || math.IsInf(ps.value, 0) {
+			continue
+		}
+
+		key := appendInfluxSeriesKey(nil, measurement, labels)
+		p := pointsByKey[string(key)]
+		if p == nil {
+			p = &influxPoint{
+				key: key,
+			}
+			pointsByKey[string(key)] = p
+			points = append(points, p)
+		}
+		p.fields = append(p.fields, influxField{
+			key:   fieldKey,
+			value: ps.value,
+		})
+	}
+
+	timestamp := ts.UnixNano()
+	for _, p := range points {
+		dst = append(dst, p.key...)
+		dst = append(dst, ' ')
+		for i, f := range p.fields {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = appendInfluxEscaped(dst, f.key, ",= ")
+			dst = append(dst, '=')
+			dst = strconv.AppendFloat(dst, f.value, 'g', -1, 64)
+		}
+		dst = append(dst, ' ')
+		dst = strconv.AppendInt(dst, timestamp, 10)
+		dst = append(dst, '\n')
+	}
+	return dst
+}
+
+type influxPoint struct {
+	key    []byte
+	fields []influxField
+}
+
+type influxField struct {
+	key   string
+	value float64
+}
+
+func isHistogramBucket(ps *parsedSample) bool {
+	return strings.HasSuffix(ps.name, "_bucket") && (hasLabel(ps.labels, "le") || hasLabel(ps.labels, "vmrange"))
+}
+
+func hasLabel(labels []Label, name string) bool {
+	for _, label := range labels {
+		if label.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// extractLabel returns the value of the first found label with one of the given names
+// and the remaining labels without the found label.
+func extractLabel(labels []Label, names ...string) (string, []Label) {
+	for i, label := range labels {
+		for _, name := range names {
+			if label.Name != name {
+				continue
+			}
+			rest := append([]Label{}, labels[:i]...)
+			rest = append(rest, labels[i+1:]...)
+			return label.Value, rest
+		}
+	}
+	return "", labels
+}
+
+// appendInfluxSeriesKey appends measurement with tags sorted by name to dst.
+//
+// Tags with empty values are skipped, since InfluxDB doesn't support them.
+func appendInfluxSeriesKey(dst []byte, measurement string, labels []Label) []byte {
+	dst = appendInfluxEscaped(dst, measurement, ", ")
+	tags := append([]Label{}, labels...)
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].Name < tags[j].Name
+	})
+	for _, tag := range tags {
+		if len(tag.Value) == 0 {
+			continue
+		}
+		dst = append(dst, ',')
+		dst = appendInfluxEscaped(dst, tag.Name, ",= ")
+		dst = append(dst, '=')
+		dst = appendInfluxEscaped(dst, tag.Value, ",= ")
+	}
+	return dst
+}
+
+// appendInfluxEscaped appends s to dst with the escaped special chars.
+//
+// Newlines are replaced with spaces, since they cannot be escaped in InfluxDB line protocol.
+func appendInfluxEscaped(dst []byte, s, specialChars string) []byte {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\n' {
+			c = ' '
+		}
+		if strings.IndexByte(specialChars, c) >= 0 || c == '\\' && i == len(s)-1 {
+			dst = append(dst, '\\')
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
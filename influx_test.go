@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestAppendInfluxLines(t *testing.T) {
+	ts := time.Unix(1700000000, 123)
+	f := func(s, expected string) {
+		t.Helper()
+		result := appendInfluxLines(nil, []byte(s), ts)
+		if string(result) != expected {
+			t.Fatalf("unexpected result; got\n%s\nwant\n%s", result, expected)
+		}
+	}
+	f("", "")
+	f("# HELP foo\n# TYPE foo gauge\nfoo 1.5\n", "foo value=1.5 1700000000000000123\n")
+	f(`foo{z="1",a="b c",e=""} 2`, `foo,a=b\ c,z=1 value=2 1700000000000000123`+"\n")
+	f(`foo{a="x,y=z"} NaN
+bar +Inf
+baz 3
+`, "baz value=3 1700000000000000123\n")
+
+	// Counter with _count suffix without histogram or summary family
+	f("requests_count 5\n", "requests_count value=5 1700000000000000123\n")
+
+	// HistogramStatic
+	f(`duration_bucket{path="/",le="1.000e-01"} 1
+duration_bucket{path="/",le="+Inf"} 2
+duration_sum{path="/"} 0.25
+duration_count{path="/"} 2
+`, `duration,path=/ 1.000e-01=1,+Inf=2,sum=0.25,count=2 1700000000000000123`+"\n")
+
+	// Histogram
+	f(`latency_bucket{vmrange="8.799e-01...1.000e+00"} 2
+latency_sum 2
+latency_count 2
+`, `latency 8.799e-01...1.000e+00=2,sum=2,count=2 1700000000000000123`+"\n")
+
+	// Summary
+	f(`rt_sum 6
+rt_count 2
+rt{quantile="0.5"} 2
+rt{quantile="1"} 4
+`, `rt sum=6,count=2,0.5=2,1=4 1700000000000000123`+"\n")
+}
+
+func TestSetWriteInfluxLine(t *testing.T) {
+	s := NewSet()
+	s.NewCounter(`requests_total{path="/foo"}`).Set(10)
+	s.NewGauge("temperature", func() float64 { return 21.5 })
+	h := s.NewHistogramStatic(`duration_seconds{path="/foo"}`, []float64{0.1})
+	h.Update(0.05)
+
+	var bb bytes.Buffer
+	s.WriteInfluxLine(&bb, time.Unix(1, 0))
+	result := bb.String()
+	expected := `duration_seconds,path=/foo 1.000e-01=1,+Inf=1,sum=0.05,count=1 1000000000
+requests_total,path=/foo value=10 1000000000
+temperature value=21.5 1000000000
+`
+	if result != expected {
+		t.Fatalf("unexpected result; got\n%s\nwant\n%s", result, expected)
+	}
+}
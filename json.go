@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// WriteJSON writes metrics from the default set and all the sets registered via RegisterSet to w in JSON format.
+//
+// See Set.WriteJSON for the description of the JSON format.
+func WriteJSON(w io.Writer) {
+	writeJSON(w, Snapshot())
+}
+
+// WriteJSON writes all the metrics from s to w in JSON format.
+//
+// The output has the following format:
+//
+//	{"metrics":[
+//	  {"name":"requests_total{path=\"/foo\"}","family":"requests_total","labels":{"path":"/foo"},"type":"counter","value":10},
+//	  {"name":"temperature","family":"temperature","type":"gauge","value":21.5},
+//	  {"name":"duration_seconds","family":"duration_seconds","type":"histogram","bucket_label":"le",
+//	   "buckets":[{"range":"1.000e-01","lower":0,"upper":0.1,"count":3},{"range":"+Inf","lower":0.1,"upper":"+Inf","count":1}],
+//	   "sum":0.45,"count":4},
+//	  {"name":"response_size_bytes","family":"response_size_bytes","type":"summary",
+//	   "quantiles":[{"quantile":0.5,"value":1024},{"quantile":0.99,"value":4096}],"sum":10240,"count":8}
+//	]}
+//
+// Where:
+//
+//   - value is set for counter, gauge and untyped metrics
+//   - bucket_label and buckets are set for histogram metrics. bucket_label is `le` for HistogramStatic and `vmrange` for Histogram
+//   - bucket count isn't cumulative, e.g. it doesn't include values from the previous buckets
+//   - quantiles are set for summary metrics
+//   - sum and count are set for histogram and summary metrics
+//   - NaN, +Inf and -Inf values are written as "NaN", "+Inf" and "-Inf" strings
+//
+// See also Set.Snapshot.
+func (s *Set) WriteJSON(w io.Writer) {
+	writeJSON(w, s.Snapshot())
+}
+
+func writeJSON(w io.Writer, mss []MetricSnapshot) {
+	metrics := make([]jsonMetric, len(mss))
+	for i := range mss {
+		metrics[i].init(&mss[i])
+	}
+	data, err := json.Marshal(&jsonMetrics{
+		Metrics: metrics,
+	})
+	if err != nil {
+		panic(fmt.Errorf("BUG: cannot marshal metrics to JSON: %w", err))
+	}
+	data = append(data, '\n')
+	w.Write(data)
+}
+
+type jsonMetrics struct {
+	Metrics []jsonMetric `json:"metrics"`
+}
+
+type jsonMetric struct {
+	Name        string            `json:"name"`
+	Family      string            `json:"family"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Type        string            `json:"type"`
+	Value       *jsonFloat        `json:"value,omitempty"`
+	BucketLabel string            `json:"bucket_label,omitempty"`
+	Buckets     []jsonBucket      `json:"buckets,omitempty"`
+	Quantiles   []jsonQuantile    `json:"quantiles,omitempty"`
+	Sum         *jsonFloat        `json:"sum,omitempty"`
+	Count       *uint64           `json:"count,omitempty"`
+}
+
+type jsonBucket struct {
+	Range string    `json:"range"`
+	Lower jsonFloat `json:"lower"`
+	Upper jsonFloat `json:"upper"`
+	Count uint64    `json:"count"`
+}
+
+type jsonQuantile struct {
+	Quantile jsonFloat `json:"quantile"`
+	Value    jsonFloat `json:"value"`
+}
+
+func (jm *jsonMetric) init(ms *MetricSnapshot) {
+	jm.Name = ms.Name
+	jm.Family = ms.Family
+	if len(ms.Labels) > 0 {
+		jm.Labels = make(map[string]string, len(ms.Labels))
+		for _, label := range ms.Labels {
+			jm.Labels[label.Name] = label.Value
+		}
+	}
+	jm.Type = ms.Type
+	switch ms.Type {
+	case "histogram", "summary":
+		jm.BucketLabel = ms.BucketLabel
+		for _, b := range ms.Buckets {
+			jm.Buckets = append(jm.Buckets, jsonBucket{
+				Range: b.Range,
+				Lower: jsonFloat(b.Lower),
+				Upper: jsonFloat(b.Upper),
+				Count: b.Count,
+			})
+		}
+		for _, q := range ms.Quantiles {
+			jm.Quantiles = append(jm.Quantiles, jsonQuantile{
+				Quantile: jsonFloat(q.Quantile),
+				Value:    jsonFloat(q.Value),
+			})
+		}
+		sum := jsonFloat(ms.Sum)
+		count := ms.Count
+		jm.Sum = &sum
+		jm.Count = &count
+	default:
+		v := jsonFloat(ms.Value)
+		jm.Value = &v
+	}
+}
+
+// jsonFloat is float64, which is marshaled to JSON string for NaN and Inf values.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	switch {
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(v, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Inf"`), nil
+	}
+	return strconv.AppendFloat(nil, v, 'g', -1, 64), nil
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestSetWriteJSON(t *testing.T) {
+	s := NewSet()
+	s.NewCounter(`requests_total{path="/foo"}`).Set(10)
+	s.NewGauge("temperature", func() float64 { return 21.5 })
+	s.NewGauge("nan", func() float64 { return math.NaN() })
+	h := s.NewHistogramStatic("duration_seconds", []float64{0.1})
+	h.Update(0.05)
+	h.Update(0.2)
+
+	var bb bytes.Buffer
+	s.WriteJSON(&bb)
+	result := bb.String()
+	expected := `{"metrics":[` +
+		`{"name":"duration_seconds","family":"duration_seconds","type":"histogram","bucket_label":"le",` +
+		`"buckets":[{"range":"1.000e-01","lower":0,"upper":0.1,"count":1},{"range":"+Inf","lower":0.1,"upper":"+Inf","count":1}],` +
+		`"sum":0.25,"count":2},` +
+		`{"name":"nan","family":"nan","type":"gauge","value":"NaN"},` +
+		`{"name":"requests_total{path=\"/foo\"}","family":"requests_total","labels":{"path":"/foo"},"type":"counter","value":10},` +
+		`{"name":"temperature","family":"temperature","type":"gauge","value":21.5}` +
+		`]}` + "\n"
+	if result != expected {
+		t.Fatalf("unexpected JSON; got\n%s\nwant\n%s", result, expected)
+	}
+	if !json.Valid(bb.Bytes()) {
+		t.Fatalf("invalid JSON: %s", result)
+	}
+}
+
+func TestSetWriteJSONSummary(t *testing.T) {
+	s := NewSet()
+	sm := s.NewSummaryExt("response_size_bytes", defaultSummaryWindow, []float64{0.5})
+	sm.Update(1024)
+
+	var bb bytes.Buffer
+	s.WriteJSON(&bb)
+	result := bb.String()
+	expected := `{"metrics":[{"name":"response_size_bytes","family":"response_size_bytes","type":"summary",` +
+		`"quantiles":[{"quantile":0.5,"value":1024}],"sum":1024,"count":1}]}` + "\n"
+	if result != expected {
+		t.Fatalf("unexpected JSON; got\n%s\nwant\n%s", result, expected)
+	}
+}
+
+func TestSetWriteJSONEmpty(t *testing.T) {
+	s := NewSet()
+	var bb bytes.Buffer
+	s.WriteJSON(&bb)
+	if result, expected := bb.String(), `{"metrics":[]}`+"\n"; result != expected {
+		t.Fatalf("unexpected JSON; got\n%s\nwant\n%s", result, expected)
+	}
+}
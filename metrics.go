@@ -15,10 +15,12 @@ package metrics
 import (
 	"fmt"
 	"io"
+	"net/http"
 	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -31,6 +33,7 @@ type namedMetric struct {
 type metric interface {
 	marshalTo(prefix string, w io.Writer)
 	metricType() string
+	appendSnapshot(dst []MetricSnapshot, name string) []MetricSnapshot
 }
 
 var defaultSet = NewSet()
@@ -67,6 +70,21 @@ func UnregisterSet(s *Set, destroySet bool) {
 	}
 }
 
+// getRegisteredSets returns sets registered via RegisterSet in stable order.
+func getRegisteredSets() []*Set {
+	registeredSetsLock.Lock()
+	sets := make([]*Set, 0, len(registeredSets))
+	for s := range registeredSets {
+		sets = append(sets, s)
+	}
+	registeredSetsLock.Unlock()
+
+	sort.Slice(sets, func(i, j int) bool {
+		return uintptr(unsafe.Pointer(sets[i])) < uintptr(unsafe.Pointer(sets[j]))
+	})
+	return sets
+}
+
 // RegisterMetricsWriter registers writeMetrics callback for including metrics in the output generated by WritePrometheus.
 //
 // The writeMetrics callback must write metrics to w in Prometheus text exposition format without timestamps and trailing comments.
@@ -92,17 +110,7 @@ func RegisterMetricsWriter(writeMetrics func(w io.Writer)) {
 //	    metrics.WritePrometheus(w, true)
 //	})
 func WritePrometheus(w io.Writer, exposeProcessMetrics bool) {
-	registeredSetsLock.Lock()
-	sets := make([]*Set, 0, len(registeredSets))
-	for s := range registeredSets {
-		sets = append(sets, s)
-	}
-	registeredSetsLock.Unlock()
-
-	sort.Slice(sets, func(i, j int) bool {
-		return uintptr(unsafe.Pointer(sets[i])) < uintptr(unsafe.Pointer(sets[j]))
-	})
-	for _, s := range sets {
+	for _, s := range getRegisteredSets() {
 		s.WritePrometheus(w)
 	}
 	if exposeProcessMetrics {
@@ -110,6 +118,18 @@ func WritePrometheus(w io.Writer, exposeProcessMetrics bool) {
 	}
 }
 
+// PrometheusHandler returns http.Handler, which exposes metrics in Prometheus format like WritePrometheus does.
+//
+// If rcs isn't nil, then it is applied to the exposed metrics. See NewRelabelConfigs.
+//
+//	http.Handle("/metrics", metrics.PrometheusHandler(true, nil))
+func PrometheusHandler(exposeProcessMetrics bool, rcs *RelabelConfigs) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WritePrometheusWithRelabeling(w, exposeProcessMetrics, rcs)
+	})
+}
+
 // WriteProcessMetrics writes additional process metrics in Prometheus format to w.
 //
 // The following `go_*` and `process_*` metrics are exposed for the currently
@@ -155,6 +175,48 @@ func WritePrometheus(w io.Writer, exposeProcessMetrics bool) {
 //
 //   - process_io_storage_written_bytes_total - the number of bytes actually written to disk
 //
+//   - process_context_switches_voluntary_total - the number of voluntary context switches for the main process thread
+//
+//   - process_context_switches_nonvoluntary_total - the number of involuntary context switches for the main process thread
+//
+//   - process_main_thread_schedstat_running_seconds_total - the time spent by the main process thread on CPU
+//
+//   - process_main_thread_schedstat_waiting_seconds_total - the time spent by the main process thread waiting for CPU in the run queue
+//
+//   - process_main_thread_schedstat_timeslices_total - the number of timeslices run by the main process thread
+//
+//   - process_oom_score - the OOM killer score of the process. The process with the highest score is killed first
+//
+//   - process_oom_score_adj - the adjustment of the OOM killer score
+//
+//   - process_pressure_{cpu,memory,io}_waiting_seconds_total - the time when some tasks were stalled on the resource
+//     according to Linux pressure stall information. The `scope` label is `system` for the host and `cgroup` for the process cgroup
+//
+//   - process_pressure_{cpu,memory,io}_stalled_seconds_total - the time when all the non-idle tasks were stalled on the resource
+//
+//   - process_cgroup_memory_usage_bytes - memory usage of the process cgroup on Linux.
+//     process_cgroup_* metrics are exposed only if the corresponding cgroup controller is available
+//
+//   - process_cgroup_memory_limit_bytes - memory limit of the process cgroup. It isn't exposed if there is no limit
+//
+//   - process_cgroup_memory_anon_bytes - anonymous memory usage of the process cgroup
+//
+//   - process_cgroup_memory_file_bytes - page cache usage of the process cgroup
+//
+//   - process_cgroup_memory_kernel_bytes - kernel memory usage of the process cgroup
+//
+//   - process_cgroup_cpu_quota_cores - CPU quota of the process cgroup in CPU cores. It isn't exposed if there is no quota
+//
+//   - process_cgroup_cpu_periods_total - the number of CPU quota enforcement periods for the process cgroup
+//
+//   - process_cgroup_cpu_throttled_periods_total - the number of periods when the process cgroup was throttled
+//
+//   - process_cgroup_cpu_throttled_seconds_total - the total time the process cgroup was throttled
+//
+//   - process_cgroup_pids - the number of tasks in the process cgroup
+//
+//   - process_cgroup_pids_limit - the limit on the number of tasks in the process cgroup. It isn't exposed if there is no limit
+//
 //   - go_sched_latencies_seconds - time spent by goroutines in ready state before they start execution
 //
 //   - go_mutex_wait_seconds_total - summary time spent by all the goroutines while waiting for locked mutex
@@ -229,10 +291,13 @@ func WritePrometheus(w io.Writer, exposeProcessMetrics bool) {
 //	    metrics.WriteProcessMetrics(w)
 //	})
 //
+// Metrics for processes registered via WatchProcess are written too with `process_pid_` prefix.
+//
 // See also WriteFDMetrics.
 func WriteProcessMetrics(w io.Writer) {
 	writeGoMetrics(w)
 	writeProcessMetrics(w)
+	writeWatchedProcessMetrics(w)
 	writePushMetrics(w)
 }
 
@@ -241,6 +306,40 @@ func WriteFDMetrics(w io.Writer) {
 	writeFDMetrics(w)
 }
 
+// FDTypeMetricsOptions contains options for WriteFDTypeMetrics.
+type FDTypeMetricsOptions struct {
+	// CacheDuration is the duration for caching file descriptor counts between WriteFDTypeMetrics calls.
+	//
+	// By default the counts are obtained on every WriteFDTypeMetrics call.
+	CacheDuration time.Duration
+
+	// MaxSampledFDs is the maximum number of file descriptors to inspect. If the process has more open file descriptors,
+	// then randomly chosen file descriptors are inspected and the counts are extrapolated to all the open file descriptors.
+	//
+	// By default all the open file descriptors are inspected.
+	MaxSampledFDs int
+}
+
+// WriteFDTypeMetrics writes `process_open_fds_by_type{type="..."}` metrics to w.
+//
+// The type is one of socket, pipe, eventfd, anon_inode, file or other.
+// The types are obtained by reading every open file descriptor link on Linux, which may be expensive for processes
+// with big number of open file descriptors, so WriteFDTypeMetrics isn't called by WriteFDMetrics.
+// Use opts for limiting the cost. opts may be nil.
+func WriteFDTypeMetrics(w io.Writer, opts *FDTypeMetricsOptions) {
+	writeFDTypeMetrics(w, opts)
+}
+
+// WriteNetMetrics writes `process_net_*` metrics to w.
+//
+// The metrics include TCP and UDP counters such as retransmitted segments and the number of sockets by state.
+// They are obtained from /proc/self/net on Linux, so they cover all the sockets in the network namespace of the process.
+// It is expensive obtaining the number of TCP sockets by state when big number of sockets is opened,
+// so WriteNetMetrics isn't called by WriteProcessMetrics.
+func WriteNetMetrics(w io.Writer) {
+	writeNetMetrics(w)
+}
+
 // UnregisterMetric removes metric with the given name from default set.
 //
 // See also UnregisterAllMetrics.
@@ -250,7 +349,8 @@ func UnregisterMetric(name string) bool {
 
 // UnregisterAllMetrics unregisters all the metrics from default set.
 //
-// It also unregisters writeMetrics callbacks passed to RegisterMetricsWriter.
+// It also unregisters writeMetrics callbacks passed to RegisterMetricsWriter
+// and collect callbacks passed to RegisterCollector.
 func UnregisterAllMetrics() {
 	defaultSet.UnregisterAllMetrics()
 }
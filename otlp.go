@@ -0,0 +1,864 @@
+package metrics
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OTLPOptions is the list of options, which may be applied to InitOTLPWithOptions().
+type OTLPOptions struct {
+	// PushOptions contains options for pushing metrics to pushURL.
+	//
+	// ExtraLabels are added to attributes of all the data points.
+	// RelabelConfigs are applied to metric names and attributes of every series after adding ExtraLabels.
+	// The `__name__` label contains the metric family name, e.g. histogram names have no `_bucket`, `_sum` and `_count` suffixes.
+	// Method is POST by default. Format, InfluxOrg, InfluxBucket, Pushgateway and AppendTimestamps options are ignored.
+	// MaxBodySize isn't supported.
+	//
+	// DeltaTemporality enables pushing counters and histograms with delta aggregation temporality.
+	// Summaries are always pushed with cumulative values.
+	PushOptions
+
+	// Encoding is the encoding for the pushed metrics.
+	//
+	// By default metrics are encoded in protobuf.
+	Encoding OTLPEncoding
+
+	// ResourceAttributes is an optional list of attributes for the resource, which exposes the pushed metrics.
+	// For example, {"service.name": "my-service"}.
+	ResourceAttributes map[string]string
+}
+
+// OTLPEncoding is the encoding for the metrics pushed via OTLP/HTTP.
+type OTLPEncoding int
+
+const (
+	// OTLPEncodingProtobuf is binary protobuf encoding with `application/x-protobuf` content type.
+	OTLPEncodingProtobuf OTLPEncoding = iota
+
+	// OTLPEncodingJSON is JSON protobuf encoding with `application/json` content type.
+	OTLPEncodingJSON
+)
+
+// InitOTLPWithOptions sets up periodic push for globally registered metrics to the given OTLP/HTTP pushURL with the given interval.
+//
+// See Set.InitOTLPWithOptions for details.
+func InitOTLPWithOptions(ctx context.Context, pushURL string, interval time.Duration, opts *OTLPOptions) error {
+	return initOTLP(ctx, pushURL, interval, Snapshot, opts)
+}
+
+// InitOTLPWithOptions sets up periodic push for metrics from s to the given OTLP/HTTP pushURL with the given interval.
+//
+// It is recommended pushing metrics to `/v1/metrics` endpoint of OpenTelemetry collector.
+// See https://opentelemetry.io/docs/specs/otlp/#otlphttp
+//
+// Metrics are mapped to OpenTelemetry metrics in the following way:
+//
+//   - Counter and FloatCounter are pushed as cumulative monotonic Sum
+//   - Gauge and untyped metrics are pushed as Gauge
+//   - HistogramStatic is pushed as cumulative Histogram with explicit buckets
+//   - Histogram is pushed as cumulative ExponentialHistogram. Histogram buckets do not match exponential buckets,
+//     so every Histogram bucket is put into the exponential bucket, which contains its middle point
+//   - Summary is pushed as Summary
+//
+// Sums and histograms are pushed with delta aggregation temporality instead of cumulative if opts.DeltaTemporality is set.
+//
+// The periodic push is stopped when ctx is canceled.
+// It is possible to wait until the background metrics push worker is stopped on a WaitGroup passed via opts.WaitGroup.
+//
+// opts may contain additional configuration options if non-nil.
+func (s *Set) InitOTLPWithOptions(ctx context.Context, pushURL string, interval time.Duration, opts *OTLPOptions) error {
+	return initOTLP(ctx, pushURL, interval, s.Snapshot, opts)
+}
+
+// PushOTLP pushes globally registered metrics to the given OTLP/HTTP pushURL.
+//
+// See Set.InitOTLPWithOptions for details.
+func PushOTLP(ctx context.Context, pushURL string, opts *OTLPOptions) error {
+	oc, err := newOTLPContext(pushURL, opts)
+	if err != nil {
+		return err
+	}
+	return oc.pushMetrics(ctx, Snapshot())
+}
+
+// PushOTLP pushes metrics from s to the given OTLP/HTTP pushURL.
+//
+// See Set.InitOTLPWithOptions for details.
+func (s *Set) PushOTLP(ctx context.Context, pushURL string, opts *OTLPOptions) error {
+	oc, err := newOTLPContext(pushURL, opts)
+	if err != nil {
+		return err
+	}
+	return oc.pushMetrics(ctx, s.Snapshot())
+}
+
+func initOTLP(ctx context.Context, pushURL string, interval time.Duration, snapshot func() []MetricSnapshot, opts *OTLPOptions) error {
+	oc, err := newOTLPContext(pushURL, opts)
+	if err != nil {
+		return err
+	}
+
+	// validate interval
+	if interval <= 0 {
+		return fmt.Errorf("interval must be positive; got %s", interval)
+	}
+	pushMetricsSet.GetOrCreateFloatCounter(fmt.Sprintf(`metrics_push_interval_seconds{url=%q}`, oc.pc.pushURLRedacted)).Set(interval.Seconds())
+
+	var pushOpts *PushOptions
+	if opts != nil {
+		pushOpts = &opts.PushOptions
+	}
+	sched, err := newPushScheduleFromOptions(pushOpts, oc.pc.pushURLRedacted)
+	if err != nil {
+		return err
+	}
+	var wg *sync.WaitGroup
+	push := func(ctx context.Context) error {
+		return oc.pushMetrics(ctx, snapshot())
+	}
+	var onStop func()
+	if opts != nil {
+		wg = opts.WaitGroup
+		if opts.FlushOnStop {
+			onStop = newFlushOnStop(interval, opts.FlushTimeout, push)
+		}
+	}
+	startPeriodicPush(ctx, interval, sched, wg, push, onStop)
+
+	return nil
+}
+
+type otlpContext struct {
+	pc                 *pushContext
+	encoding           OTLPEncoding
+	extraAttributes    []Label
+	resourceAttributes []otlpKeyValue
+
+	// lastPushTime is the time of the last successful push. It is used as the start time for deltas.
+	lastPushTime atomic.Value
+}
+
+func newOTLPContext(pushURL string, opts *OTLPOptions) (*otlpContext, error) {
+	if opts == nil {
+		opts = &OTLPOptions{}
+	}
+
+	if opts.MaxBodySize > 0 {
+		return nil, fmt.Errorf("MaxBodySize isn't supported for OTLP push")
+	}
+
+	pushOpts := opts.PushOptions
+	pushOpts.AppendTimestamps = false
+	pushOpts.Format = PushFormatPrometheus
+	pushOpts.PushgatewayJob = ""
+	if pushOpts.Method == "" {
+		pushOpts.Method = http.MethodPost
+	}
+	pc, err := newPushContext(pushURL, &pushOpts)
+	if err != nil {
+		return nil, err
+	}
+	switch opts.Encoding {
+	case OTLPEncodingProtobuf:
+		pc.contentType = "application/x-protobuf"
+	case OTLPEncodingJSON:
+		pc.contentType = "application/json"
+	default:
+		return nil, fmt.Errorf("unsupported Encoding=%d", opts.Encoding)
+	}
+
+	var extraAttributes []Label
+	if len(pc.extraLabels) > 0 {
+		labels, _, err := parseLabels(pc.extraLabels + "}")
+		if err != nil {
+			panic(fmt.Errorf("BUG: cannot parse already validated extraLabels=%q: %w", pc.extraLabels, err))
+		}
+		extraAttributes = labels
+	}
+
+	keys := make([]string, 0, len(opts.ResourceAttributes))
+	for k := range opts.ResourceAttributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	resourceAttributes := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		resourceAttributes = append(resourceAttributes, newOTLPKeyValue(k, opts.ResourceAttributes[k]))
+	}
+
+	return &otlpContext{
+		pc:                 pc,
+		encoding:           opts.Encoding,
+		extraAttributes:    extraAttributes,
+		resourceAttributes: resourceAttributes,
+	}, nil
+}
+
+func (oc *otlpContext) pushMetrics(ctx context.Context, mss []MetricSnapshot) error {
+	if oc.pc.relabelConfigs != nil {
+		mss = oc.relabelSnapshots(mss)
+	}
+	ds := oc.pc.deltaState
+	var currValues map[string]float64
+	if ds != nil {
+		mss, currValues = appendOTLPDeltas(nil, mss, ds)
+	}
+	now := time.Now()
+	req := oc.newExportRequest(mss, now)
+
+	bb := getBytesBuffer()
+	defer putBytesBuffer(bb)
+	switch oc.encoding {
+	case OTLPEncodingJSON:
+		data, err := json.Marshal(req)
+		if err != nil {
+			panic(fmt.Errorf("BUG: cannot marshal OTLP request to JSON: %w", err))
+		}
+		bb.B = append(bb.B[:0], data...)
+	default:
+		bb.B = req.marshalProtobuf(bb.B[:0])
+	}
+	err := oc.pc.push(ctx, bb)
+	if ds != nil {
+		// Deltas are accumulated until the successful push.
+		if err == nil {
+			ds.commit(currValues)
+			oc.lastPushTime.Store(now)
+		}
+		ds.forgetMissing(currValues)
+	}
+	if errors.Is(err, errPushCanceled) {
+		// The push is canceled, e.g. because of the application shutdown.
+		return nil
+	}
+	return err
+}
+
+// appendOTLPDeltas appends mss to dst after converting counters and histograms to deltas since the last successful push in ds.
+//
+// It returns the cumulative values, which must be passed to ds.commit after the successful push
+// and to ds.forgetMissing after every push attempt.
+func appendOTLPDeltas(dst, mss []MetricSnapshot, ds *pushDeltaState) ([]MetricSnapshot, map[string]float64) {
+	currValues := make(map[string]float64)
+	for _, ms := range mss {
+		switch ms.Type {
+		case "counter":
+			currValues[ms.Name] = ms.Value
+			if prev, ok := ds.getPrevValue(ms.Name); ok && ms.Value >= prev {
+				ms.Value -= prev
+			}
+		case "histogram":
+			countKey := ms.Name + " count"
+			sumKey := ms.Name + " sum"
+			currValues[countKey] = float64(ms.Count)
+			currValues[sumKey] = ms.Sum
+			for _, b := range ms.Buckets {
+				currValues[ms.Name+" bucket "+b.Range] = float64(b.Count)
+			}
+			prevCount, ok := ds.getPrevValue(countKey)
+			if !ok || float64(ms.Count) < prevCount {
+				// New or reset histogram is pushed with full values.
+				break
+			}
+			ms.Count -= uint64(prevCount)
+			if prevSum, ok := ds.getPrevValue(sumKey); ok {
+				ms.Sum -= prevSum
+			}
+			buckets := make([]BucketSnapshot, len(ms.Buckets))
+			for i, b := range ms.Buckets {
+				if prev, ok := ds.getPrevValue(ms.Name + " bucket " + b.Range); ok && float64(b.Count) >= prev {
+					b.Count -= uint64(prev)
+				}
+				buckets[i] = b
+			}
+			ms.Buckets = buckets
+		}
+		dst = append(dst, ms)
+	}
+	return dst, currValues
+}
+
+// otlpStartTime is used as the start time for cumulative metrics.
+var otlpStartTime = time.Now()
+
+// otlpExpHistogramScale is the scale for exponential histograms generated from Histogram.
+//
+// The base for this scale is 2^(2^-3) ≈ 1.09, so it is more precise than Histogram buckets with ≈ 1.14 ratio between bounds.
+const otlpExpHistogramScale = 3
+
+const (
+	otlpAggregationTemporalityDelta      = 1
+	otlpAggregationTemporalityCumulative = 2
+)
+
+// relabelSnapshots applies oc.pc.relabelConfigs to mss and returns the result.
+//
+// ExtraLabels are added to labels of the returned snapshots, since they are visible to relabeling.
+func (oc *otlpContext) relabelSnapshots(mss []MetricSnapshot) []MetricSnapshot {
+	dst := make([]MetricSnapshot, 0, len(mss))
+	for _, ms := range mss {
+		labels := make([]Label, 0, 1+len(oc.extraAttributes)+len(ms.Labels))
+		labels = append(labels, Label{
+			Name:  "__name__",
+			Value: ms.Family,
+		})
+		labels = append(labels, oc.extraAttributes...)
+		labels = append(labels, ms.Labels...)
+		labels = oc.pc.relabelConfigs.apply(labels)
+		if labels == nil {
+			continue
+		}
+		family := getLabelValue(labels, "__name__")
+		if err := validateIdent(family); err != nil {
+			log.Printf("ERROR: metrics: invalid metric name after relabeling %q: %s", ms.Name, err)
+			continue
+		}
+		ms.Family = family
+		ms.Labels = setLabel(labels, "__name__", "")
+		ms.Name = marshalMetricName(family, ms.Labels)
+		dst = append(dst, ms)
+	}
+	return dst
+}
+
+func (oc *otlpContext) newExportRequest(mss []MetricSnapshot, now time.Time) *otlpExportRequest {
+	cumulativeStartTime := otlpUint64(otlpStartTime.UnixNano())
+	startTime := cumulativeStartTime
+	temporality := otlpAggregationTemporalityCumulative
+	if oc.pc.deltaState != nil {
+		temporality = otlpAggregationTemporalityDelta
+		if t, ok := oc.lastPushTime.Load().(time.Time); ok {
+			startTime = otlpUint64(t.UnixNano())
+		}
+	}
+	ts := otlpUint64(now.UnixNano())
+	extraAttributes := oc.extraAttributes
+	if oc.pc.relabelConfigs != nil {
+		// ExtraLabels are already added to labels by relabelSnapshots.
+		extraAttributes = nil
+	}
+
+	var metrics []*otlpMetric
+	metricsByKey := make(map[string]*otlpMetric)
+	getMetric := func(ms *MetricSnapshot) *otlpMetric {
+		key := ms.Family + " " + ms.Type
+		m := metricsByKey[key]
+		if m == nil {
+			m = &otlpMetric{
+				Name: ms.Family,
+			}
+			switch ms.Type {
+			case "counter":
+				m.Sum = &otlpSum{
+					AggregationTemporality: temporality,
+					IsMonotonic:            true,
+				}
+			case "histogram":
+				if ms.BucketLabel == "vmrange" {
+					m.ExponentialHistogram = &otlpExponentialHistogram{
+						AggregationTemporality: temporality,
+					}
+				} else {
+					m.Histogram = &otlpHistogram{
+						AggregationTemporality: temporality,
+					}
+				}
+			case "summary":
+				m.Summary = &otlpSummary{}
+			default:
+				m.Gauge = &otlpGauge{}
+			}
+			metricsByKey[key] = m
+			metrics = append(metrics, m)
+		}
+		return m
+	}
+
+	for i := range mss {
+		ms := &mss[i]
+		m := getMetric(ms)
+		attributes := getOTLPAttributes(extraAttributes, ms.Labels)
+		switch {
+		case m.Sum != nil:
+			m.Sum.DataPoints = append(m.Sum.DataPoints, otlpNumberDataPoint{
+				Attributes:        attributes,
+				StartTimeUnixNano: startTime,
+				TimeUnixNano:      ts,
+				AsDouble:          otlpDouble(ms.Value),
+			})
+		case m.Gauge != nil:
+			m.Gauge.DataPoints = append(m.Gauge.DataPoints, otlpNumberDataPoint{
+				Attributes:   attributes,
+				TimeUnixNano: ts,
+				AsDouble:     otlpDouble(ms.Value),
+			})
+		case m.Histogram != nil:
+			dp := otlpHistogramDataPoint{
+				Attributes:        attributes,
+				StartTimeUnixNano: startTime,
+				TimeUnixNano:      ts,
+				Count:             otlpUint64(ms.Count),
+				Sum:               otlpDouble(ms.Sum),
+			}
+			for _, b := range ms.Buckets {
+				dp.BucketCounts = append(dp.BucketCounts, otlpUint64(b.Count))
+				if !math.IsInf(b.Upper, 1) {
+					dp.ExplicitBounds = append(dp.ExplicitBounds, otlpDouble(b.Upper))
+				}
+			}
+			m.Histogram.DataPoints = append(m.Histogram.DataPoints, dp)
+		case m.ExponentialHistogram != nil:
+			dp := otlpExponentialHistogramDataPoint{
+				Attributes:        attributes,
+				StartTimeUnixNano: startTime,
+				TimeUnixNano:      ts,
+				Count:             otlpUint64(ms.Count),
+				Sum:               otlpDouble(ms.Sum),
+				Scale:             otlpExpHistogramScale,
+			}
+			dp.initBuckets(ms.Buckets)
+			m.ExponentialHistogram.DataPoints = append(m.ExponentialHistogram.DataPoints, dp)
+		case m.Summary != nil:
+			dp := otlpSummaryDataPoint{
+				Attributes:        attributes,
+				StartTimeUnixNano: cumulativeStartTime,
+				TimeUnixNano:      ts,
+				Count:             otlpUint64(ms.Count),
+				Sum:               otlpDouble(ms.Sum),
+			}
+			for _, q := range ms.Quantiles {
+				dp.QuantileValues = append(dp.QuantileValues, otlpValueAtQuantile{
+					Quantile: otlpDouble(q.Quantile),
+					Value:    otlpDouble(q.Value),
+				})
+			}
+			m.Summary.DataPoints = append(m.Summary.DataPoints, dp)
+		}
+	}
+
+	return &otlpExportRequest{
+		ResourceMetrics: []otlpResourceMetrics{{
+			Resource: otlpResource{
+				Attributes: oc.resourceAttributes,
+			},
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope: otlpScope{
+					Name: "github.com/itcomusic/metrics",
+				},
+				Metrics: metrics,
+			}},
+		}},
+	}
+}
+
+func getOTLPAttributes(extraLabels, labels []Label) []otlpKeyValue {
+	if len(labels)+len(extraLabels) == 0 {
+		return nil
+	}
+	attributes := make([]otlpKeyValue, 0, len(labels)+len(extraLabels))
+	for _, label := range extraLabels {
+		attributes = append(attributes, newOTLPKeyValue(label.Name, label.Value))
+	}
+	for _, label := range labels {
+		attributes = append(attributes, newOTLPKeyValue(label.Name, label.Value))
+	}
+	return attributes
+}
+
+// initBuckets puts Histogram buckets into exponential buckets of dp.
+//
+// Every bucket is put into the exponential bucket containing its geometric middle point.
+// The lower bucket with values close to zero is put into zero_count.
+func (dp *otlpExponentialHistogramDataPoint) initBuckets(buckets []BucketSnapshot) {
+	var counts []otlpUint64
+	offset := 0
+	for _, b := range buckets {
+		if b.Lower <= 0 {
+			dp.ZeroCount += otlpUint64(b.Count)
+			continue
+		}
+		v := b.Lower
+		if !math.IsInf(b.Upper, 1) {
+			v = math.Sqrt(b.Lower * b.Upper)
+		}
+		idx := getOTLPExpBucketIdx(v)
+		if len(counts) == 0 {
+			offset = idx
+		}
+		// buckets are sorted by bounds, so idx cannot be smaller than offset.
+		for offset+len(counts) <= idx {
+			counts = append(counts, 0)
+		}
+		counts[idx-offset] += otlpUint64(b.Count)
+	}
+	if len(counts) > 0 {
+		dp.Positive = &otlpBuckets{
+			Offset:       int32(offset),
+			BucketCounts: counts,
+		}
+	}
+}
+
+// getOTLPExpBucketIdx returns the index of the exponential bucket containing v for otlpExpHistogramScale.
+//
+// The bucket with index i contains values in the range (base^i, base^(i+1)].
+func getOTLPExpBucketIdx(v float64) int {
+	return int(math.Ceil(math.Log2(v)*(1<<otlpExpHistogramScale))) - 1
+}
+
+// The following types represent OTLP ExportMetricsServiceRequest message.
+//
+// JSON tags follow protobuf JSON mapping, while marshalProtobuf methods follow field numbers from
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto
+
+type otlpExportRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope     `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func newOTLPKeyValue(key, value string) otlpKeyValue {
+	return otlpKeyValue{
+		Key: key,
+		Value: otlpAnyValue{
+			StringValue: value,
+		},
+	}
+}
+
+type otlpMetric struct {
+	Name                 string                    `json:"name"`
+	Gauge                *otlpGauge                `json:"gauge,omitempty"`
+	Sum                  *otlpSum                  `json:"sum,omitempty"`
+	Histogram            *otlpHistogram            `json:"histogram,omitempty"`
+	ExponentialHistogram *otlpExponentialHistogram `json:"exponentialHistogram,omitempty"`
+	Summary              *otlpSummary              `json:"summary,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpExponentialHistogram struct {
+	DataPoints             []otlpExponentialHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                                 `json:"aggregationTemporality"`
+}
+
+type otlpSummary struct {
+	DataPoints []otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano otlpUint64     `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      otlpUint64     `json:"timeUnixNano"`
+	AsDouble          otlpDouble     `json:"asDouble"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano otlpUint64     `json:"startTimeUnixNano"`
+	TimeUnixNano      otlpUint64     `json:"timeUnixNano"`
+	Count             otlpUint64     `json:"count"`
+	Sum               otlpDouble     `json:"sum"`
+	BucketCounts      []otlpUint64   `json:"bucketCounts"`
+	ExplicitBounds    []otlpDouble   `json:"explicitBounds"`
+}
+
+type otlpExponentialHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano otlpUint64     `json:"startTimeUnixNano"`
+	TimeUnixNano      otlpUint64     `json:"timeUnixNano"`
+	Count             otlpUint64     `json:"count"`
+	Sum               otlpDouble     `json:"sum"`
+	Scale             int32          `json:"scale"`
+	ZeroCount         otlpUint64     `json:"zeroCount"`
+	Positive          *otlpBuckets   `json:"positive,omitempty"`
+}
+
+type otlpBuckets struct {
+	Offset       int32        `json:"offset"`
+	BucketCounts []otlpUint64 `json:"bucketCounts"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes        []otlpKeyValue        `json:"attributes,omitempty"`
+	StartTimeUnixNano otlpUint64            `json:"startTimeUnixNano"`
+	TimeUnixNano      otlpUint64            `json:"timeUnixNano"`
+	Count             otlpUint64            `json:"count"`
+	Sum               otlpDouble            `json:"sum"`
+	QuantileValues    []otlpValueAtQuantile `json:"quantileValues,omitempty"`
+}
+
+type otlpValueAtQuantile struct {
+	Quantile otlpDouble `json:"quantile"`
+	Value    otlpDouble `json:"value"`
+}
+
+// otlpUint64 is uint64, which is marshaled to JSON as a string according to protobuf JSON mapping.
+type otlpUint64 uint64
+
+// MarshalJSON implements json.Marshaler interface.
+func (n otlpUint64) MarshalJSON() ([]byte, error) {
+	return strconv.AppendQuote(nil, strconv.FormatUint(uint64(n), 10)), nil
+}
+
+// otlpDouble is float64, which is marshaled to JSON according to protobuf JSON mapping.
+//
+// NaN, +Inf and -Inf are marshaled as "NaN", "Infinity" and "-Infinity" strings.
+type otlpDouble float64
+
+// MarshalJSON implements json.Marshaler interface.
+func (f otlpDouble) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	switch {
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(v, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Infinity"`), nil
+	}
+	return strconv.AppendFloat(nil, v, 'g', -1, 64), nil
+}
+
+func (r *otlpExportRequest) marshalProtobuf(dst []byte) []byte {
+	for i := range r.ResourceMetrics {
+		dst = appendProtoMessage(dst, 1, r.ResourceMetrics[i].marshalProtobuf(nil))
+	}
+	return dst
+}
+
+func (rm *otlpResourceMetrics) marshalProtobuf(dst []byte) []byte {
+	dst = appendProtoMessage(dst, 1, rm.Resource.marshalProtobuf(nil))
+	for i := range rm.ScopeMetrics {
+		dst = appendProtoMessage(dst, 2, rm.ScopeMetrics[i].marshalProtobuf(nil))
+	}
+	return dst
+}
+
+func (r *otlpResource) marshalProtobuf(dst []byte) []byte {
+	return appendProtoKeyValues(dst, 1, r.Attributes)
+}
+
+func (sm *otlpScopeMetrics) marshalProtobuf(dst []byte) []byte {
+	dst = appendProtoMessage(dst, 1, appendProtoString(nil, 1, sm.Scope.Name))
+	for _, m := range sm.Metrics {
+		dst = appendProtoMessage(dst, 2, m.marshalProtobuf(nil))
+	}
+	return dst
+}
+
+func (m *otlpMetric) marshalProtobuf(dst []byte) []byte {
+	dst = appendProtoString(dst, 1, m.Name)
+	switch {
+	case m.Gauge != nil:
+		var b []byte
+		for i := range m.Gauge.DataPoints {
+			b = appendProtoMessage(b, 1, m.Gauge.DataPoints[i].marshalProtobuf(nil))
+		}
+		dst = appendProtoMessage(dst, 5, b)
+	case m.Sum != nil:
+		var b []byte
+		for i := range m.Sum.DataPoints {
+			b = appendProtoMessage(b, 1, m.Sum.DataPoints[i].marshalProtobuf(nil))
+		}
+		b = appendProtoVarint(b, 2, uint64(m.Sum.AggregationTemporality))
+		if m.Sum.IsMonotonic {
+			b = appendProtoVarint(b, 3, 1)
+		}
+		dst = appendProtoMessage(dst, 7, b)
+	case m.Histogram != nil:
+		var b []byte
+		for i := range m.Histogram.DataPoints {
+			b = appendProtoMessage(b, 1, m.Histogram.DataPoints[i].marshalProtobuf(nil))
+		}
+		b = appendProtoVarint(b, 2, uint64(m.Histogram.AggregationTemporality))
+		dst = appendProtoMessage(dst, 9, b)
+	case m.ExponentialHistogram != nil:
+		var b []byte
+		for i := range m.ExponentialHistogram.DataPoints {
+			b = appendProtoMessage(b, 1, m.ExponentialHistogram.DataPoints[i].marshalProtobuf(nil))
+		}
+		b = appendProtoVarint(b, 2, uint64(m.ExponentialHistogram.AggregationTemporality))
+		dst = appendProtoMessage(dst, 10, b)
+	case m.Summary != nil:
+		var b []byte
+		for i := range m.Summary.DataPoints {
+			b = appendProtoMessage(b, 1, m.Summary.DataPoints[i].marshalProtobuf(nil))
+		}
+		dst = appendProtoMessage(dst, 11, b)
+	}
+	return dst
+}
+
+func (dp *otlpNumberDataPoint) marshalProtobuf(dst []byte) []byte {
+	if dp.StartTimeUnixNano > 0 {
+		dst = appendProtoFixed64(dst, 2, uint64(dp.StartTimeUnixNano))
+	}
+	dst = appendProtoFixed64(dst, 3, uint64(dp.TimeUnixNano))
+	dst = appendProtoDouble(dst, 4, float64(dp.AsDouble))
+	return appendProtoKeyValues(dst, 7, dp.Attributes)
+}
+
+func (dp *otlpHistogramDataPoint) marshalProtobuf(dst []byte) []byte {
+	dst = appendProtoFixed64(dst, 2, uint64(dp.StartTimeUnixNano))
+	dst = appendProtoFixed64(dst, 3, uint64(dp.TimeUnixNano))
+	dst = appendProtoFixed64(dst, 4, uint64(dp.Count))
+	dst = appendProtoDouble(dst, 5, float64(dp.Sum))
+	var b []byte
+	for _, n := range dp.BucketCounts {
+		b = appendUint64LE(b, uint64(n))
+	}
+	dst = appendProtoBytes(dst, 6, b)
+	b = b[:0]
+	for _, f := range dp.ExplicitBounds {
+		b = appendUint64LE(b, math.Float64bits(float64(f)))
+	}
+	dst = appendProtoBytes(dst, 7, b)
+	return appendProtoKeyValues(dst, 9, dp.Attributes)
+}
+
+func (dp *otlpExponentialHistogramDataPoint) marshalProtobuf(dst []byte) []byte {
+	dst = appendProtoKeyValues(dst, 1, dp.Attributes)
+	dst = appendProtoFixed64(dst, 2, uint64(dp.StartTimeUnixNano))
+	dst = appendProtoFixed64(dst, 3, uint64(dp.TimeUnixNano))
+	dst = appendProtoFixed64(dst, 4, uint64(dp.Count))
+	dst = appendProtoDouble(dst, 5, float64(dp.Sum))
+	dst = appendProtoVarint(dst, 6, encodeZigZag(dp.Scale))
+	dst = appendProtoFixed64(dst, 7, uint64(dp.ZeroCount))
+	if dp.Positive != nil {
+		b := appendProtoVarint(nil, 1, encodeZigZag(dp.Positive.Offset))
+		var counts []byte
+		for _, n := range dp.Positive.BucketCounts {
+			counts = appendUvarint(counts, uint64(n))
+		}
+		b = appendProtoBytes(b, 2, counts)
+		dst = appendProtoMessage(dst, 8, b)
+	}
+	return dst
+}
+
+func (dp *otlpSummaryDataPoint) marshalProtobuf(dst []byte) []byte {
+	dst = appendProtoFixed64(dst, 2, uint64(dp.StartTimeUnixNano))
+	dst = appendProtoFixed64(dst, 3, uint64(dp.TimeUnixNano))
+	dst = appendProtoFixed64(dst, 4, uint64(dp.Count))
+	dst = appendProtoDouble(dst, 5, float64(dp.Sum))
+	for _, q := range dp.QuantileValues {
+		b := appendProtoDouble(nil, 1, float64(q.Quantile))
+		b = appendProtoDouble(b, 2, float64(q.Value))
+		dst = appendProtoMessage(dst, 6, b)
+	}
+	return appendProtoKeyValues(dst, 7, dp.Attributes)
+}
+
+// The following functions append protobuf-encoded fields to dst.
+//
+// See https://protobuf.dev/programming-guides/encoding/
+
+const (
+	protoWireTypeVarint = 0
+	protoWireTypeI64    = 1
+	protoWireTypeLen    = 2
+)
+
+func appendProtoTag(dst []byte, fieldNum, wireType int) []byte {
+	return appendUvarint(dst, uint64(fieldNum<<3|wireType))
+}
+
+func appendProtoVarint(dst []byte, fieldNum int, v uint64) []byte {
+	dst = appendProtoTag(dst, fieldNum, protoWireTypeVarint)
+	return appendUvarint(dst, v)
+}
+
+func appendProtoFixed64(dst []byte, fieldNum int, v uint64) []byte {
+	dst = appendProtoTag(dst, fieldNum, protoWireTypeI64)
+	return appendUint64LE(dst, v)
+}
+
+func appendProtoDouble(dst []byte, fieldNum int, v float64) []byte {
+	return appendProtoFixed64(dst, fieldNum, math.Float64bits(v))
+}
+
+func appendProtoBytes(dst []byte, fieldNum int, b []byte) []byte {
+	dst = appendProtoTag(dst, fieldNum, protoWireTypeLen)
+	dst = appendUvarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+func appendProtoString(dst []byte, fieldNum int, s string) []byte {
+	dst = appendProtoTag(dst, fieldNum, protoWireTypeLen)
+	dst = appendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+func appendProtoMessage(dst []byte, fieldNum int, msg []byte) []byte {
+	return appendProtoBytes(dst, fieldNum, msg)
+}
+
+func appendProtoKeyValues(dst []byte, fieldNum int, kvs []otlpKeyValue) []byte {
+	for _, kv := range kvs {
+		b := appendProtoString(nil, 1, kv.Key)
+		b = appendProtoMessage(b, 2, appendProtoString(nil, 1, kv.Value.StringValue))
+		dst = appendProtoMessage(dst, fieldNum, b)
+	}
+	return dst
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(dst, buf[:n]...)
+}
+
+func encodeZigZag(v int32) uint64 {
+	return uint64(uint32((v << 1) ^ (v >> 31)))
+}
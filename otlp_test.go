@@ -0,0 +1,306 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestOTLPExpBucketIdx(t *testing.T) {
+	f := func(v float64, expectedIdx int) {
+		t.Helper()
+		idx := getOTLPExpBucketIdx(v)
+		if idx != expectedIdx {
+			t.Fatalf("unexpected bucket index for %v; got %d; want %d", v, idx, expectedIdx)
+		}
+	}
+	f(1, -1)
+	f(1.01, 0)
+	f(1.09, 0)
+	f(2, 7)
+	f(2.01, 8)
+	f(0.5, -9)
+}
+
+func TestOTLPMarshalProtobuf(t *testing.T) {
+	s := NewSet()
+	s.NewGauge(`foo{bar="baz"}`, nil).Set(1.5)
+
+	oc, err := newOTLPContext("http://localhost:4318/v1/metrics", &OTLPOptions{
+		ResourceAttributes: map[string]string{
+			"service.name": "x",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	req := oc.newExportRequest(s.Snapshot(), time.Unix(0, 1))
+	result := req.marshalProtobuf(nil)
+	expectedResult := "" +
+		// ResourceMetrics
+		"\x0a\x64" +
+		// Resource
+		"\x0a\x15" + "\x0a\x13" + "\x0a\x0cservice.name" + "\x12\x03\x0a\x01x" +
+		// ScopeMetrics
+		"\x12\x4b" +
+		// Scope
+		"\x0a\x1e" + "\x0a\x1cgithub.com/itcomusic/metrics" +
+		// Metric
+		"\x12\x29" + "\x0a\x03foo" +
+		// Gauge
+		"\x2a\x22" +
+		// NumberDataPoint
+		"\x0a\x20" +
+		"\x19\x01\x00\x00\x00\x00\x00\x00\x00" +
+		"\x21\x00\x00\x00\x00\x00\x00\xf8\x3f" +
+		"\x3a\x0c" + "\x0a\x03bar" + "\x12\x05\x0a\x03baz"
+	if string(result) != expectedResult {
+		t.Fatalf("unexpected result; got\n%q\nwant\n%q", result, expectedResult)
+	}
+}
+
+func TestPushOTLPJSON(t *testing.T) {
+	var reqMethod, reqContentType string
+	var reqData []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqMethod = r.Method
+		reqContentType = r.Header.Get("Content-Type")
+		reqData, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	s := NewSet()
+	s.NewCounter(`requests_total{path="/foo"}`).Set(10)
+	s.NewGauge(`temperature`, nil).Set(math.NaN())
+	h := s.NewHistogram(`response_size`)
+	h.Update(0)
+	h.Update(1000)
+	hs := s.NewHistogramStatic(`duration_seconds`, []float64{0.1, 1})
+	hs.Update(0.5)
+	sm := s.NewSummaryExt(`latency_seconds`, time.Hour, []float64{0.5})
+	sm.Update(2)
+
+	opts := &OTLPOptions{
+		Encoding: OTLPEncodingJSON,
+	}
+	opts.ExtraLabels = `job="test"`
+	opts.DisableCompression = true
+	if err := s.PushOTLP(context.Background(), srv.URL+"/v1/metrics", opts); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if reqMethod != http.MethodPost {
+		t.Fatalf("unexpected method; got %s; want %s", reqMethod, http.MethodPost)
+	}
+	if reqContentType != "application/json" {
+		t.Fatalf("unexpected Content-Type: %q", reqContentType)
+	}
+
+	var req struct {
+		ResourceMetrics []struct {
+			ScopeMetrics []struct {
+				Metrics []map[string]json.RawMessage
+			}
+		}
+	}
+	if err := json.Unmarshal(reqData, &req); err != nil {
+		t.Fatalf("cannot unmarshal request: %s; request: %s", err, reqData)
+	}
+	metrics := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	expected := []struct {
+		name, kind, data string
+	}{
+		{"duration_seconds", "histogram", `{"dataPoints":[{"attributes":[{"key":"job","value":{"stringValue":"test"}}],"startTimeUnixNano":"T","timeUnixNano":"T","count":"1","sum":0.5,"bucketCounts":["0","1","0"],"explicitBounds":[0.1,1]}],"aggregationTemporality":2}`},
+		{"latency_seconds", "summary", `{"dataPoints":[{"attributes":[{"key":"job","value":{"stringValue":"test"}}],"startTimeUnixNano":"T","timeUnixNano":"T","count":"1","sum":2,"quantileValues":[{"quantile":0.5,"value":2}]}]}`},
+		{"requests_total", "sum", `{"dataPoints":[{"attributes":[{"key":"job","value":{"stringValue":"test"}},{"key":"path","value":{"stringValue":"/foo"}}],"startTimeUnixNano":"T","timeUnixNano":"T","asDouble":10}],"aggregationTemporality":2,"isMonotonic":true}`},
+		{"response_size", "exponentialHistogram", `{"dataPoints":[{"attributes":[{"key":"job","value":{"stringValue":"test"}}],"startTimeUnixNano":"T","timeUnixNano":"T","count":"2","sum":1000,"scale":3,"zeroCount":"1","positive":{"offset":78,"bucketCounts":["1"]}}],"aggregationTemporality":2}`},
+		{"temperature", "gauge", `{"dataPoints":[{"attributes":[{"key":"job","value":{"stringValue":"test"}}],"timeUnixNano":"T","asDouble":"NaN"}]}`},
+	}
+	if len(metrics) != len(expected) {
+		t.Fatalf("unexpected number of metrics; got %d; want %d; request: %s", len(metrics), len(expected), reqData)
+	}
+	for i, e := range expected {
+		m := metrics[i]
+		var name string
+		_ = json.Unmarshal(m["name"], &name)
+		if name != e.name {
+			t.Fatalf("unexpected metric name at position %d; got %q; want %q", i, name, e.name)
+		}
+		data := timestampsRegexp.ReplaceAllString(string(m[e.kind]), `"T"`)
+		if data != e.data {
+			t.Fatalf("unexpected %s data for %q; got\n%s\nwant\n%s", e.kind, e.name, data, e.data)
+		}
+	}
+}
+
+var timestampsRegexp = regexp.MustCompile(`"\d{10,}"`)
+
+func TestPushOTLPRelabeling(t *testing.T) {
+	var reqData []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqData, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	s := NewSet()
+	s.NewCounter(`requests_total{path="/foo",tmp="x"}`).Set(10)
+	s.NewCounter(`noisy_total`).Set(1)
+	hs := s.NewHistogramStatic(`duration_seconds`, []float64{1})
+	hs.Update(0.5)
+
+	opts := &OTLPOptions{
+		Encoding: OTLPEncodingJSON,
+	}
+	opts.ExtraLabels = `job="test"`
+	opts.DisableCompression = true
+	opts.RelabelConfigs = MustNewRelabelConfigs([]RelabelConfig{
+		{
+			Action:       "drop",
+			SourceLabels: []string{"__name__"},
+			Regex:        "noisy_.+",
+		},
+		{
+			Action: "labeldrop",
+			Regex:  "tmp",
+		},
+		{
+			SourceLabels: []string{"__name__", "job"},
+			Regex:        "(.+);test",
+			TargetLabel:  "__name__",
+			Replacement:  "test_$1",
+		},
+	})
+	if err := s.PushOTLP(context.Background(), srv.URL+"/v1/metrics", opts); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var req struct {
+		ResourceMetrics []struct {
+			ScopeMetrics []struct {
+				Metrics []map[string]json.RawMessage
+			}
+		}
+	}
+	if err := json.Unmarshal(reqData, &req); err != nil {
+		t.Fatalf("cannot unmarshal request: %s; request: %s", err, reqData)
+	}
+	metrics := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	expected := []struct {
+		name, kind, data string
+	}{
+		{"test_duration_seconds", "histogram", `{"dataPoints":[{"attributes":[{"key":"job","value":{"stringValue":"test"}}],"startTimeUnixNano":"T","timeUnixNano":"T","count":"1","sum":0.5,"bucketCounts":["1","0"],"explicitBounds":[1]}],"aggregationTemporality":2}`},
+		{"test_requests_total", "sum", `{"dataPoints":[{"attributes":[{"key":"job","value":{"stringValue":"test"}},{"key":"path","value":{"stringValue":"/foo"}}],"startTimeUnixNano":"T","timeUnixNano":"T","asDouble":10}],"aggregationTemporality":2,"isMonotonic":true}`},
+	}
+	if len(metrics) != len(expected) {
+		t.Fatalf("unexpected number of metrics; got %d; want %d; request: %s", len(metrics), len(expected), reqData)
+	}
+	for i, e := range expected {
+		m := metrics[i]
+		var name string
+		_ = json.Unmarshal(m["name"], &name)
+		if name != e.name {
+			t.Fatalf("unexpected metric name at position %d; got %q; want %q", i, name, e.name)
+		}
+		data := timestampsRegexp.ReplaceAllString(string(m[e.kind]), `"T"`)
+		if data != e.data {
+			t.Fatalf("unexpected %s data for %q; got\n%s\nwant\n%s", e.kind, e.name, data, e.data)
+		}
+	}
+}
+
+func TestNewOTLPContextMaxBodySize(t *testing.T) {
+	opts := &OTLPOptions{}
+	opts.MaxBodySize = 1024
+	if _, err := newOTLPContext("http://localhost:4318/v1/metrics", opts); err == nil {
+		t.Fatalf("expecting non-nil error for MaxBodySize")
+	}
+}
+
+func TestPushOTLPDeltaTemporality(t *testing.T) {
+	var reqData []byte
+	statusCode := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqData, _ = io.ReadAll(r.Body)
+		w.WriteHeader(statusCode)
+	}))
+	defer srv.Close()
+
+	s := NewSet()
+	c := s.NewCounter(`requests_total`)
+	hs := s.NewHistogramStatic(`duration_seconds`, []float64{1})
+	s.NewGauge(`temperature`, nil).Set(21)
+
+	opts := &OTLPOptions{
+		Encoding: OTLPEncodingJSON,
+	}
+	opts.DeltaTemporality = true
+	opts.DisableCompression = true
+	oc, err := newOTLPContext(srv.URL+"/v1/metrics", opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f := func(expected map[string]string, expectError bool) {
+		t.Helper()
+		err := oc.pushMetrics(context.Background(), s.Snapshot())
+		if expectError && err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		if !expectError && err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var req struct {
+			ResourceMetrics []struct {
+				ScopeMetrics []struct {
+					Metrics []map[string]json.RawMessage
+				}
+			}
+		}
+		if err := json.Unmarshal(reqData, &req); err != nil {
+			t.Fatalf("cannot unmarshal request: %s; request: %s", err, reqData)
+		}
+		for _, m := range req.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+			var name string
+			_ = json.Unmarshal(m["name"], &name)
+			for kind, data := range m {
+				if kind == "name" {
+					continue
+				}
+				result := timestampsRegexp.ReplaceAllString(string(data), `"T"`)
+				if result != expected[name] {
+					t.Fatalf("unexpected %s data for %q; got\n%s\nwant\n%s", kind, name, result, expected[name])
+				}
+			}
+		}
+	}
+
+	c.Add(10)
+	hs.Update(0.5)
+	hs.Update(2)
+	f(map[string]string{
+		"duration_seconds": `{"dataPoints":[{"startTimeUnixNano":"T","timeUnixNano":"T","count":"2","sum":2.5,"bucketCounts":["1","1"],"explicitBounds":[1]}],"aggregationTemporality":1}`,
+		"requests_total":   `{"dataPoints":[{"startTimeUnixNano":"T","timeUnixNano":"T","asDouble":10}],"aggregationTemporality":1,"isMonotonic":true}`,
+		"temperature":      `{"dataPoints":[{"timeUnixNano":"T","asDouble":21}]}`,
+	}, false)
+
+	// Deltas are accumulated until the successful push.
+	c.Add(5)
+	hs.Update(0.25)
+	statusCode = http.StatusBadGateway
+	f(map[string]string{
+		"duration_seconds": `{"dataPoints":[{"startTimeUnixNano":"T","timeUnixNano":"T","count":"1","sum":0.25,"bucketCounts":["1","0"],"explicitBounds":[1]}],"aggregationTemporality":1}`,
+		"requests_total":   `{"dataPoints":[{"startTimeUnixNano":"T","timeUnixNano":"T","asDouble":5}],"aggregationTemporality":1,"isMonotonic":true}`,
+		"temperature":      `{"dataPoints":[{"timeUnixNano":"T","asDouble":21}]}`,
+	}, true)
+	c.Add(1)
+	statusCode = http.StatusOK
+	f(map[string]string{
+		"duration_seconds": `{"dataPoints":[{"startTimeUnixNano":"T","timeUnixNano":"T","count":"1","sum":0.25,"bucketCounts":["1","0"],"explicitBounds":[1]}],"aggregationTemporality":1}`,
+		"requests_total":   `{"dataPoints":[{"startTimeUnixNano":"T","timeUnixNano":"T","asDouble":6}],"aggregationTemporality":1,"isMonotonic":true}`,
+		"temperature":      `{"dataPoints":[{"timeUnixNano":"T","asDouble":21}]}`,
+	}, false)
+}
@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parsedSample is a sample parsed from a line in Prometheus text exposition format.
+type parsedSample struct {
+	// name is the metric name without labels.
+	name string
+
+	// labels contains the parsed labels.
+	labels []Label
+
+	// value is the sample value.
+	value float64
+}
+
+// parseSampleLine parses Prometheus text exposition line without timestamp.
+//
+// Comment lines mustn't be passed to parseSampleLine.
+func parseSampleLine(line string) (*parsedSample, error) {
+	line = strings.TrimSpace(line)
+	n := strings.IndexAny(line, "{ \t")
+	if n < 0 {
+		return nil, fmt.Errorf("missing value in %q", line)
+	}
+	ps := &parsedSample{
+		name: line[:n],
+	}
+	if err := validateIdent(ps.name); err != nil {
+		return nil, fmt.Errorf("cannot parse %q: %w", line, err)
+	}
+	tail := line[n:]
+	if tail[0] == '{' {
+		labels, tailNext, err := parseLabels(tail[1:])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse labels in %q: %w", line, err)
+		}
+		ps.labels = labels
+		tail = tailNext
+	}
+	tail = strings.TrimSpace(tail)
+	if n := strings.IndexAny(tail, " \t"); n >= 0 {
+		// Ignore timestamp
+		tail = tail[:n]
+	}
+	v, err := strconv.ParseFloat(tail, 64)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse value in %q: %w", line, err)
+	}
+	ps.value = v
+	return ps, nil
+}
+
+// parseLabels parses labels from s, which must start after the opening curly brace.
+//
+// It returns the parsed labels and the tail after the closing curly brace.
+func parseLabels(s string) ([]Label, string, error) {
+	var labels []Label
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if len(s) == 0 {
+			return nil, s, fmt.Errorf("missing closing curly brace")
+		}
+		if s[0] == '}' {
+			return labels, s[1:], nil
+		}
+		n := strings.IndexByte(s, '=')
+		if n < 0 {
+			return nil, s, fmt.Errorf("missing `=` after %q", s)
+		}
+		name := strings.TrimSpace(s[:n])
+		if err := validateIdent(name); err != nil {
+			return nil, s, err
+		}
+		s = strings.TrimLeft(s[n+1:], " \t")
+		if len(s) == 0 || s[0] != '"' {
+			return nil, s, fmt.Errorf("missing starting `\"` for %q value", name)
+		}
+		n = findClosingQuote(s)
+		if n < 0 {
+			return nil, s, fmt.Errorf("missing trailing `\"` for %q value", name)
+		}
+		labels = append(labels, Label{
+			Name:  name,
+			Value: unescapeLabelValue(s[1:n]),
+		})
+		s = strings.TrimLeft(s[n+1:], " \t")
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, "}") {
+			return nil, s, fmt.Errorf("missing `,` after %q value", name)
+		}
+	}
+}
+
+// findClosingQuote returns the index of the closing quote for the quoted string at the start of s.
+//
+// -1 is returned if the closing quote is missing.
+func findClosingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// unescapeLabelValue unescapes label value s according to Prometheus text exposition format.
+//
+// Only `\\`, `\"` and `\n` escape sequences are decoded, while other backslashes are left as is.
+// This is the reverse of escapeLabelValue.
+func unescapeLabelValue(s string) string {
+	n := strings.IndexByte(s, '\\')
+	if n < 0 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	b = append(b, s[:n]...)
+	for i := n; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			b = append(b, c)
+			continue
+		}
+		switch s[i+1] {
+		case '\\', '"':
+			b = append(b, s[i+1])
+			i++
+		case 'n':
+			b = append(b, '\n')
+			i++
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+// parseMetricName splits metric name with optional labels into the name without labels and the parsed labels.
+func parseMetricName(name string) (string, []Label, error) {
+	n := strings.IndexByte(name, '{')
+	if n < 0 {
+		return name, nil, nil
+	}
+	labels, tail, err := parseLabels(name[n+1:])
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot parse labels in %q: %w", name, err)
+	}
+	if len(strings.TrimSpace(tail)) > 0 {
+		return "", nil, fmt.Errorf("unexpected tail after labels in %q: %q", name, tail)
+	}
+	return name[:n], labels, nil
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestParseSampleLineSuccess(t *testing.T) {
+	f := func(line, nameExpected string, labelsExpected []Label, valueExpected float64) {
+		t.Helper()
+		ps, err := parseSampleLine(line)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if ps.name != nameExpected {
+			t.Fatalf("unexpected name; got %q; want %q", ps.name, nameExpected)
+		}
+		if fmt.Sprintf("%q", ps.labels) != fmt.Sprintf("%q", labelsExpected) {
+			t.Fatalf("unexpected labels; got %q; want %q", ps.labels, labelsExpected)
+		}
+		if ps.value != valueExpected && !(math.IsNaN(ps.value) && math.IsNaN(valueExpected)) {
+			t.Fatalf("unexpected value; got %v; want %v", ps.value, valueExpected)
+		}
+	}
+	f("foo 1", "foo", nil, 1)
+	f("  foo   1.5e3  ", "foo", nil, 1500)
+	f("foo{} -2", "foo", nil, -2)
+	f(`foo{bar="baz"} 3`, "foo", []Label{{"bar", "baz"}}, 3)
+	f(`foo{bar="baz", aaa="b"} 4 1700000000000`, "foo", []Label{{"bar", "baz"}, {"aaa", "b"}}, 4)
+	f(`foo{bar="a\"b\\c}{",x="y",} 5`, "foo", []Label{{"bar", `a"b\c}{`}, {"x", "y"}}, 5)
+	f(`foo{bar="a\nb",x="\z\t\u0041"} 6`, "foo", []Label{{"bar", "a\nb"}, {"x", `\z\t\u0041`}}, 6)
+	f("foo{bar=\"tab\tctrl\x01\"} 7", "foo", []Label{{"bar", "tab\tctrl\x01"}}, 7)
+	f("foo NaN", "foo", nil, math.NaN())
+	f("foo +Inf", "foo", nil, math.Inf(1))
+}
+
+func TestParseSampleLineFailure(t *testing.T) {
+	f := func(line string) {
+		t.Helper()
+		if _, err := parseSampleLine(line); err == nil {
+			t.Fatalf("expecting non-nil error for %q", line)
+		}
+	}
+	f("")
+	f("foo")
+	f("foo bar")
+	f("foo-bar 1")
+	f("foo{ 1")
+	f("foo{bar} 1")
+	f("foo{bar=baz} 1")
+	f(`foo{bar="baz} 1`)
+	f(`foo{bar="baz" x="y"} 1`)
+}
+
+func TestParseMetricName(t *testing.T) {
+	name, labels, err := parseMetricName(`foo{bar="baz",x="y"}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if name != "foo" || fmt.Sprintf("%q", labels) != `[{"bar" "baz"} {"x" "y"}]` {
+		t.Fatalf("unexpected result; got %q, %q", name, labels)
+	}
+	if _, _, err := parseMetricName(`foo{bar="baz"}x`); err == nil {
+		t.Fatalf("expecting non-nil error for tail after labels")
+	}
+}
@@ -2,13 +2,17 @@ package metrics
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -49,17 +53,43 @@ type procStat struct {
 
 func writeProcessMetrics(w io.Writer) {
 	statFilepath := "/proc/self/stat"
-	data, err := ioutil.ReadFile(statFilepath)
+	p, _, err := getProcStat(statFilepath)
 	if err != nil {
-		log.Printf("ERROR: metrics: cannot open %s: %s", statFilepath, err)
+		log.Printf("ERROR: metrics: %s", err)
 		return
 	}
 
+	// It is expensive obtaining `process_open_fds` when big number of file descriptors is opened,
+	// so don't do it here.
+	// See writeFDMetrics instead.
+
+	writeProcStatMetrics(w, p, "process_", "")
+	WriteGaugeUint64(w, "process_start_time_seconds", uint64(startTimeSeconds))
+	WriteGaugeUint64(w, "process_virtual_memory_bytes", uint64(p.Vsize))
+	writeProcessMemMetrics(w)
+	writePressureMetrics(w)
+	writeSchedMetrics(w)
+	writeIOMetrics(w)
+	writeCgroupMetrics(w)
+}
+
+// getProcStat parses /proc/<pid>/stat file at statFilepath.
+//
+// It returns the parsed stat and the process command name.
+func getProcStat(statFilepath string) (*procStat, string, error) {
+	data, err := ioutil.ReadFile(statFilepath)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot open %s: %w", statFilepath, err)
+	}
+
 	// Search for the end of command.
 	n := bytes.LastIndex(data, []byte(") "))
 	if n < 0 {
-		log.Printf("ERROR: metrics: cannot find command in parentheses in %q read from %s", data, statFilepath)
-		return
+		return nil, "", fmt.Errorf("cannot find command in parentheses in %q read from %s", data, statFilepath)
+	}
+	comm := ""
+	if m := bytes.IndexByte(data[:n], '('); m >= 0 {
+		comm = string(data[m+1 : n])
 	}
 	data = data[n+2:]
 
@@ -69,34 +99,39 @@ func writeProcessMetrics(w io.Writer) {
 		&p.State, &p.Ppid, &p.Pgrp, &p.Session, &p.TtyNr, &p.Tpgid, &p.Flags, &p.Minflt, &p.Cminflt, &p.Majflt, &p.Cmajflt,
 		&p.Utime, &p.Stime, &p.Cutime, &p.Cstime, &p.Priority, &p.Nice, &p.NumThreads, &p.ItrealValue, &p.Starttime, &p.Vsize, &p.Rss)
 	if err != nil {
-		log.Printf("ERROR: metrics: cannot parse %q read from %s: %s", data, statFilepath, err)
-		return
+		return nil, "", fmt.Errorf("cannot parse %q read from %s: %w", data, statFilepath, err)
 	}
+	return &p, comm, nil
+}
 
-	// It is expensive obtaining `process_open_fds` when big number of file descriptors is opened,
-	// so don't do it here.
-	// See writeFDMetrics instead.
-
+// writeProcStatMetrics writes metrics from p with the given name prefix such as `process_` to w.
+//
+// labels is an optional comma-separated list of `label="value"` labels for the written metrics.
+func writeProcStatMetrics(w io.Writer, p *procStat, prefix, labels string) {
 	utime := float64(p.Utime) / userHZ
 	stime := float64(p.Stime) / userHZ
-	WriteCounterFloat64(w, "process_cpu_seconds_system_total", stime)
-	WriteCounterFloat64(w, "process_cpu_seconds_total", utime+stime)
-	WriteCounterFloat64(w, "process_cpu_seconds_user_total", utime)
-	WriteCounterUint64(w, "process_major_pagefaults_total", uint64(p.Majflt))
-	WriteCounterUint64(w, "process_minor_pagefaults_total", uint64(p.Minflt))
-	WriteGaugeUint64(w, "process_num_threads", uint64(p.NumThreads))
-	WriteGaugeUint64(w, "process_resident_memory_bytes", uint64(p.Rss)*pageSizeBytes)
-	WriteGaugeUint64(w, "process_start_time_seconds", uint64(startTimeSeconds))
-	WriteGaugeUint64(w, "process_virtual_memory_bytes", uint64(p.Vsize))
-	writeProcessMemMetrics(w)
-	writeIOMetrics(w)
+	WriteCounterFloat64(w, withLabels(prefix+"cpu_seconds_system_total", labels), stime)
+	WriteCounterFloat64(w, withLabels(prefix+"cpu_seconds_total", labels), utime+stime)
+	WriteCounterFloat64(w, withLabels(prefix+"cpu_seconds_user_total", labels), utime)
+	WriteCounterUint64(w, withLabels(prefix+"major_pagefaults_total", labels), uint64(p.Majflt))
+	WriteCounterUint64(w, withLabels(prefix+"minor_pagefaults_total", labels), uint64(p.Minflt))
+	WriteGaugeUint64(w, withLabels(prefix+"num_threads", labels), uint64(p.NumThreads))
+	WriteGaugeUint64(w, withLabels(prefix+"resident_memory_bytes", labels), uint64(p.Rss)*pageSizeBytes)
+}
+
+// withLabels returns metric name with the given labels, which may be empty.
+func withLabels(name, labels string) string {
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
 }
 
 var procSelfIOErrLogged uint32
 
 func writeIOMetrics(w io.Writer) {
 	ioFilepath := "/proc/self/io"
-	data, err := ioutil.ReadFile(ioFilepath)
+	ios, err := getIOStats(ioFilepath)
 	if err != nil {
 		// Do not spam the logs with errors - this error cannot be fixed without process restart.
 		// See https://github.com/itcomusic/metrics/issues/42
@@ -104,6 +139,25 @@ func writeIOMetrics(w io.Writer) {
 			log.Printf("ERROR: metrics: cannot read process_io_* metrics from %q, so these metrics won't be updated until the error is fixed; "+
 				"see https://github.com/itcomusic/metrics/issues/42 ; The error: %s", ioFilepath, err)
 		}
+		ios = &ioStats{}
+	}
+	writeIOStats(w, ios, "process_", "")
+}
+
+// ioStats contains IO stats from /proc/<pid>/io.
+type ioStats struct {
+	rchar      int64
+	wchar      int64
+	syscr      int64
+	syscw      int64
+	readBytes  int64
+	writeBytes int64
+}
+
+func getIOStats(ioFilepath string) (*ioStats, error) {
+	data, err := ioutil.ReadFile(ioFilepath)
+	if err != nil {
+		return nil, err
 	}
 
 	getInt := func(s string) int64 {
@@ -119,31 +173,35 @@ func writeIOMetrics(w io.Writer) {
 		}
 		return v
 	}
-	var rchar, wchar, syscr, syscw, readBytes, writeBytes int64
+	var ios ioStats
 	lines := strings.Split(string(data), "\n")
 	for _, s := range lines {
 		s = strings.TrimSpace(s)
 		switch {
 		case strings.HasPrefix(s, "rchar: "):
-			rchar = getInt(s)
+			ios.rchar = getInt(s)
 		case strings.HasPrefix(s, "wchar: "):
-			wchar = getInt(s)
+			ios.wchar = getInt(s)
 		case strings.HasPrefix(s, "syscr: "):
-			syscr = getInt(s)
+			ios.syscr = getInt(s)
 		case strings.HasPrefix(s, "syscw: "):
-			syscw = getInt(s)
+			ios.syscw = getInt(s)
 		case strings.HasPrefix(s, "read_bytes: "):
-			readBytes = getInt(s)
+			ios.readBytes = getInt(s)
 		case strings.HasPrefix(s, "write_bytes: "):
-			writeBytes = getInt(s)
+			ios.writeBytes = getInt(s)
 		}
 	}
-	WriteGaugeUint64(w, "process_io_read_bytes_total", uint64(rchar))
-	WriteGaugeUint64(w, "process_io_written_bytes_total", uint64(wchar))
-	WriteGaugeUint64(w, "process_io_read_syscalls_total", uint64(syscr))
-	WriteGaugeUint64(w, "process_io_write_syscalls_total", uint64(syscw))
-	WriteGaugeUint64(w, "process_io_storage_read_bytes_total", uint64(readBytes))
-	WriteGaugeUint64(w, "process_io_storage_written_bytes_total", uint64(writeBytes))
+	return &ios, nil
+}
+
+func writeIOStats(w io.Writer, ios *ioStats, prefix, labels string) {
+	WriteGaugeUint64(w, withLabels(prefix+"io_read_bytes_total", labels), uint64(ios.rchar))
+	WriteGaugeUint64(w, withLabels(prefix+"io_written_bytes_total", labels), uint64(ios.wchar))
+	WriteGaugeUint64(w, withLabels(prefix+"io_read_syscalls_total", labels), uint64(ios.syscr))
+	WriteGaugeUint64(w, withLabels(prefix+"io_write_syscalls_total", labels), uint64(ios.syscw))
+	WriteGaugeUint64(w, withLabels(prefix+"io_storage_read_bytes_total", labels), uint64(ios.readBytes))
+	WriteGaugeUint64(w, withLabels(prefix+"io_storage_written_bytes_total", labels), uint64(ios.writeBytes))
 }
 
 var startTimeSeconds = time.Now().Unix()
@@ -184,6 +242,145 @@ func getOpenFDsCount(path string) (uint64, error) {
 	return totalOpenFDs, nil
 }
 
+// fdTypes contains file descriptor types exposed by writeFDTypeMetrics.
+var fdTypes = []string{"socket", "pipe", "eventfd", "anon_inode", "file", "other"}
+
+// fdTypeCountsCaches contains cached file descriptor counts per FDTypeMetricsOptions,
+// so callers with distinct options do not get counts obtained with other options.
+var fdTypeCountsCaches struct {
+	mu sync.Mutex
+	m  map[FDTypeMetricsOptions]*fdTypeCountsCache
+}
+
+type fdTypeCountsCache struct {
+	mu         sync.Mutex
+	counts     map[string]uint64
+	lastUpdate time.Time
+}
+
+func getFDTypeCountsCache(opts FDTypeMetricsOptions) *fdTypeCountsCache {
+	caches := &fdTypeCountsCaches
+	caches.mu.Lock()
+	defer caches.mu.Unlock()
+	if caches.m == nil {
+		caches.m = make(map[FDTypeMetricsOptions]*fdTypeCountsCache)
+	}
+	c := caches.m[opts]
+	if c == nil {
+		c = &fdTypeCountsCache{}
+		caches.m[opts] = c
+	}
+	return c
+}
+
+// writeFDTypeMetrics writes process_open_fds_by_type metrics to w.
+func writeFDTypeMetrics(w io.Writer, opts *FDTypeMetricsOptions) {
+	if opts == nil {
+		opts = &FDTypeMetricsOptions{}
+	}
+	c := getFDTypeCountsCache(*opts)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil || time.Since(c.lastUpdate) >= opts.CacheDuration {
+		counts, err := getFDTypeCounts("/proc/self/fd", opts.MaxSampledFDs)
+		if err != nil {
+			log.Printf("ERROR: metrics: cannot determine open file descriptor types: %s", err)
+			return
+		}
+		c.counts = counts
+		c.lastUpdate = time.Now()
+	}
+	for _, fdType := range fdTypes {
+		WriteGaugeUint64(w, fmt.Sprintf(`process_open_fds_by_type{type=%q}`, fdType), c.counts[fdType])
+	}
+}
+
+// getFDTypeCounts returns the number of file descriptors by type in fdDir such as /proc/self/fd.
+//
+// If maxSampledFDs is positive and fdDir contains more file descriptors, then only maxSampledFDs randomly chosen
+// file descriptors are inspected and the returned counts are extrapolated to the total number of file descriptors.
+func getFDTypeCounts(fdDir string, maxSampledFDs int) (map[string]uint64, error) {
+	names, total, err := sampleFDNames(fdDir, maxSampledFDs)
+	if err != nil {
+		return nil, err
+	}
+	sampled := make(map[string]uint64)
+	samples := 0
+	for _, name := range names {
+		target, err := os.Readlink(fdDir + "/" + name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// The file descriptor has been closed.
+				continue
+			}
+			return nil, err
+		}
+		sampled[getFDType(target)]++
+		samples++
+	}
+	if len(names) == total || samples == 0 {
+		return sampled, nil
+	}
+	counts := make(map[string]uint64, len(sampled))
+	scale := float64(total) / float64(samples)
+	for fdType, n := range sampled {
+		counts[fdType] = uint64(math.Round(float64(n) * scale))
+	}
+	return counts, nil
+}
+
+// sampleFDNames returns up to maxSampledFDs file descriptor names from fdDir and the total number of file descriptors in fdDir.
+//
+// All the names are returned if maxSampledFDs isn't positive. Otherwise fdDir is read in chunks
+// and names are chosen with reservoir sampling, so only the sampled names are kept in memory.
+func sampleFDNames(fdDir string, maxSampledFDs int) ([]string, int, error) {
+	f, err := os.Open(fdDir)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	var sampled []string
+	total := 0
+	for {
+		names, err := f.Readdirnames(512)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("unexpected error at Readdirnames: %s", err)
+		}
+		for _, name := range names {
+			total++
+			if maxSampledFDs <= 0 || len(sampled) < maxSampledFDs {
+				sampled = append(sampled, name)
+				continue
+			}
+			if n := rand.Intn(total); n < maxSampledFDs {
+				sampled[n] = name
+			}
+		}
+	}
+	return sampled, total, nil
+}
+
+// getFDType returns file descriptor type for the given /proc/self/fd/* link target.
+func getFDType(target string) string {
+	switch {
+	case strings.HasPrefix(target, "socket:"):
+		return "socket"
+	case strings.HasPrefix(target, "pipe:"):
+		return "pipe"
+	case target == "anon_inode:[eventfd]":
+		return "eventfd"
+	case strings.HasPrefix(target, "anon_inode:"):
+		return "anon_inode"
+	case strings.HasPrefix(target, "/"):
+		return "file"
+	default:
+		return "other"
+	}
+}
+
 func getMaxFilesLimit(path string) (uint64, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -229,12 +426,222 @@ func writeProcessMemMetrics(w io.Writer) {
 		log.Printf("ERROR: metrics: cannot determine memory status: %s", err)
 		return
 	}
-	WriteGaugeUint64(w, "process_virtual_memory_peak_bytes", ms.vmPeak)
-	WriteGaugeUint64(w, "process_resident_memory_peak_bytes", ms.rssPeak)
-	WriteGaugeUint64(w, "process_resident_memory_anon_bytes", ms.rssAnon)
-	WriteGaugeUint64(w, "process_resident_memory_file_bytes", ms.rssFile)
-	WriteGaugeUint64(w, "process_resident_memory_shared_bytes", ms.rssShmem)
+	writeMemStats(w, ms, "process_", "")
+}
+
+func writeMemStats(w io.Writer, ms *memStats, prefix, labels string) {
+	WriteGaugeUint64(w, withLabels(prefix+"virtual_memory_peak_bytes", labels), ms.vmPeak)
+	WriteGaugeUint64(w, withLabels(prefix+"resident_memory_peak_bytes", labels), ms.rssPeak)
+	WriteGaugeUint64(w, withLabels(prefix+"resident_memory_anon_bytes", labels), ms.rssAnon)
+	WriteGaugeUint64(w, withLabels(prefix+"resident_memory_file_bytes", labels), ms.rssFile)
+	WriteGaugeUint64(w, withLabels(prefix+"resident_memory_shared_bytes", labels), ms.rssShmem)
+}
+
+// ctxtSwitchStats contains the number of context switches for the process.
+type ctxtSwitchStats struct {
+	voluntary    uint64
+	nonvoluntary uint64
+}
+
+func getCtxtSwitchStats(path string) (*ctxtSwitchStats, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cs ctxtSwitchStats
+	lines := strings.Split(string(data), "\n")
+	for _, s := range lines {
+		if !strings.HasPrefix(s, "voluntary_ctxt_switches:") && !strings.HasPrefix(s, "nonvoluntary_ctxt_switches:") {
+			continue
+		}
+		line := strings.Fields(s)
+		if len(line) != 2 {
+			return nil, fmt.Errorf("unexpected number of fields found in %q; got %d; want %d", s, len(line), 2)
+		}
+		value, err := strconv.ParseUint(line[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse number from %q: %w", s, err)
+		}
+		switch line[0] {
+		case "voluntary_ctxt_switches:":
+			cs.voluntary = value
+		case "nonvoluntary_ctxt_switches:":
+			cs.nonvoluntary = value
+		}
+	}
+	return &cs, nil
+}
+
+// schedStats contains scheduler stats for the process.
+//
+// See https://docs.kernel.org/scheduler/sched-stats.html#proc-pid-schedstat
+type schedStats struct {
+	runningNanoseconds uint64
+	waitingNanoseconds uint64
+	timeslices         uint64
+}
+
+func getSchedStats(path string) (*schedStats, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("unexpected number of fields found in %q at %s; got %d; want %d", data, path, len(fields), 3)
+	}
+	var values [3]uint64
+	for i, field := range fields {
+		v, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse number from %q at %s: %w", data, path, err)
+		}
+		values[i] = v
+	}
+	return &schedStats{
+		runningNanoseconds: values[0],
+		waitingNanoseconds: values[1],
+		timeslices:         values[2],
+	}, nil
+}
+
+// getOOMScore reads integer OOM score from /proc/self/oom_score or /proc/self/oom_score_adj file at path.
+func getOOMScore(path string) (int64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q at %s: %w", data, path, err)
+	}
+	return v, nil
+}
+
+var procSelfSchedErrLogged uint32
+
+// writeSchedMetrics writes context switch, scheduler and OOM metrics to w.
+func writeSchedMetrics(w io.Writer) {
+	// /proc/self/status and /proc/self/schedstat contain stats only for the main thread.
+	cs, err := getCtxtSwitchStats("/proc/self/status")
+	if err != nil {
+		logSchedMetricsError("cannot determine context switches", err)
+	} else {
+		WriteCounterUint64(w, "process_context_switches_voluntary_total", cs.voluntary)
+		WriteCounterUint64(w, "process_context_switches_nonvoluntary_total", cs.nonvoluntary)
+	}
+
+	// The file is missing if the kernel is built without CONFIG_SCHED_INFO.
+	ss, err := getSchedStats("/proc/self/schedstat")
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logSchedMetricsError("cannot determine scheduler stats", err)
+		}
+	} else {
+		WriteCounterFloat64(w, "process_main_thread_schedstat_running_seconds_total", float64(ss.runningNanoseconds)/1e9)
+		WriteCounterFloat64(w, "process_main_thread_schedstat_waiting_seconds_total", float64(ss.waitingNanoseconds)/1e9)
+		WriteCounterUint64(w, "process_main_thread_schedstat_timeslices_total", ss.timeslices)
+	}
+
+	if oomScore, err := getOOMScore("/proc/self/oom_score"); err != nil {
+		logSchedMetricsError("cannot determine OOM score", err)
+	} else {
+		WriteGaugeUint64(w, "process_oom_score", uint64(oomScore))
+	}
+	if oomScoreAdj, err := getOOMScore("/proc/self/oom_score_adj"); err != nil {
+		logSchedMetricsError("cannot determine OOM score adjustment", err)
+	} else {
+		WriteGaugeFloat64(w, "process_oom_score_adj", float64(oomScoreAdj))
+	}
+}
+
+// logSchedMetricsError logs the error for context switch, scheduler and OOM metrics only once,
+// since it usually cannot be fixed without process restart.
+func logSchedMetricsError(msg string, err error) {
+	if atomic.CompareAndSwapUint32(&procSelfSchedErrLogged, 0, 1) {
+		log.Printf("ERROR: metrics: %s: %s", msg, err)
+	}
+}
+
+// pressureStats contains pressure stall information for a single resource.
+//
+// See https://docs.kernel.org/accounting/psi.html
+type pressureStats struct {
+	// someSeconds is the total time when at least some tasks were stalled on the resource.
+	someSeconds float64
+
+	// fullSeconds is the total time when all the non-idle tasks were stalled on the resource.
+	fullSeconds float64
+
+	// hasFull is set if the `full` line is present.
+	hasFull bool
+}
+
+var procPressureErrLogged uint32
+
+// writePressureMetrics writes process_pressure_* metrics for the host and for the process cgroup to w.
+func writePressureMetrics(w io.Writer) {
+	writePressureMetricsForScope(w, "system", "/proc/pressure/", "")
+	cp, err := getCgroupPaths("/proc/self/cgroup")
+	if err != nil || !cp.isV2 {
+		// Pressure stall information is available only for cgroup v2.
+		return
+	}
+	writePressureMetricsForScope(w, "cgroup", getCgroupDir("/sys/fs/cgroup", cp.v2Path)+"/", ".pressure")
+}
 
+func writePressureMetricsForScope(w io.Writer, scope, pathPrefix, pathSuffix string) {
+	for _, resource := range []string{"cpu", "memory", "io"} {
+		path := pathPrefix + resource + pathSuffix
+		ps, err := getPressureStats(path)
+		if err != nil {
+			// Pressure stall information is missing if the kernel is built without CONFIG_PSI or if it is disabled.
+			if !os.IsNotExist(err) && atomic.CompareAndSwapUint32(&procPressureErrLogged, 0, 1) {
+				log.Printf("ERROR: metrics: cannot read process_pressure_* metrics: %s", err)
+			}
+			continue
+		}
+		WriteCounterFloat64(w, fmt.Sprintf(`process_pressure_%s_waiting_seconds_total{scope=%q}`, resource, scope), ps.someSeconds)
+		if ps.hasFull {
+			WriteCounterFloat64(w, fmt.Sprintf(`process_pressure_%s_stalled_seconds_total{scope=%q}`, resource, scope), ps.fullSeconds)
+		}
+	}
+}
+
+func getPressureStats(path string) (*pressureStats, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ps pressureStats
+	lines := strings.Split(string(data), "\n")
+	for _, s := range lines {
+		// Every line has `some|full avg10=0.00 avg60=0.00 avg300=0.00 total=123` format.
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] != "some" && fields[0] != "full" {
+			return nil, fmt.Errorf("unexpected line %q in %s; expecting `some` or `full` line", s, path)
+		}
+		var total string
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, "total=") {
+				total = field[len("total="):]
+			}
+		}
+		totalUsecs, err := strconv.ParseUint(total, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse total in %q at %s: %w", s, path, err)
+		}
+		if fields[0] == "some" {
+			ps.someSeconds = float64(totalUsecs) / 1e6
+		} else {
+			ps.fullSeconds = float64(totalUsecs) / 1e6
+			ps.hasFull = true
+		}
+	}
+	return &ps, nil
 }
 
 func getMemStats(path string) (*memStats, error) {
@@ -278,3 +685,512 @@ func getMemStats(path string) (*memStats, error) {
 	}
 	return &ms, nil
 }
+
+// cgroupStats contains resource usage and limits for the cgroup of the process.
+//
+// has* fields are set if the corresponding stats were read. Zero limits mean there is no limit.
+type cgroupStats struct {
+	hasMemoryUsage bool
+	memoryUsage    uint64
+	memoryLimit    uint64
+
+	hasMemoryStat bool
+	memoryAnon    uint64
+	memoryFile    uint64
+
+	hasMemoryKernel bool
+	memoryKernel    uint64
+
+	cpuQuota float64
+
+	hasCPUStat          bool
+	cpuPeriods          uint64
+	cpuThrottledPeriods uint64
+	cpuThrottledSeconds float64
+
+	hasPids   bool
+	pids      uint64
+	pidsLimit uint64
+}
+
+var procSelfCgroupErrLogged uint32
+
+func writeCgroupMetrics(w io.Writer) {
+	cs, err := getCgroupStats("/proc/self/cgroup", "/sys/fs/cgroup")
+	if err != nil {
+		// Do not spam the logs with errors - this error cannot be fixed without process restart.
+		if atomic.CompareAndSwapUint32(&procSelfCgroupErrLogged, 0, 1) {
+			log.Printf("ERROR: metrics: cannot read process_cgroup_* metrics, so these metrics won't be exposed until the error is fixed: %s", err)
+		}
+		return
+	}
+	if cs.hasMemoryUsage {
+		WriteGaugeUint64(w, "process_cgroup_memory_usage_bytes", cs.memoryUsage)
+	}
+	if cs.memoryLimit > 0 {
+		WriteGaugeUint64(w, "process_cgroup_memory_limit_bytes", cs.memoryLimit)
+	}
+	if cs.hasMemoryStat {
+		WriteGaugeUint64(w, "process_cgroup_memory_anon_bytes", cs.memoryAnon)
+		WriteGaugeUint64(w, "process_cgroup_memory_file_bytes", cs.memoryFile)
+	}
+	if cs.hasMemoryKernel {
+		WriteGaugeUint64(w, "process_cgroup_memory_kernel_bytes", cs.memoryKernel)
+	}
+	if cs.cpuQuota > 0 {
+		WriteGaugeFloat64(w, "process_cgroup_cpu_quota_cores", cs.cpuQuota)
+	}
+	if cs.hasCPUStat {
+		WriteCounterUint64(w, "process_cgroup_cpu_periods_total", cs.cpuPeriods)
+		WriteCounterUint64(w, "process_cgroup_cpu_throttled_periods_total", cs.cpuThrottledPeriods)
+		WriteCounterFloat64(w, "process_cgroup_cpu_throttled_seconds_total", cs.cpuThrottledSeconds)
+	}
+	if cs.hasPids {
+		WriteGaugeUint64(w, "process_cgroup_pids", cs.pids)
+	}
+	if cs.pidsLimit > 0 {
+		WriteGaugeUint64(w, "process_cgroup_pids_limit", cs.pidsLimit)
+	}
+}
+
+// getCgroupStats returns cgroup stats for the process with the given cgroupPath file such as /proc/self/cgroup.
+//
+// cgroupRoot is the path where cgroup hierarchies are mounted such as /sys/fs/cgroup.
+// Both cgroup v1 and v2 hierarchies are supported. Missing cgroup files are ignored.
+func getCgroupStats(cgroupPath, cgroupRoot string) (*cgroupStats, error) {
+	cp, err := getCgroupPaths(cgroupPath)
+	if err != nil {
+		return nil, err
+	}
+	if cp.isV2 {
+		return getCgroupV2Stats(getCgroupDir(cgroupRoot, cp.v2Path)), nil
+	}
+	getDir := func(controller string) string {
+		return getCgroupDir(cgroupRoot+"/"+controller, cp.v1Paths[controller])
+	}
+	return getCgroupV1Stats(getDir("memory"), getDir("cpu"), getDir("pids")), nil
+}
+
+// cgroupPaths contains cgroup paths for the process.
+type cgroupPaths struct {
+	// v1Paths contains cgroup v1 paths keyed by controller name.
+	v1Paths map[string]string
+
+	// v2Path is cgroup v2 path.
+	v2Path string
+
+	// isV2 is set if controllers are managed by cgroup v2 hierarchy.
+	isV2 bool
+}
+
+// getCgroupPaths reads cgroup paths from the given cgroupPath file such as /proc/self/cgroup.
+func getCgroupPaths(cgroupPath string) (*cgroupPaths, error) {
+	data, err := ioutil.ReadFile(cgroupPath)
+	if err != nil {
+		return nil, err
+	}
+	cp := &cgroupPaths{
+		v1Paths: make(map[string]string),
+	}
+	for _, s := range strings.Split(string(data), "\n") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		// Every line has `hierarchy-ID:controller-list:cgroup-path` format.
+		// See https://man7.org/linux/man-pages/man7/cgroups.7.html
+		fields := strings.SplitN(s, ":", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected line %q in %s; expecting `hierarchy-ID:controller-list:cgroup-path`", s, cgroupPath)
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			cp.v2Path = fields[2]
+			cp.isV2 = true
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			cp.v1Paths[controller] = fields[2]
+		}
+	}
+	if _, ok := cp.v1Paths["memory"]; ok {
+		// Hybrid mode uses v1 hierarchies for controllers.
+		cp.isV2 = false
+	}
+	if !cp.isV2 && len(cp.v1Paths) == 0 {
+		return nil, fmt.Errorf("cannot find cgroup hierarchies in %s", cgroupPath)
+	}
+	return cp, nil
+}
+
+// getCgroupDir returns the directory for the given cgroup path under the hierarchy mounted at root.
+//
+// Containers usually have their own cgroup mounted at root, while /proc/self/cgroup contains the path on the host,
+// so root is returned if the path is missing under root.
+func getCgroupDir(root, path string) string {
+	dir := root + path
+	if _, err := os.Stat(dir); err != nil {
+		return root
+	}
+	return dir
+}
+
+func getCgroupV2Stats(dir string) *cgroupStats {
+	var cs cgroupStats
+	cs.memoryUsage, cs.hasMemoryUsage = readCgroupUint64(dir + "/memory.current")
+	cs.memoryLimit, _ = readCgroupUint64(dir + "/memory.max")
+	if memStat := readCgroupKeyValues(dir + "/memory.stat"); memStat != nil {
+		cs.memoryAnon = memStat["anon"]
+		cs.memoryFile = memStat["file"]
+		cs.hasMemoryStat = true
+		if v, ok := memStat["kernel"]; ok {
+			cs.memoryKernel = v
+		} else {
+			// Older kernels do not expose `kernel` stat.
+			cs.memoryKernel = memStat["kernel_stack"] + memStat["pagetables"] + memStat["sock"] + memStat["slab"]
+		}
+		cs.hasMemoryKernel = true
+	}
+	if fields := readCgroupFields(dir + "/cpu.max"); len(fields) == 2 && fields[0] != "max" {
+		quota, _ := strconv.ParseFloat(fields[0], 64)
+		period, _ := strconv.ParseFloat(fields[1], 64)
+		if period > 0 {
+			cs.cpuQuota = quota / period
+		}
+	}
+	// cpu.stat contains throttling stats only if cpu controller is enabled for the cgroup.
+	cpuStat := readCgroupKeyValues(dir + "/cpu.stat")
+	cs.cpuPeriods, cs.hasCPUStat = cpuStat["nr_periods"]
+	cs.cpuThrottledPeriods = cpuStat["nr_throttled"]
+	cs.cpuThrottledSeconds = float64(cpuStat["throttled_usec"]) / 1e6
+	cs.pids, cs.hasPids = readCgroupUint64(dir + "/pids.current")
+	cs.pidsLimit, _ = readCgroupUint64(dir + "/pids.max")
+	return &cs
+}
+
+func getCgroupV1Stats(memoryDir, cpuDir, pidsDir string) *cgroupStats {
+	var cs cgroupStats
+	cs.memoryUsage, cs.hasMemoryUsage = readCgroupUint64(memoryDir + "/memory.usage_in_bytes")
+	// cgroup v1 uses the maximum page-aligned int64 value for unlimited memory.
+	if limit, _ := readCgroupUint64(memoryDir + "/memory.limit_in_bytes"); limit < 1<<62 {
+		cs.memoryLimit = limit
+	}
+	if memStat := readCgroupKeyValues(memoryDir + "/memory.stat"); memStat != nil {
+		cs.memoryAnon = memStat["total_rss"]
+		cs.memoryFile = memStat["total_cache"]
+		cs.hasMemoryStat = true
+	}
+	cs.memoryKernel, cs.hasMemoryKernel = readCgroupUint64(memoryDir + "/memory.kmem.usage_in_bytes")
+	quotaFields := readCgroupFields(cpuDir + "/cpu.cfs_quota_us")
+	if len(quotaFields) == 1 && quotaFields[0] != "-1" {
+		quota, _ := strconv.ParseFloat(quotaFields[0], 64)
+		period, _ := readCgroupUint64(cpuDir + "/cpu.cfs_period_us")
+		if period > 0 {
+			cs.cpuQuota = quota / float64(period)
+		}
+	}
+	cpuStat := readCgroupKeyValues(cpuDir + "/cpu.stat")
+	cs.cpuPeriods, cs.hasCPUStat = cpuStat["nr_periods"]
+	cs.cpuThrottledPeriods = cpuStat["nr_throttled"]
+	cs.cpuThrottledSeconds = float64(cpuStat["throttled_time"]) / 1e9
+	cs.pids, cs.hasPids = readCgroupUint64(pidsDir + "/pids.current")
+	cs.pidsLimit, _ = readCgroupUint64(pidsDir + "/pids.max")
+	return &cs
+}
+
+// readCgroupFields returns whitespace-separated fields from the first line of the file at path.
+//
+// nil is returned if the file cannot be read.
+func readCgroupFields(path string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	if n := bytes.IndexByte(data, '\n'); n >= 0 {
+		data = data[:n]
+	}
+	return strings.Fields(string(data))
+}
+
+// readCgroupUint64 reads a single number from the file at path.
+//
+// false is returned if the file cannot be read or if it doesn't contain a number, e.g. it contains `max`.
+func readCgroupUint64(path string) (uint64, bool) {
+	fields := readCgroupFields(path)
+	if len(fields) != 1 {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// readCgroupKeyValues reads `key value` lines from the file at path.
+//
+// nil is returned if the file cannot be read.
+func readCgroupKeyValues(path string) map[string]uint64 {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	m := make(map[string]uint64)
+	for _, s := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(s)
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		m[fields[0]] = v
+	}
+	return m
+}
+
+var procSelfNetErrLogged uint32
+
+// logNetMetricsError logs the error for process_net_* metrics only once, since it usually cannot be fixed
+// without process restart. For example, /proc/self/net may be missing in sandboxed environments.
+func logNetMetricsError(msg string, err error) {
+	if atomic.CompareAndSwapUint32(&procSelfNetErrLogged, 0, 1) {
+		log.Printf("ERROR: metrics: %s, so process_net_* metrics won't be exposed until the error is fixed: %s", msg, err)
+	}
+}
+
+// writeNetMetrics writes process_net_* metrics to w.
+//
+// The metrics are obtained from /proc/self/net, so they cover all the sockets in the network namespace of the process.
+func writeNetMetrics(w io.Writer) {
+	snmp, err := getNetProtoStats("/proc/self/net/snmp")
+	if err != nil {
+		logNetMetricsError("cannot determine network stats", err)
+		return
+	}
+	netstat, err := getNetProtoStats("/proc/self/net/netstat")
+	if err != nil {
+		logNetMetricsError("cannot determine extended network stats", err)
+		return
+	}
+	sockstat, err := getNetProtoStats("/proc/self/net/sockstat")
+	if err != nil {
+		logNetMetricsError("cannot determine socket stats", err)
+		return
+	}
+	tcpStates, err := getTCPSocketStates("/proc/self/net/tcp")
+	if err != nil {
+		logNetMetricsError("cannot determine TCP socket states", err)
+		return
+	}
+	tcp6States, err := getTCPSocketStates("/proc/self/net/tcp6")
+	if err != nil && !os.IsNotExist(err) {
+		// /proc/self/net/tcp6 is missing when IPv6 is disabled.
+		logNetMetricsError("cannot determine TCP6 socket states", err)
+		return
+	}
+
+	tcp := snmp["Tcp"]
+	WriteCounterUint64(w, "process_net_tcp_active_opens_total", tcp["ActiveOpens"])
+	WriteCounterUint64(w, "process_net_tcp_passive_opens_total", tcp["PassiveOpens"])
+	WriteCounterUint64(w, "process_net_tcp_attempt_fails_total", tcp["AttemptFails"])
+	WriteCounterUint64(w, "process_net_tcp_established_resets_total", tcp["EstabResets"])
+	WriteGaugeUint64(w, "process_net_tcp_established", tcp["CurrEstab"])
+	WriteCounterUint64(w, "process_net_tcp_in_segments_total", tcp["InSegs"])
+	WriteCounterUint64(w, "process_net_tcp_out_segments_total", tcp["OutSegs"])
+	WriteCounterUint64(w, "process_net_tcp_retransmitted_segments_total", tcp["RetransSegs"])
+	WriteCounterUint64(w, "process_net_tcp_in_errors_total", tcp["InErrs"])
+	WriteCounterUint64(w, "process_net_tcp_out_resets_total", tcp["OutRsts"])
+	tcpExt := netstat["TcpExt"]
+	WriteCounterUint64(w, "process_net_tcp_listen_overflows_total", tcpExt["ListenOverflows"])
+	WriteCounterUint64(w, "process_net_tcp_listen_drops_total", tcpExt["ListenDrops"])
+	WriteCounterUint64(w, "process_net_tcp_timeouts_total", tcpExt["TCPTimeouts"])
+	udp := snmp["Udp"]
+	WriteCounterUint64(w, "process_net_udp_in_datagrams_total", udp["InDatagrams"])
+	WriteCounterUint64(w, "process_net_udp_out_datagrams_total", udp["OutDatagrams"])
+	WriteCounterUint64(w, "process_net_udp_in_errors_total", udp["InErrors"])
+	WriteCounterUint64(w, "process_net_udp_no_ports_total", udp["NoPorts"])
+	WriteCounterUint64(w, "process_net_udp_receive_buffer_errors_total", udp["RcvbufErrors"])
+	WriteCounterUint64(w, "process_net_udp_send_buffer_errors_total", udp["SndbufErrors"])
+	WriteGaugeUint64(w, "process_net_sockets_used", sockstat["sockets"]["used"])
+	WriteGaugeUint64(w, "process_net_tcp_sockets_inuse", sockstat["TCP"]["inuse"])
+	WriteGaugeUint64(w, "process_net_tcp_sockets_orphan", sockstat["TCP"]["orphan"])
+	WriteGaugeUint64(w, "process_net_tcp_sockets_time_wait", sockstat["TCP"]["tw"])
+	WriteGaugeUint64(w, "process_net_udp_sockets_inuse", sockstat["UDP"]["inuse"])
+	for _, state := range tcpSocketStates[1:] {
+		WriteGaugeUint64(w, fmt.Sprintf(`process_net_tcp_sockets{state=%q}`, state), tcpStates[state]+tcp6States[state])
+	}
+}
+
+// getNetProtoStats parses per-protocol stats from /proc/net/snmp, /proc/net/netstat or /proc/net/sockstat file at path.
+//
+// The returned stats are keyed by protocol name and then by stat name. Negative values are ignored.
+func getNetProtoStats(path string) (map[string]map[string]uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]map[string]uint64)
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		if len(fields) == 0 {
+			continue
+		}
+		if !strings.HasSuffix(fields[0], ":") {
+			return nil, fmt.Errorf("missing protocol name in %q at %s", lines[i], path)
+		}
+		proto := strings.TrimSuffix(fields[0], ":")
+		stats := make(map[string]uint64)
+		m[proto] = stats
+		if i+1 < len(lines) && strings.HasPrefix(lines[i+1], fields[0]+" ") {
+			// snmp and netstat files contain a line with stat names followed by a line with values for every protocol.
+			i++
+			values := strings.Fields(lines[i])
+			if len(values) != len(fields) {
+				return nil, fmt.Errorf("unexpected number of values in %q for %q at %s", lines[i], lines[i-1], path)
+			}
+			for j := 1; j < len(fields); j++ {
+				v, err := strconv.ParseInt(values[j], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("cannot parse %s value %q at %s: %w", fields[j], values[j], path, err)
+				}
+				if v >= 0 {
+					stats[fields[j]] = uint64(v)
+				}
+			}
+			continue
+		}
+		// sockstat file contains `name value` pairs after the protocol name.
+		if len(fields)%2 != 1 {
+			return nil, fmt.Errorf("unexpected number of fields in %q at %s", lines[i], path)
+		}
+		for j := 1; j < len(fields); j += 2 {
+			v, err := strconv.ParseUint(fields[j+1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse %s value %q at %s: %w", fields[j], fields[j+1], path, err)
+			}
+			stats[fields[j]] = v
+		}
+	}
+	return m, nil
+}
+
+// tcpSocketStates contains TCP socket state names indexed by their codes in /proc/net/tcp.
+//
+// See https://github.com/torvalds/linux/blob/master/include/net/tcp_states.h
+var tcpSocketStates = []string{
+	1:  "established",
+	2:  "syn_sent",
+	3:  "syn_recv",
+	4:  "fin_wait1",
+	5:  "fin_wait2",
+	6:  "time_wait",
+	7:  "close",
+	8:  "close_wait",
+	9:  "last_ack",
+	10: "listen",
+	11: "closing",
+}
+
+// getTCPSocketStates returns the number of TCP sockets by state from /proc/net/tcp or /proc/net/tcp6 file at path.
+func getTCPSocketStates(path string) (map[string]uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]uint64)
+	lines := strings.Split(string(data), "\n")
+	if len(lines) > 0 {
+		// Skip the header
+		lines = lines[1:]
+	}
+	for _, s := range lines {
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("unexpected number of fields in %q at %s", s, path)
+		}
+		code, err := strconv.ParseUint(fields[3], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse socket state in %q at %s: %w", s, path, err)
+		}
+		if code == 0 || code >= uint64(len(tcpSocketStates)) {
+			// Ignore unknown states
+			continue
+		}
+		m[tcpSocketStates[code]]++
+	}
+	return m, nil
+}
+
+// writeProcessMetricsForPID writes process_pid_* metrics for the process with the given pid under procRoot to w.
+//
+// The metrics are labeled with pid and name labels plus optional labels.
+// If starttime is non-zero, then it must match the process start time in clock ticks since boot,
+// so the metrics for another process, which reused the pid, aren't written.
+// The start time of the process is returned on success.
+// errProcessExited is returned if the process doesn't exist.
+func writeProcessMetricsForPID(w io.Writer, procRoot string, pid int, labels string, starttime uint64) (uint64, error) {
+	dir := fmt.Sprintf("%s/%d", procRoot, pid)
+	p, comm, err := getProcStat(dir + "/stat")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, errProcessExited
+		}
+		return 0, err
+	}
+	if p.State == 'Z' || p.State == 'X' {
+		// Zombie and dead processes have already exited.
+		return 0, errProcessExited
+	}
+	if starttime != 0 && p.Starttime != starttime {
+		// The process has exited and its pid has been reused by another process.
+		return 0, errProcessExited
+	}
+	bootTime, err := getBootTime(procRoot + "/stat")
+	if err != nil {
+		return 0, err
+	}
+	ms, err := getMemStats(dir + "/status")
+	if err != nil {
+		return 0, fmt.Errorf("cannot determine memory status: %w", err)
+	}
+
+	pidLabels := fmt.Sprintf("pid=\"%d\",name=\"%s\"", pid, escapeLabelValue(comm))
+	if labels != "" {
+		pidLabels += "," + labels
+	}
+	writeProcStatMetrics(w, p, pidMetricsPrefix, pidLabels)
+	WriteGaugeUint64(w, withLabels(pidMetricsPrefix+"start_time_seconds", pidLabels), bootTime+p.Starttime/userHZ)
+	WriteGaugeUint64(w, withLabels(pidMetricsPrefix+"virtual_memory_bytes", pidLabels), uint64(p.Vsize))
+	writeMemStats(w, ms, pidMetricsPrefix, pidLabels)
+
+	// /proc/<pid>/io is readable only by processes with ptrace access to the given process.
+	if ios, err := getIOStats(dir + "/io"); err == nil {
+		writeIOStats(w, ios, pidMetricsPrefix, pidLabels)
+	}
+	return p.Starttime, nil
+}
+
+// getBootTime returns system boot time in unix seconds from /proc/stat file at path.
+func getBootTime(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(string(data), "\n")
+	for _, s := range lines {
+		if !strings.HasPrefix(s, "btime ") {
+			continue
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(s[len("btime "):]), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse boot time from %q at %s: %w", s, path, err)
+		}
+		return v, nil
+	}
+	return 0, fmt.Errorf("cannot find boot time at %s", path)
+}
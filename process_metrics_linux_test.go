@@ -1,6 +1,12 @@
 package metrics
 
-import "testing"
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestGetMaxFilesLimit(t *testing.T) {
 	f := func(want uint64, path string, wantErr bool) {
@@ -49,3 +55,478 @@ func TestGetMemStats(t *testing.T) {
 	f(memStats{vmPeak: 2130489344, rssPeak: 200679424, rssAnon: 121602048, rssFile: 11362304}, "testdata/status", false)
 	f(memStats{}, "testdata/status_bad", true)
 }
+
+func TestGetCgroupStats(t *testing.T) {
+	f := func(want cgroupStats, cgroupPath, cgroupRoot string, wantErr bool) {
+		t.Helper()
+		got, err := getCgroupStats(cgroupPath, cgroupRoot)
+		if (err != nil && !wantErr) || (err == nil && wantErr) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != nil && *got != want {
+			t.Fatalf("unexpected result: %+v, want: %+v at getCgroupStats", *got, want)
+		}
+	}
+	f(cgroupStats{
+		hasMemoryUsage:      true,
+		memoryUsage:         104857600,
+		memoryLimit:         536870912,
+		hasMemoryStat:       true,
+		memoryAnon:          73400320,
+		memoryFile:          26214400,
+		hasMemoryKernel:     true,
+		memoryKernel:        5242880,
+		cpuQuota:            1.5,
+		hasCPUStat:          true,
+		cpuPeriods:          1200,
+		cpuThrottledPeriods: 35,
+		cpuThrottledSeconds: 2.5,
+		hasPids:             true,
+		pids:                12,
+	}, "testdata/cgroup_v2/cgroup", "testdata/cgroup_v2/sys", false)
+	f(cgroupStats{
+		hasMemoryUsage:      true,
+		memoryUsage:         209715200,
+		hasMemoryStat:       true,
+		memoryAnon:          94371840,
+		memoryFile:          104857600,
+		hasMemoryKernel:     true,
+		memoryKernel:        3145728,
+		cpuQuota:            0.5,
+		hasCPUStat:          true,
+		cpuPeriods:          500,
+		cpuThrottledPeriods: 20,
+		cpuThrottledSeconds: 1.5,
+		hasPids:             true,
+		pids:                7,
+		pidsLimit:           1024,
+	}, "testdata/cgroup_v1/cgroup", "testdata/cgroup_v1/sys", false)
+	// only memory controller is mounted
+	f(cgroupStats{
+		hasMemoryUsage: true,
+		memoryUsage:    1048576,
+	}, "testdata/cgroup_v1/cgroup", "testdata/cgroup_v1_memory_only/sys", false)
+	f(cgroupStats{}, "testdata/bad_path", "testdata/cgroup_v2/sys", true)
+	f(cgroupStats{}, "testdata/limits", "testdata/cgroup_v2/sys", true)
+}
+
+func TestGetPressureStats(t *testing.T) {
+	f := func(want pressureStats, path string, wantErr bool) {
+		t.Helper()
+		got, err := getPressureStats(path)
+		if (err != nil && !wantErr) || (err == nil && wantErr) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != nil && *got != want {
+			t.Fatalf("unexpected result: %+v, want: %+v at getPressureStats", *got, want)
+		}
+	}
+	f(pressureStats{someSeconds: 40.201721, fullSeconds: 1.5, hasFull: true}, "testdata/pressure", false)
+	f(pressureStats{someSeconds: 2.5}, "testdata/pressure_some", false)
+	f(pressureStats{}, "testdata/pressure_bad", true)
+	f(pressureStats{}, "testdata/limits", true)
+	f(pressureStats{}, "testdata/bad_path", true)
+}
+
+func TestGetNetProtoStats(t *testing.T) {
+	f := func(want map[string]map[string]uint64, path string, wantErr bool) {
+		t.Helper()
+		got, err := getNetProtoStats(path)
+		if (err != nil && !wantErr) || (err == nil && wantErr) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for proto, stats := range want {
+			for name, v := range stats {
+				if got[proto][name] != v {
+					t.Fatalf("unexpected %s %s: %d, want: %d at getNetProtoStats", proto, name, got[proto][name], v)
+				}
+			}
+		}
+	}
+	f(map[string]map[string]uint64{
+		"Tcp": {
+			"ActiveOpens":  660,
+			"PassiveOpens": 657,
+			"CurrEstab":    2,
+			"RetransSegs":  9,
+			"OutRsts":      142,
+			"MaxConn":      0,
+		},
+		"Udp": {
+			"InDatagrams":  442,
+			"NoPorts":      5,
+			"RcvbufErrors": 2,
+		},
+	}, "testdata/net_snmp", false)
+	f(map[string]map[string]uint64{
+		"TcpExt": {
+			"ListenOverflows": 7,
+			"ListenDrops":     8,
+			"TCPTimeouts":     97,
+		},
+	}, "testdata/net_netstat", false)
+	f(map[string]map[string]uint64{
+		"sockets": {
+			"used": 18,
+		},
+		"TCP": {
+			"inuse":  4,
+			"orphan": 1,
+			"tw":     34,
+		},
+		"UDP": {
+			"inuse": 2,
+		},
+	}, "testdata/net_sockstat", false)
+	f(nil, "testdata/net_snmp_bad", true)
+	f(nil, "testdata/limits", true)
+	f(nil, "testdata/bad_path", true)
+}
+
+func TestGetTCPSocketStates(t *testing.T) {
+	f := func(want map[string]uint64, path string, wantErr bool) {
+		t.Helper()
+		got, err := getTCPSocketStates(path)
+		if (err != nil && !wantErr) || (err == nil && wantErr) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("unexpected result: %v, want: %v at getTCPSocketStates", got, want)
+		}
+		for state, n := range want {
+			if got[state] != n {
+				t.Fatalf("unexpected result: %v, want: %v at getTCPSocketStates", got, want)
+			}
+		}
+	}
+	f(map[string]uint64{"listen": 2, "time_wait": 1, "established": 1}, "testdata/net_tcp", false)
+	f(nil, "testdata/net_tcp_bad", true)
+	f(nil, "testdata/bad_path", true)
+}
+
+func TestGetCtxtSwitchStats(t *testing.T) {
+	f := func(want ctxtSwitchStats, path string, wantErr bool) {
+		t.Helper()
+		got, err := getCtxtSwitchStats(path)
+		if (err != nil && !wantErr) || (err == nil && wantErr) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != nil && *got != want {
+			t.Fatalf("unexpected result: %+v, want: %+v at getCtxtSwitchStats", *got, want)
+		}
+	}
+	f(ctxtSwitchStats{voluntary: 82, nonvoluntary: 21}, "testdata/status", false)
+	f(ctxtSwitchStats{}, "testdata/status_ctxt_bad", true)
+	f(ctxtSwitchStats{}, "testdata/bad_path", true)
+}
+
+func TestGetSchedStats(t *testing.T) {
+	f := func(want schedStats, path string, wantErr bool) {
+		t.Helper()
+		got, err := getSchedStats(path)
+		if (err != nil && !wantErr) || (err == nil && wantErr) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != nil && *got != want {
+			t.Fatalf("unexpected result: %+v, want: %+v at getSchedStats", *got, want)
+		}
+	}
+	f(schedStats{runningNanoseconds: 1234567890, waitingNanoseconds: 987654321, timeslices: 4321}, "testdata/schedstat", false)
+	f(schedStats{}, "testdata/schedstat_bad", true)
+	f(schedStats{}, "testdata/limits", true)
+	f(schedStats{}, "testdata/bad_path", true)
+}
+
+func TestGetOOMScore(t *testing.T) {
+	f := func(want int64, path string, wantErr bool) {
+		t.Helper()
+		got, err := getOOMScore(path)
+		if (err != nil && !wantErr) || (err == nil && wantErr) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != want {
+			t.Fatalf("unexpected result: %d, want: %d at getOOMScore", got, want)
+		}
+	}
+	f(666, "testdata/oom_score", false)
+	f(-500, "testdata/oom_score_adj", false)
+	f(0, "testdata/limits", true)
+	f(0, "testdata/bad_path", true)
+}
+
+func TestWriteSchedMetrics(t *testing.T) {
+	var bb bytes.Buffer
+	writeSchedMetrics(&bb)
+	result := bb.String()
+	for _, name := range []string{"process_context_switches_voluntary_total ", "process_context_switches_nonvoluntary_total "} {
+		if !strings.Contains(result, name) {
+			t.Fatalf("missing %q in the output\n%s", name, result)
+		}
+	}
+}
+
+func TestGetFDTypeCounts(t *testing.T) {
+	f := func(want map[string]uint64, path string, maxSampledFDs int, wantErr bool) {
+		t.Helper()
+		got, err := getFDTypeCounts(path, maxSampledFDs)
+		if (err != nil && !wantErr) || (err == nil && wantErr) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("unexpected result: %v, want: %v at getFDTypeCounts", got, want)
+		}
+		for fdType, n := range want {
+			if got[fdType] != n {
+				t.Fatalf("unexpected result: %v, want: %v at getFDTypeCounts", got, want)
+			}
+		}
+	}
+	f(map[string]uint64{"socket": 2, "pipe": 1, "eventfd": 1, "anon_inode": 1, "file": 2, "other": 1}, "testdata/fd_types", 0, false)
+	f(map[string]uint64{"socket": 2, "pipe": 1, "eventfd": 1, "anon_inode": 1, "file": 2, "other": 1}, "testdata/fd_types", 8, false)
+
+	f(nil, "testdata/bad_path", 0, true)
+	f(nil, "testdata/fd", 0, true)
+
+	// random 4 fds are sampled and the counts are extrapolated to 8 fds
+	for i := 0; i < 10; i++ {
+		got, err := getFDTypeCounts("testdata/fd_types", 4)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		total := uint64(0)
+		for _, n := range got {
+			if n%2 != 0 {
+				t.Fatalf("unexpected result: %v; counts must be extrapolated by 2", got)
+			}
+			total += n
+		}
+		if total != 8 {
+			t.Fatalf("unexpected total number of fds; got %d; want 8", total)
+		}
+	}
+}
+
+func TestSampleFDNames(t *testing.T) {
+	f := func(maxSampledFDs, wantSampled int) {
+		t.Helper()
+		names, total, err := sampleFDNames("testdata/fd_types", maxSampledFDs)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if total != 8 {
+			t.Fatalf("unexpected total; got %d; want 8", total)
+		}
+		if len(names) != wantSampled {
+			t.Fatalf("unexpected number of sampled names; got %d; want %d", len(names), wantSampled)
+		}
+		seen := make(map[string]bool)
+		for _, name := range names {
+			if seen[name] {
+				t.Fatalf("duplicate sampled name %q in %q", name, names)
+			}
+			seen[name] = true
+		}
+	}
+	f(0, 8)
+	f(3, 3)
+	f(8, 8)
+	f(100, 8)
+}
+
+func TestGetFDTypeCountsCache(t *testing.T) {
+	opts1 := FDTypeMetricsOptions{CacheDuration: time.Hour}
+	opts2 := FDTypeMetricsOptions{CacheDuration: time.Hour, MaxSampledFDs: 4}
+	c1 := getFDTypeCountsCache(opts1)
+	if c := getFDTypeCountsCache(opts1); c != c1 {
+		t.Fatalf("expecting the same cache for the same options")
+	}
+	if c := getFDTypeCountsCache(opts2); c == c1 {
+		t.Fatalf("expecting distinct caches for distinct options")
+	}
+}
+
+func TestWriteProcessMetricsForPID(t *testing.T) {
+	var bb bytes.Buffer
+	starttime, err := writeProcessMetricsForPID(&bb, "testdata/proc", 1234, `job="transcode"`, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if starttime != 360000 {
+		t.Fatalf("unexpected start time; got %d; want %d", starttime, 360000)
+	}
+	labels := `{pid="1234",name="ffmpeg worker",job="transcode"}`
+	expected := fmt.Sprintf(`process_pid_cpu_seconds_system_total%[1]s 0.5
+process_pid_cpu_seconds_total%[1]s 3
+process_pid_cpu_seconds_user_total%[1]s 2.5
+process_pid_major_pagefaults_total%[1]s 12
+process_pid_minor_pagefaults_total%[1]s 1500
+process_pid_num_threads%[1]s 4
+process_pid_resident_memory_bytes%[1]s %[2]d
+process_pid_start_time_seconds%[1]s 1700003600
+process_pid_virtual_memory_bytes%[1]s 123456789
+process_pid_virtual_memory_peak_bytes%[1]s 204800000
+process_pid_resident_memory_peak_bytes%[1]s 10240000
+process_pid_resident_memory_anon_bytes%[1]s 4194304
+process_pid_resident_memory_file_bytes%[1]s 2097152
+process_pid_resident_memory_shared_bytes%[1]s 1048576
+process_pid_io_read_bytes_total%[1]s 1000
+process_pid_io_written_bytes_total%[1]s 2000
+process_pid_io_read_syscalls_total%[1]s 30
+process_pid_io_write_syscalls_total%[1]s 40
+process_pid_io_storage_read_bytes_total%[1]s 4096
+process_pid_io_storage_written_bytes_total%[1]s 8192
+`, labels, 2048*pageSizeBytes)
+	if bb.String() != expected {
+		t.Fatalf("unexpected output; got\n%s\nwant\n%s", bb.String(), expected)
+	}
+
+	// exited processes
+	if _, err := writeProcessMetricsForPID(&bb, "testdata/proc", 5678, "", 0); err != errProcessExited {
+		t.Fatalf("unexpected error for zombie process; got %v; want %v", err, errProcessExited)
+	}
+	if _, err := writeProcessMetricsForPID(&bb, "testdata/proc", 9999, "", 0); err != errProcessExited {
+		t.Fatalf("unexpected error for missing process; got %v; want %v", err, errProcessExited)
+	}
+
+	// the pid is reused by another process
+	bb.Reset()
+	if _, err := writeProcessMetricsForPID(&bb, "testdata/proc", 1234, "", 123); err != errProcessExited {
+		t.Fatalf("unexpected error for reused pid; got %v; want %v", err, errProcessExited)
+	}
+	if bb.Len() > 0 {
+		t.Fatalf("unexpected metrics for reused pid:\n%s", bb.String())
+	}
+
+	// the command name is escaped according to Prometheus text exposition format
+	bb.Reset()
+	if _, err := writeProcessMetricsForPID(&bb, "testdata/proc", 2468, "", 0); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	line := `process_pid_cpu_seconds_total{pid="2468",name="a\"b\\c` + "\t" + `d"} 3`
+	if !strings.Contains(bb.String(), line+"\n") {
+		t.Fatalf("cannot find %q in the output:\n%s", line, bb.String())
+	}
+}
+
+func TestWatchProcess(t *testing.T) {
+	SetProcRoot("testdata/proc")
+	defer SetProcRoot("/proc")
+
+	if err := WatchProcess(1234, `job="transcode"`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer UnwatchProcess(1234)
+	if err := WatchProcess(9999, ""); err == nil {
+		t.Fatalf("expecting non-nil error for missing process")
+	}
+	if err := WatchProcess(1234, `bad labels`); err == nil {
+		t.Fatalf("expecting non-nil error for invalid labels")
+	}
+
+	var bb bytes.Buffer
+	writeWatchedProcessMetrics(&bb)
+	if !strings.Contains(bb.String(), `process_pid_cpu_seconds_total{pid="1234",name="ffmpeg worker",job="transcode"} 3`+"\n") {
+		t.Fatalf("missing metrics for the watched process in\n%s", bb.String())
+	}
+
+	// The process is unregistered after it exits.
+	watchedProcessesLock.Lock()
+	watchedProcesses[5678] = watchedProcess{}
+	watchedProcessesLock.Unlock()
+	bb.Reset()
+	writeWatchedProcessMetrics(&bb)
+	if strings.Contains(bb.String(), `pid="5678"`) {
+		t.Fatalf("unexpected metrics for the exited process in\n%s", bb.String())
+	}
+	watchedProcessesLock.Lock()
+	_, ok := watchedProcesses[5678]
+	watchedProcessesLock.Unlock()
+	if ok {
+		t.Fatalf("the exited process must be unregistered")
+	}
+
+	// The process is unregistered if its pid is reused by another process.
+	watchedProcessesLock.Lock()
+	watchedProcesses[1234] = watchedProcess{
+		starttime: 123,
+	}
+	watchedProcessesLock.Unlock()
+	bb.Reset()
+	writeWatchedProcessMetrics(&bb)
+	if bb.Len() > 0 {
+		t.Fatalf("unexpected metrics for reused pid:\n%s", bb.String())
+	}
+	watchedProcessesLock.Lock()
+	_, ok = watchedProcesses[1234]
+	watchedProcessesLock.Unlock()
+	if ok {
+		t.Fatalf("the process with reused pid must be unregistered")
+	}
+
+	if err := WatchProcess(1234, ""); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	UnwatchProcess(1234)
+	bb.Reset()
+	writeWatchedProcessMetrics(&bb)
+	if bb.Len() > 0 {
+		t.Fatalf("unexpected metrics after UnwatchProcess:\n%s", bb.String())
+	}
+}
+
+func TestWatchProcessMetadata(t *testing.T) {
+	SetProcRoot("testdata/proc")
+	defer SetProcRoot("/proc")
+	ExposeMetadata(true)
+	defer ExposeMetadata(false)
+
+	for _, pid := range []int{1234, 4321} {
+		if err := WatchProcess(pid, ""); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer UnwatchProcess(pid)
+	}
+
+	var bb bytes.Buffer
+	writeWatchedProcessMetrics(&bb)
+	result := bb.String()
+
+	// Every metric family must be contiguous and must have metadata only once.
+	seen := make(map[string]bool)
+	prevFamily := ""
+	for _, line := range strings.Split(strings.TrimSuffix(result, "\n"), "\n") {
+		var family string
+		if strings.HasPrefix(line, "# ") {
+			family = strings.Fields(line)[2]
+		} else {
+			family = getMetricFamily(strings.Fields(line)[0])
+		}
+		if !strings.HasPrefix(family, "process_pid_") {
+			t.Fatalf("unexpected metric family %q in\n%s", family, result)
+		}
+		if family != prevFamily {
+			if seen[family] {
+				t.Fatalf("metric family %q isn't contiguous in\n%s", family, result)
+			}
+			seen[family] = true
+			prevFamily = family
+		}
+	}
+
+	expected := `# HELP process_pid_cpu_seconds_total
+# TYPE process_pid_cpu_seconds_total counter
+process_pid_cpu_seconds_total{pid="1234",name="ffmpeg worker"} 3
+process_pid_cpu_seconds_total{pid="4321",name="sh"} 3
+`
+	if !strings.Contains(result, expected) {
+		t.Fatalf("missing\n%s\nin\n%s", expected, result)
+	}
+	expected = `# HELP process_pid_io_read_bytes_total
+# TYPE process_pid_io_read_bytes_total gauge
+process_pid_io_read_bytes_total{pid="1234",name="ffmpeg worker"} 1000
+# HELP process_pid_io_written_bytes_total
+`
+	if !strings.Contains(result, expected) {
+		t.Fatalf("missing\n%s\nin\n%s", expected, result)
+	}
+}
@@ -4,6 +4,7 @@
 package metrics
 
 import (
+	"errors"
 	"io"
 )
 
@@ -14,3 +15,15 @@ func writeProcessMetrics(w io.Writer) {
 func writeFDMetrics(w io.Writer) {
 	// TODO: implement it.
 }
+
+func writeNetMetrics(w io.Writer) {
+	// TODO: implement it.
+}
+
+func writeFDTypeMetrics(w io.Writer, opts *FDTypeMetricsOptions) {
+	// TODO: implement it.
+}
+
+func writeProcessMetricsForPID(w io.Writer, procRoot string, pid int, labels string, starttime uint64) (uint64, error) {
+	return 0, errors.New("process metrics for arbitrary pids aren't supported on this OS")
+}
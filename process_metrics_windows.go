@@ -4,6 +4,7 @@
 package metrics
 
 import (
+	"errors"
 	"io"
 	"log"
 	"syscall"
@@ -82,3 +83,15 @@ func writeFDMetrics(w io.Writer) {
 	WriteGaugeUint64(w, "process_max_fds", 16777216)
 	WriteGaugeUint64(w, "process_open_fds", uint64(count))
 }
+
+func writeNetMetrics(w io.Writer) {
+	// TODO: implement it.
+}
+
+func writeFDTypeMetrics(w io.Writer, opts *FDTypeMetricsOptions) {
+	// TODO: implement it.
+}
+
+func writeProcessMetricsForPID(w io.Writer, procRoot string, pid int, labels string, starttime uint64) (uint64, error) {
+	return 0, errors.New("process metrics for arbitrary pids aren't supported on this OS")
+}
@@ -0,0 +1,211 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// pidMetricsPrefix is the prefix for metrics written by WriteProcessMetricsForPID and WatchProcess.
+//
+// It differs from the `process_` prefix of the current process metrics, since metric families must be contiguous
+// in Prometheus text exposition format.
+const pidMetricsPrefix = "process_pid_"
+
+// errProcessExited is returned by writeProcessMetricsForPID if the process doesn't exist.
+var errProcessExited = errors.New("the process has exited")
+
+var (
+	procRoot     = "/proc"
+	procRootLock sync.Mutex
+)
+
+// SetProcRoot sets the root of proc filesystem used by WriteProcessMetricsForPID and WatchProcess.
+//
+// This may be useful when the host proc filesystem is mounted at non-default path inside container.
+// By default the root is `/proc`. SetProcRoot doesn't affect metrics for the current process.
+func SetProcRoot(root string) {
+	procRootLock.Lock()
+	procRoot = root
+	procRootLock.Unlock()
+}
+
+func getProcRoot() string {
+	procRootLock.Lock()
+	root := procRoot
+	procRootLock.Unlock()
+	return root
+}
+
+// WriteProcessMetricsForPID writes `process_pid_*` metrics for the process with the given pid to w.
+//
+// The metrics include CPU, memory and IO usage. They have the same names as `process_*` metrics
+// for the current process with `process_pid_` prefix, e.g. `process_pid_cpu_seconds_total`,
+// so they don't clash with metrics written by WriteProcessMetrics. They are labeled with `pid` and `name` labels,
+// where name is the process command name. labels may contain additional comma-separated list
+// of `label="value"` labels for the metrics.
+//
+// An error is returned if the process doesn't exist or if the metrics cannot be obtained.
+// IO metrics are written only if the current process has permissions to read them.
+// The metrics are supported only on Linux. See also WatchProcess.
+func WriteProcessMetricsForPID(w io.Writer, pid int, labels string) error {
+	if err := validateTags(labels); err != nil {
+		return fmt.Errorf("invalid labels=%q: %w", labels, err)
+	}
+	if _, err := writeProcessMetricsForPID(w, getProcRoot(), pid, labels, 0); err != nil {
+		return fmt.Errorf("cannot write metrics for pid=%d: %w", pid, err)
+	}
+	return nil
+}
+
+// watchedProcess contains a process registered via WatchProcess.
+type watchedProcess struct {
+	labels string
+
+	// starttime is the process start time in clock ticks since boot.
+	// It is used for detecting pid reuse after the process exits.
+	starttime uint64
+}
+
+var (
+	watchedProcesses     = make(map[int]watchedProcess)
+	watchedProcessesLock sync.Mutex
+)
+
+// WatchProcess registers the process with the given pid for exposing its metrics via WriteProcessMetrics.
+//
+// The metrics are written like WriteProcessMetricsForPID does with the given labels.
+// The process is unregistered automatically after it exits, so its metrics are no longer exposed.
+// The process is identified by its pid and start time, so the metrics of another process, which reused the pid,
+// aren't exposed.
+// Calling WatchProcess for already watched pid updates its labels.
+//
+// An error is returned if the process doesn't exist or if its metrics cannot be obtained. See also UnwatchProcess.
+func WatchProcess(pid int, labels string) error {
+	if err := validateTags(labels); err != nil {
+		return fmt.Errorf("invalid labels=%q: %w", labels, err)
+	}
+	starttime, err := writeProcessMetricsForPID(ioutil.Discard, getProcRoot(), pid, labels, 0)
+	if err != nil {
+		return fmt.Errorf("cannot write metrics for pid=%d: %w", pid, err)
+	}
+	watchedProcessesLock.Lock()
+	watchedProcesses[pid] = watchedProcess{
+		labels:    labels,
+		starttime: starttime,
+	}
+	watchedProcessesLock.Unlock()
+	return nil
+}
+
+// UnwatchProcess unregisters the process with the given pid registered via WatchProcess.
+func UnwatchProcess(pid int) {
+	watchedProcessesLock.Lock()
+	delete(watchedProcesses, pid)
+	watchedProcessesLock.Unlock()
+}
+
+// unwatchProcess unregisters the exited process with the given pid and starttime.
+//
+// The process isn't unregistered if the pid has been registered again via WatchProcess for a new process.
+func unwatchProcess(pid int, starttime uint64) {
+	watchedProcessesLock.Lock()
+	if wp, ok := watchedProcesses[pid]; ok && wp.starttime == starttime {
+		delete(watchedProcesses, pid)
+	}
+	watchedProcessesLock.Unlock()
+}
+
+// writeWatchedProcessMetrics writes metrics for processes registered via WatchProcess to w.
+//
+// Metrics for all the processes are grouped by metric family, so every family is contiguous
+// and its metadata is written only once if ExposeMetadata is enabled. Exited processes are unregistered.
+func writeWatchedProcessMetrics(w io.Writer) {
+	watchedProcessesLock.Lock()
+	pids := make([]int, 0, len(watchedProcesses))
+	wps := make(map[int]watchedProcess, len(watchedProcesses))
+	for pid, wp := range watchedProcesses {
+		pids = append(pids, pid)
+		wps[pid] = wp
+	}
+	watchedProcessesLock.Unlock()
+	if len(pids) == 0 {
+		return
+	}
+
+	bb := getBytesBuffer()
+	defer putBytesBuffer(bb)
+
+	sort.Ints(pids)
+	root := getProcRoot()
+	for _, pid := range pids {
+		wp := wps[pid]
+		_, err := writeProcessMetricsForPID(bb, root, pid, wp.labels, wp.starttime)
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, errProcessExited) {
+			unwatchProcess(pid, wp.starttime)
+			continue
+		}
+		log.Printf("ERROR: metrics: cannot write metrics for pid=%d: %s", pid, err)
+	}
+	writeGroupedByFamily(w, bb.B)
+}
+
+// writeGroupedByFamily writes metrics from data in Prometheus text exposition format to w grouped by metric family.
+//
+// Families are written in the order of their first occurrence in data. Only the first metadata for every family is written.
+func writeGroupedByFamily(w io.Writer, data []byte) {
+	type family struct {
+		metadata []string
+		samples  []string
+	}
+	var families []*family
+	m := make(map[string]*family)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		isMetadata := strings.HasPrefix(line, "# ")
+		var name string
+		if isMetadata {
+			// # HELP <family> ... or # TYPE <family> <type>
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				continue
+			}
+			name = fields[2]
+		} else {
+			n := strings.IndexAny(line, "{ ")
+			if n < 0 {
+				continue
+			}
+			name = line[:n]
+		}
+		f := m[name]
+		if f == nil {
+			f = &family{}
+			m[name] = f
+			families = append(families, f)
+		}
+		if !isMetadata {
+			f.samples = append(f.samples, line)
+		} else if len(f.samples) == 0 {
+			f.metadata = append(f.metadata, line)
+		}
+	}
+	for _, f := range families {
+		for _, line := range f.metadata {
+			fmt.Fprintf(w, "%s\n", line)
+		}
+		for _, line := range f.samples {
+			fmt.Fprintf(w, "%s\n", line)
+		}
+	}
+}
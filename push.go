@@ -3,15 +3,20 @@ package metrics
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"compress/gzip"
@@ -29,18 +34,195 @@ type PushOptions struct {
 
 	// Whether to disable HTTP request body compression before sending the metrics to pushURL.
 	//
-	// By default the compression is enabled.
+	// By default the compression is enabled. DisableCompression takes precedence over Compression.
 	DisableCompression bool
 
+	// Compression is the compression algorithm for HTTP request body.
+	//
+	// By default gzip compression is used.
+	Compression PushCompression
+
+	// MaxBodySize is an optional limit on the size of a single request body before compression.
+	//
+	// If the rendered metrics exceed MaxBodySize, then they are split into multiple requests.
+	// Metrics are split on family boundaries, so all the samples for a single metric family
+	// such as histogram buckets are always sent in a single request. A single family, which exceeds MaxBodySize,
+	// is sent in a separate request.
+	//
+	// In Pushgateway mode with PUT method the first request is sent with PUT method, while the rest of requests
+	// are sent with POST method, so they do not replace each other.
+	//
+	// By default the size of request body isn't limited.
+	MaxBodySize int
+
+	// MaxConcurrentRequests is the maximum number of concurrent requests for sending parts of metrics split by MaxBodySize.
+	//
+	// By default parts are sent sequentially.
+	MaxConcurrentRequests int
+
+	// RelabelConfigs is an optional relabeling, which is applied to the pushed metrics after adding ExtraLabels.
+	//
+	// It may be used for dropping and renaming metrics and labels before pushing them to pushURL.
+	// See NewRelabelConfigs.
+	RelabelConfigs *RelabelConfigs
+
+	// DeltaTemporality enables pushing differences since the last successful push instead of cumulative values
+	// for counters, histogram buckets and summary sums and counts.
+	//
+	// This may be needed for backends, which expect delta temporality such as Datadog.
+	// Series without `# TYPE` metadata are considered cumulative if they have `_total`, `_bucket`, `_sum` or `_count` suffix,
+	// so it is recommended enabling metadata via ExposeMetadata. Series, which appear for the first time
+	// or which disappeared since the last push, are pushed with their full values. Series with decreased values
+	// are considered reset, so their current values are pushed.
+	DeltaTemporality bool
+
+	// AppendTimestamps enables appending the collection timestamp in milliseconds to every pushed sample.
+	//
+	// The collection timestamp is the time when writeMetrics returns. Samples, which already have timestamps, are left as is.
+	// By default the samples are pushed without timestamps, so the receiver uses the time when the samples are received.
+	//
+	// AppendTimestamps cannot be used in Pushgateway mode, since Pushgateway rejects samples with timestamps.
+	// Samples in InfluxDB line protocol always contain the collection timestamp.
+	AppendTimestamps bool
+
 	// Method is HTTP request method to use when pushing metrics to pushURL.
 	//
-	// By default the Method is GET.
+	// By default the Method is GET for PushFormatPrometheus and POST for PushFormatInfluxLine.
 	Method string
 
+	// Format is the format of the metrics pushed to pushURL.
+	//
+	// By default the metrics are pushed in Prometheus text exposition format.
+	Format PushFormat
+
+	// InfluxOrg is an optional organization name, which is passed in `org` query arg
+	// to InfluxDB v2 `/api/v2/write` endpoint when Format is PushFormatInfluxLine.
+	InfluxOrg string
+
+	// InfluxBucket is an optional bucket name, which is passed in `bucket` query arg to InfluxDB v2 `/api/v2/write` endpoint
+	// or in `db` query arg to InfluxDB v1 `/write` endpoint when Format is PushFormatInfluxLine.
+	InfluxBucket string
+
+	// PushgatewayJob enables Pushgateway mode with the given job name.
+	//
+	// In this mode pushURL must point to Pushgateway root, for example `http://pushgateway:9091`.
+	// The metrics are pushed to `<pushURL>/metrics/job/<PushgatewayJob>/<label>/<value>/...` grouping path,
+	// where `<label>/<value>` pairs are taken from PushgatewayGroupingKey.
+	// Values, which cannot be put into the path as is, are base64-encoded according to
+	// https://github.com/prometheus/pushgateway#url
+	//
+	// Method may be either PUT or POST in Pushgateway mode. PUT replaces all the metrics in the group,
+	// while POST replaces only the metrics with the same names. By default the Method is PUT.
+	//
+	// The group is deleted from Pushgateway when the periodic push started by InitPush* functions is stopped,
+	// so metrics do not linger in Pushgateway after the application is stopped. See also FlushOnStop.
+	//
+	// See https://github.com/prometheus/pushgateway
+	PushgatewayJob string
+
+	// PushgatewayGroupingKey is an optional comma-separated list of `label="value"` labels,
+	// which are added to Pushgateway grouping path after the job. For example, `instance="host1"`.
+	//
+	// PushgatewayGroupingKey is ignored if PushgatewayJob is empty.
+	PushgatewayGroupingKey string
+
+	// Auth is an optional authentication for requests to pushURL.
+	//
+	// It is applied to every request after Headers, so it overrides `Authorization` header from Headers.
+	// See NewBasicAuth, NewBearerTokenFileAuth and NewOAuth2ClientCredentialsAuth.
+	Auth PushAuth
+
+	// TLSConfig is an optional TLS configuration for connecting to pushURL.
+	TLSConfig *tls.Config
+
+	// TLSCertFile and TLSKeyFile are optional paths to PEM-encoded client certificate and key for mTLS.
+	//
+	// The files are re-read when they are changed, so the certificate may be rotated without restarting the application.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TLSCAFile is an optional path to PEM-encoded root CAs for verifying pushURL server certificate.
+	//
+	// The file is re-read when it is changed.
+	// TLSConfig.VerifyConnection, if set, is called after the server certificate is verified against TLSCAFile.
+	TLSCAFile string
+
+	// Transport is an optional http.RoundTripper for sending requests to pushURL.
+	//
+	// It may be used for setting up proxies, connection limits, etc.
+	// Transport cannot be set together with TLSConfig, TLSCertFile, TLSKeyFile or TLSCAFile.
+	Transport http.RoundTripper
+
+	// StartJitter is an optional maximum random delay before the first push.
+	//
+	// It may be used for spreading the load on pushURL from multiple instances of the application started at the same time.
+	StartJitter time.Duration
+
+	// AlignToInterval aligns pushes to wall-clock boundaries of the push interval. For example, pushes with 10s interval
+	// are performed at :00, :10, :20, etc. seconds. The alignment is shifted by a random delay if StartJitter is set.
+	AlignToInterval bool
+
+	// SkipIfBusy skips the push if the previous push is still running. Skipped pushes are counted
+	// in `metrics_push_skipped_total` metric.
+	//
+	// By default the next push is performed after the previous push is finished. Pushes, which start after
+	// the next scheduled time, are counted in `metrics_push_late_total` metric.
+	SkipIfBusy bool
+
+	// FlushOnStop enables the final push of metrics when the periodic push started by InitPush* functions is stopped.
+	//
+	// This allows short-lived jobs to make sure the metrics collected during the last interval are pushed to pushURL
+	// after canceling ctx and waiting on opts.WaitGroup.
+	// The Pushgateway group isn't deleted on stop when FlushOnStop is set.
+	FlushOnStop bool
+
+	// FlushTimeout is the timeout for the final push when FlushOnStop is set.
+	//
+	// By default the FlushTimeout equals to the push interval plus one second.
+	FlushTimeout time.Duration
+
 	// Optional WaitGroup for waiting until all the push workers created with this WaitGroup are stopped.
 	WaitGroup *sync.WaitGroup
 }
 
+// PushFormat is the format of the metrics pushed to pushURL.
+type PushFormat int
+
+const (
+	// PushFormatPrometheus is Prometheus text exposition format.
+	//
+	// See https://github.com/prometheus/docs/blob/main/content/docs/instrumenting/exposition_formats.md#text-based-format
+	PushFormatPrometheus PushFormat = iota
+
+	// PushFormatInfluxLine is InfluxDB line protocol.
+	//
+	// Metrics are converted to InfluxDB line protocol in the same way as Set.WriteInfluxLine does.
+	// It is recommended pushing metrics in this format to InfluxDB v2 `/api/v2/write` endpoint
+	// or to InfluxDB v1 `/write` endpoint. The `precision` query arg is set automatically for these endpoints.
+	PushFormatInfluxLine
+)
+
+// PushCompression is the compression algorithm for the metrics pushed to pushURL.
+type PushCompression int
+
+const (
+	// PushCompressionGzip is gzip compression with `Content-Encoding: gzip` header.
+	PushCompressionGzip PushCompression = iota
+
+	// PushCompressionNone disables compression.
+	PushCompressionNone
+
+	// PushCompressionZstd is zstd compression with `Content-Encoding: zstd` header.
+	//
+	// It is cheaper on CPU than gzip, while it provides comparable compression ratio for metrics.
+	PushCompressionZstd
+
+	// PushCompressionSnappy is snappy block compression with `Content-Encoding: snappy` header.
+	//
+	// It is the cheapest on CPU, while it provides lower compression ratio than gzip and zstd.
+	PushCompressionSnappy
+)
+
 // InitPushWithOptions sets up periodic push for globally registered metrics to the given pushURL with the given interval.
 //
 // The periodic push is stopped when ctx is canceled.
@@ -218,27 +400,161 @@ func InitPushExtWithOptions(ctx context.Context, pushURL string, interval time.D
 	}
 	pushMetricsSet.GetOrCreateFloatCounter(fmt.Sprintf(`metrics_push_interval_seconds{url=%q}`, pc.pushURLRedacted)).Set(interval.Seconds())
 
+	sched, err := newPushScheduleFromOptions(opts, pc.pushURLRedacted)
+	if err != nil {
+		return err
+	}
 	var wg *sync.WaitGroup
 	if opts != nil {
 		wg = opts.WaitGroup
-		if wg != nil {
-			wg.Add(1)
+	}
+	push := func(ctx context.Context) error {
+		return pc.pushMetrics(ctx, writeMetrics)
+	}
+	var onStop func()
+	switch {
+	case opts != nil && opts.FlushOnStop:
+		onStop = newFlushOnStop(interval, opts.FlushTimeout, push)
+	case pc.isPushgateway:
+		onStop = func() {
+			// ctx is already canceled, so use a separate context for deleting the group.
+			ctxLocal, cancel := context.WithTimeout(context.Background(), interval+time.Second)
+			defer cancel()
+			if err := pc.deleteGroup(ctxLocal); err != nil {
+				log.Printf("ERROR: metrics.push: %s", err)
+			}
+		}
+	}
+	startPeriodicPush(ctx, interval, sched, wg, push, onStop)
+
+	return nil
+}
+
+// pushSchedule contains scheduling options for startPeriodicPush.
+type pushSchedule struct {
+	// startJitter is the maximum random delay before the first push.
+	startJitter time.Duration
+
+	// alignToInterval aligns pushes to wall-clock interval boundaries.
+	alignToInterval bool
+
+	// skipIfBusy skips the push if the previous push is still running.
+	skipIfBusy bool
+
+	// skippedTotals are incremented on every push skipped because of skipIfBusy.
+	skippedTotals []*Counter
+
+	// lateTotals are incremented on every push started after the next scheduled push time
+	// because of the slow previous push.
+	lateTotals []*Counter
+}
+
+// newPushSchedule returns pushSchedule, which counts skipped and late pushes for every pushURLs.
+func newPushSchedule(startJitter time.Duration, alignToInterval, skipIfBusy bool, pushURLs ...string) (*pushSchedule, error) {
+	if startJitter < 0 {
+		return nil, fmt.Errorf("StartJitter cannot be negative; got %s", startJitter)
+	}
+	ps := &pushSchedule{
+		startJitter:     startJitter,
+		alignToInterval: alignToInterval,
+		skipIfBusy:      skipIfBusy,
+	}
+	for _, pushURL := range pushURLs {
+		ps.skippedTotals = append(ps.skippedTotals, pushMetricsSet.GetOrCreateCounter(fmt.Sprintf(`metrics_push_skipped_total{url=%q}`, pushURL)))
+		ps.lateTotals = append(ps.lateTotals, pushMetricsSet.GetOrCreateCounter(fmt.Sprintf(`metrics_push_late_total{url=%q}`, pushURL)))
+	}
+	return ps, nil
+}
+
+// newPushScheduleFromOptions returns pushSchedule for the given opts, which may be nil.
+func newPushScheduleFromOptions(opts *PushOptions, pushURLs ...string) (*pushSchedule, error) {
+	if opts == nil {
+		return newPushSchedule(0, false, false, pushURLs...)
+	}
+	return newPushSchedule(opts.StartJitter, opts.AlignToInterval, opts.SkipIfBusy, pushURLs...)
+}
+
+// getFirstPushTime returns the time for the first push according to ps.
+func (ps *pushSchedule) getFirstPushTime(now time.Time, interval time.Duration) time.Time {
+	t := now.Add(interval)
+	if ps.alignToInterval {
+		t = now.Truncate(interval).Add(interval)
+	}
+	if ps.startJitter > 0 {
+		t = t.Add(time.Duration(rand.Int63n(int64(ps.startJitter))))
+	}
+	return t
+}
+
+func incCounters(cs []*Counter) {
+	for _, c := range cs {
+		c.Inc()
+	}
+}
+
+// startPeriodicPush starts background worker, which calls push with the given interval until ctx is canceled.
+//
+// Every push call receives a context with interval+1s timeout. Errors returned by push are logged.
+// If onStop isn't nil, then it is called after ctx is canceled and before the worker is stopped.
+// If wg isn't nil, then wg.Done is called when the worker is stopped.
+// If sched is nil, then the first push is performed after the interval and the next pushes are performed
+// after the previous push is finished.
+func startPeriodicPush(ctx context.Context, interval time.Duration, sched *pushSchedule, wg *sync.WaitGroup, push func(ctx context.Context) error, onStop func()) {
+	if sched == nil {
+		sched = &pushSchedule{}
+	}
+	if wg != nil {
+		wg.Add(1)
+	}
+	doPush := func() {
+		ctxLocal, cancel := context.WithTimeout(ctx, interval+time.Second)
+		err := push(ctxLocal)
+		cancel()
+		if err != nil {
+			log.Printf("ERROR: metrics.push: %s", err)
 		}
 	}
 	go func() {
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
+		next := sched.getFirstPushTime(time.Now(), interval)
+		timer := time.NewTimer(time.Until(next))
+		defer timer.Stop()
+		var pushWG sync.WaitGroup
+		var isBusy uint32
 		stopCh := ctx.Done()
 		for {
 			select {
-			case <-ticker.C:
-				ctxLocal, cancel := context.WithTimeout(ctx, interval+time.Second)
-				err := pc.pushMetrics(ctxLocal, writeMetrics)
-				cancel()
-				if err != nil {
-					log.Printf("ERROR: metrics.push: %s", err)
+			case <-timer.C:
+				if sched.skipIfBusy {
+					if atomic.CompareAndSwapUint32(&isBusy, 0, 1) {
+						pushWG.Add(1)
+						go func() {
+							defer pushWG.Done()
+							doPush()
+							atomic.StoreUint32(&isBusy, 0)
+						}()
+					} else {
+						incCounters(sched.skippedTotals)
+					}
+				} else {
+					doPush()
+				}
+				next = next.Add(interval)
+				if now := time.Now(); !next.After(now) {
+					// The push took more than the interval, so the next push is late.
+					incCounters(sched.lateTotals)
+					if sched.alignToInterval {
+						// Skip missed intervals in order to stay aligned.
+						next = next.Add(now.Sub(next).Truncate(interval) + interval)
+					} else {
+						next = now
+					}
 				}
+				timer.Reset(time.Until(next))
 			case <-stopCh:
+				pushWG.Wait()
+				if onStop != nil {
+					onStop()
+				}
 				if wg != nil {
 					wg.Done()
 				}
@@ -246,8 +562,23 @@ func InitPushExtWithOptions(ctx context.Context, pushURL string, interval time.D
 			}
 		}
 	}()
+}
 
-	return nil
+// newFlushOnStop returns onStop callback for startPeriodicPush, which performs the final push with the given timeout.
+//
+// If timeout isn't positive, then interval plus one second is used as the timeout.
+func newFlushOnStop(interval, timeout time.Duration, push func(ctx context.Context) error) func() {
+	if timeout <= 0 {
+		timeout = interval + time.Second
+	}
+	return func() {
+		// ctx passed to startPeriodicPush is already canceled, so use a separate context for the final push.
+		ctxLocal, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := push(ctxLocal); err != nil {
+			log.Printf("ERROR: metrics.push: cannot perform the final push: %s", err)
+		}
+	}
 }
 
 // PushMetricsExt pushes metrics generated by wirteMetrics to pushURL.
@@ -268,12 +599,22 @@ func PushMetricsExt(ctx context.Context, pushURL string, writeMetrics func(w io.
 }
 
 type pushContext struct {
-	pushURL            *url.URL
-	method             string
-	pushURLRedacted    string
-	extraLabels        string
-	headers            http.Header
-	disableCompression bool
+	pushURL          *url.URL
+	method           string
+	format           PushFormat
+	contentType      string
+	pushURLRedacted  string
+	extraLabels      string
+	relabelConfigs   *RelabelConfigs
+	deltaState       *pushDeltaState
+	appendTimestamps bool
+	headers          http.Header
+	compression      PushCompression
+	isPushgateway    bool
+	auth             PushAuth
+
+	maxBodySize           int
+	maxConcurrentRequests int
 
 	client *http.Client
 
@@ -301,9 +642,39 @@ func newPushContext(pushURL string, opts *PushOptions) (*pushContext, error) {
 		return nil, fmt.Errorf("missing host in pushURL=%q", pushURL)
 	}
 
+	contentType := "text/plain"
 	method := opts.Method
-	if method == "" {
-		method = http.MethodGet
+	if opts.PushgatewayJob != "" {
+		if opts.Format != PushFormatPrometheus {
+			return nil, fmt.Errorf("unsupported Format=%d for Pushgateway; only PushFormatPrometheus is supported", opts.Format)
+		}
+		if opts.AppendTimestamps {
+			return nil, fmt.Errorf("AppendTimestamps cannot be used for Pushgateway, since it rejects samples with timestamps")
+		}
+		switch method {
+		case "":
+			method = http.MethodPut
+		case http.MethodPut, http.MethodPost:
+		default:
+			return nil, fmt.Errorf("unsupported Method=%q for Pushgateway; expecting PUT or POST", method)
+		}
+		if err := setPushgatewayPath(pu, opts.PushgatewayJob, opts.PushgatewayGroupingKey); err != nil {
+			return nil, err
+		}
+	}
+	switch opts.Format {
+	case PushFormatPrometheus:
+		if method == "" {
+			method = http.MethodGet
+		}
+	case PushFormatInfluxLine:
+		if method == "" {
+			method = http.MethodPost
+		}
+		contentType = "text/plain; charset=utf-8"
+		setInfluxQueryArgs(pu, opts)
+	default:
+		return nil, fmt.Errorf("unsupported Format=%d", opts.Format)
 	}
 
 	// validate ExtraLabels
@@ -324,15 +695,48 @@ func newPushContext(pushURL string, opts *PushOptions) (*pushContext, error) {
 		headers.Add(name, value)
 	}
 
+	// validate Compression
+	compression := opts.Compression
+	switch compression {
+	case PushCompressionGzip, PushCompressionNone, PushCompressionZstd, PushCompressionSnappy:
+	default:
+		return nil, fmt.Errorf("unsupported Compression=%d", compression)
+	}
+	if opts.DisableCompression {
+		compression = PushCompressionNone
+	}
+
+	transport, err := newPushTransport(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var deltaState *pushDeltaState
+	if opts.DeltaTemporality {
+		deltaState = newPushDeltaState()
+	}
+
 	pushURLRedacted := pu.Redacted()
-	client := &http.Client{}
+	client := &http.Client{
+		Transport: transport,
+	}
 	return &pushContext{
-		pushURL:            pu,
-		method:             method,
-		pushURLRedacted:    pushURLRedacted,
-		extraLabels:        extraLabels,
-		headers:            headers,
-		disableCompression: opts.DisableCompression,
+		pushURL:          pu,
+		method:           method,
+		format:           opts.Format,
+		contentType:      contentType,
+		pushURLRedacted:  pushURLRedacted,
+		extraLabels:      extraLabels,
+		relabelConfigs:   opts.RelabelConfigs,
+		deltaState:       deltaState,
+		appendTimestamps: opts.AppendTimestamps,
+		headers:          headers,
+		compression:      compression,
+		isPushgateway:    opts.PushgatewayJob != "",
+		auth:             opts.Auth,
+
+		maxBodySize:           opts.MaxBodySize,
+		maxConcurrentRequests: opts.MaxConcurrentRequests,
 
 		client: client,
 
@@ -349,25 +753,145 @@ func (pc *pushContext) pushMetrics(ctx context.Context, writeMetrics func(w io.W
 	defer putBytesBuffer(bb)
 
 	writeMetrics(bb)
+	return pc.pushRendered(ctx, bb, time.Now())
+}
 
+// pushRendered pushes metrics in Prometheus text exposition format from bb to pc.pushURL.
+//
+// ts is the time when the metrics were collected. bb contents may be modified by pushRendered.
+func (pc *pushContext) pushRendered(ctx context.Context, bb *bytesBuffer, ts time.Time) error {
 	if len(pc.extraLabels) > 0 {
 		bbTmp := getBytesBuffer()
 		bbTmp.B = append(bbTmp.B[:0], bb.B...)
 		bb.B = addExtraLabels(bb.B[:0], bbTmp.B, pc.extraLabels)
 		putBytesBuffer(bbTmp)
 	}
-	if !pc.disableCompression {
+	if pc.relabelConfigs != nil {
 		bbTmp := getBytesBuffer()
 		bbTmp.B = append(bbTmp.B[:0], bb.B...)
-		bb.B = bb.B[:0]
-		zw := getGzipWriter(bb)
-		if _, err := zw.Write(bbTmp.B); err != nil {
-			panic(fmt.Errorf("BUG: cannot write %d bytes to gzip writer: %s", len(bbTmp.B), err))
+		bb.B = relabelLines(bb.B[:0], bbTmp.B, pc.relabelConfigs)
+		putBytesBuffer(bbTmp)
+	}
+	var err error
+	if pc.deltaState != nil {
+		err = pc.pushDeltas(ctx, bb.B, ts)
+	} else {
+		bbTmp := getBytesBuffer()
+		bbTmp.B = append(bbTmp.B[:0], bb.B...)
+		bb.B = pc.appendConverted(bb.B[:0], bbTmp.B, ts)
+		putBytesBuffer(bbTmp)
+		if pc.maxBodySize > 0 && len(bb.B) > pc.maxBodySize {
+			err = pc.pushParts(ctx, splitPushBody(bb.B, pc.maxBodySize), nil)
+		} else {
+			err = pc.push(ctx, bb)
+		}
+	}
+	if errors.Is(err, errPushCanceled) {
+		// The push is canceled, e.g. because of the application shutdown.
+		return nil
+	}
+	return err
+}
+
+// appendConverted appends metrics in Prometheus text exposition format from src to dst after converting them
+// according to pc.format and pc.appendTimestamps.
+func (pc *pushContext) appendConverted(dst, src []byte, ts time.Time) []byte {
+	switch {
+	case pc.format == PushFormatInfluxLine:
+		return appendInfluxLines(dst, src, ts)
+	case pc.appendTimestamps:
+		return addTimestamps(dst, src, ts.UnixNano()/1e6)
+	default:
+		return append(dst, src...)
+	}
+}
+
+// pushDeltas pushes deltas for metrics in Prometheus text exposition format from src to pc.pushURL.
+//
+// Deltas are committed to pc.deltaState only for the successfully pushed parts, so deltas for the failed parts
+// are accumulated until the successful push, while deltas for the successfully pushed parts aren't pushed twice.
+func (pc *pushContext) pushDeltas(ctx context.Context, src []byte, ts time.Time) error {
+	ds := pc.deltaState
+	bb := getBytesBuffer()
+	defer putBytesBuffer(bb)
+
+	if pc.maxBodySize <= 0 {
+		deltas, currValues := ds.appendDeltas(nil, src)
+		bb.B = pc.appendConverted(bb.B[:0], deltas, ts)
+		err := pc.push(ctx, bb)
+		if err == nil {
+			ds.commit(currValues)
+		}
+		ds.forgetMissing(currValues)
+		return err
+	}
+
+	// Calculate deltas per metric family, so they can be committed per every successfully pushed part.
+	var parts [][]byte
+	var partsValues []map[string]float64
+	allValues := make(map[string]float64)
+	var part []byte
+	var partValues map[string]float64
+	for _, family := range splitPushBody(src, 1) {
+		deltas, currValues := ds.appendDeltas(nil, family)
+		bb.B = pc.appendConverted(bb.B[:0], deltas, ts)
+		if len(part) > 0 && len(part)+len(bb.B) > pc.maxBodySize {
+			parts = append(parts, part)
+			partsValues = append(partsValues, partValues)
+			part = nil
+			partValues = nil
 		}
-		if err := zw.Close(); err != nil {
-			panic(fmt.Errorf("BUG: cannot flush metrics to gzip writer: %s", err))
+		part = append(part, bb.B...)
+		if partValues == nil {
+			partValues = make(map[string]float64, len(currValues))
+		}
+		for k, v := range currValues {
+			partValues[k] = v
+			allValues[k] = v
+		}
+	}
+	if len(part) > 0 || len(parts) == 0 {
+		parts = append(parts, part)
+		partsValues = append(partsValues, partValues)
+	}
+	err := pc.pushParts(ctx, parts, func(partIdx int) {
+		ds.commit(partsValues[partIdx])
+	})
+	ds.forgetMissing(allValues)
+	return err
+}
+
+// push sends the request body from bb to pc.pushURL.
+//
+// The body is compressed before sending according to pc.compression. bb contents may be modified by push.
+func (pc *pushContext) push(ctx context.Context, bb *bytesBuffer) error {
+	return pc.pushWithMethod(ctx, bb, pc.method)
+}
+
+func (pc *pushContext) pushWithMethod(ctx context.Context, bb *bytesBuffer, method string) error {
+	contentEncoding := ""
+	if pc.compression != PushCompressionNone {
+		bbTmp := getBytesBuffer()
+		bbTmp.B = append(bbTmp.B[:0], bb.B...)
+		bb.B = bb.B[:0]
+		switch pc.compression {
+		case PushCompressionZstd:
+			bb.B = appendZstdCompressed(bb.B, bbTmp.B)
+			contentEncoding = "zstd"
+		case PushCompressionSnappy:
+			bb.B = appendSnappyCompressed(bb.B, bbTmp.B)
+			contentEncoding = "snappy"
+		default:
+			zw := getGzipWriter(bb)
+			if _, err := zw.Write(bbTmp.B); err != nil {
+				panic(fmt.Errorf("BUG: cannot write %d bytes to gzip writer: %s", len(bbTmp.B), err))
+			}
+			if err := zw.Close(); err != nil {
+				panic(fmt.Errorf("BUG: cannot flush metrics to gzip writer: %s", err))
+			}
+			putGzipWriter(zw)
+			contentEncoding = "gzip"
 		}
-		putGzipWriter(zw)
 		putBytesBuffer(bbTmp)
 	}
 
@@ -379,20 +903,23 @@ func (pc *pushContext) pushMetrics(ctx context.Context, writeMetrics func(w io.W
 
 	// Prepare the request to sent to pc.pushURL
 	reqBody := bytes.NewReader(bb.B)
-	req, err := http.NewRequestWithContext(ctx, pc.method, pc.pushURL.String(), reqBody)
+	req, err := http.NewRequestWithContext(ctx, method, pc.pushURL.String(), reqBody)
 	if err != nil {
 		panic(fmt.Errorf("BUG: metrics.push: cannot initialize request for metrics push to %q: %w", pc.pushURLRedacted, err))
 	}
 
-	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Content-Type", pc.contentType)
 	// Set the needed headers, and `Content-Type` allowed be overwrited.
 	for name, values := range pc.headers {
 		for _, value := range values {
 			req.Header.Add(name, value)
 		}
 	}
-	if !pc.disableCompression {
-		req.Header.Set("Content-Encoding", "gzip")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	if err := pc.setAuth(req); err != nil {
+		return err
 	}
 
 	// Perform the request
@@ -401,7 +928,7 @@ func (pc *pushContext) pushMetrics(ctx context.Context, writeMetrics func(w io.W
 	pc.pushDuration.UpdateDuration(startTime)
 	if err != nil {
 		if errors.Is(err, context.Canceled) {
-			return nil
+			return errPushCanceled
 		}
 		pc.pushErrors.Inc()
 		return fmt.Errorf("cannot push metrics to %q: %s", pc.pushURLRedacted, err)
@@ -410,12 +937,288 @@ func (pc *pushContext) pushMetrics(ctx context.Context, writeMetrics func(w io.W
 		body, _ := ioutil.ReadAll(resp.Body)
 		_ = resp.Body.Close()
 		pc.pushErrors.Inc()
+		pc.invalidateAuth(req, resp.StatusCode)
 		return fmt.Errorf("unexpected status code in response from %q: %d; expecting 2xx; response body: %q", pc.pushURLRedacted, resp.StatusCode, body)
 	}
 	_ = resp.Body.Close()
 	return nil
 }
 
+// errPushCanceled is returned by pushWithMethod if the push is canceled via ctx.
+//
+// The canceled push may be not delivered to pushURL, so it isn't logged, but it isn't considered successful.
+var errPushCanceled = errors.New("push is canceled")
+
+// pushParts sends parts to pc.pushURL with up to pc.maxConcurrentRequests concurrent requests.
+//
+// If onSuccess isn't nil, then it is called with the index of every successfully pushed part.
+func (pc *pushContext) pushParts(ctx context.Context, parts [][]byte, onSuccess func(partIdx int)) error {
+	pushPart := func(part []byte, method string) error {
+		bb := getBytesBuffer()
+		defer putBytesBuffer(bb)
+		bb.B = append(bb.B[:0], part...)
+		return pc.pushWithMethod(ctx, bb, method)
+	}
+
+	method := pc.method
+	firstIdx := 0
+	if pc.isPushgateway && method == http.MethodPut {
+		// The first PUT request replaces all the metrics in Pushgateway group,
+		// so the rest of parts must be added with POST requests after it.
+		if err := pushPart(parts[0], method); err != nil {
+			return err
+		}
+		if onSuccess != nil {
+			onSuccess(0)
+		}
+		firstIdx = 1
+		method = http.MethodPost
+	}
+
+	concurrency := pc.maxConcurrentRequests
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	var firstErr error
+	concurrencyCh := make(chan struct{}, concurrency)
+	for i := firstIdx; i < len(parts); i++ {
+		concurrencyCh <- struct{}{}
+		wg.Add(1)
+		go func(partIdx int) {
+			defer func() {
+				<-concurrencyCh
+				wg.Done()
+			}()
+			if err := pushPart(parts[partIdx], method); err != nil {
+				errLock.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errLock.Unlock()
+				return
+			}
+			if onSuccess != nil {
+				onSuccess(partIdx)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// splitPushBody splits src into parts with up to maxSize bytes each.
+//
+// src is split on metric family boundaries, so lines for a single family are always put into a single part.
+// A family exceeding maxSize is put into a separate part.
+func splitPushBody(src []byte, maxSize int) [][]byte {
+	var parts [][]byte
+	partStart := 0
+	familyStart := 0
+	prevFamily := ""
+	var lf lineFamilyTracker
+	for offset := 0; offset < len(src); {
+		lineEnd := bytes.IndexByte(src[offset:], '\n')
+		if lineEnd < 0 {
+			lineEnd = len(src)
+		} else {
+			lineEnd += offset + 1
+		}
+		family := lf.getLineFamily(src[offset:lineEnd])
+		if family != prevFamily {
+			// offset is the start of a new family.
+			familyStart = offset
+			prevFamily = family
+		}
+		if lineEnd-partStart > maxSize && familyStart > partStart {
+			parts = append(parts, src[partStart:familyStart])
+			partStart = familyStart
+		}
+		offset = lineEnd
+	}
+	if partStart < len(src) {
+		parts = append(parts, src[partStart:])
+	}
+	return parts
+}
+
+// lineFamilyTracker tracks `# HELP` and `# TYPE` metadata for determining metric families of the subsequent lines.
+type lineFamilyTracker struct {
+	// metaFamily is the family name from the last `# HELP` or `# TYPE` line.
+	metaFamily string
+
+	// metaType is the metric type from the last `# TYPE` line for metaFamily.
+	metaType string
+}
+
+// getLineFamily returns metric family name for the given line in Prometheus text exposition format or InfluxDB line protocol.
+//
+// Histogram and summary suffixes are removed from metric names, so all the lines for a single family have the same family name.
+// Suffixes are removed only if the preceding metadata is for histogram or summary, or if the line has no metadata,
+// so a counter such as `requests_count` stays in the same family as its metadata.
+func (lf *lineFamilyTracker) getLineFamily(line []byte) string {
+	s := strings.TrimSpace(string(line))
+	if strings.HasPrefix(s, "#") {
+		// `# HELP <name> ...` or `# TYPE <name> ...`
+		fields := strings.Fields(s)
+		if len(fields) < 3 {
+			return ""
+		}
+		switch fields[1] {
+		case "HELP":
+			if fields[2] != lf.metaFamily {
+				lf.metaType = ""
+			}
+			lf.metaFamily = fields[2]
+		case "TYPE":
+			lf.metaFamily = fields[2]
+			lf.metaType = ""
+			if len(fields) >= 4 {
+				lf.metaType = fields[3]
+			}
+		}
+		return fields[2]
+	}
+	n := strings.IndexAny(s, "{, \t")
+	if n >= 0 {
+		s = s[:n]
+	}
+	if s == lf.metaFamily {
+		return s
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if !strings.HasSuffix(s, suffix) {
+			continue
+		}
+		family := s[:len(s)-len(suffix)]
+		if family != lf.metaFamily {
+			// The line has no metadata.
+			return family
+		}
+		switch lf.metaType {
+		case "histogram", "summary", "":
+			return family
+		default:
+			return s
+		}
+	}
+	return s
+}
+
+// setAuth sets authentication for req if pc.auth is set.
+func (pc *pushContext) setAuth(req *http.Request) error {
+	if pc.auth == nil {
+		return nil
+	}
+	if err := pc.auth.SetAuth(req); err != nil {
+		pc.pushErrors.Inc()
+		return fmt.Errorf("cannot set auth for request to %q: %w", pc.pushURLRedacted, err)
+	}
+	return nil
+}
+
+// invalidateAuth invalidates credentials cached by pc.auth for req if pushURL responded with 401 Unauthorized status code.
+func (pc *pushContext) invalidateAuth(req *http.Request, statusCode int) {
+	if statusCode != http.StatusUnauthorized {
+		return
+	}
+	if ai, ok := pc.auth.(authInvalidator); ok {
+		ai.invalidateAuth(req)
+	}
+}
+
+// deleteGroup deletes Pushgateway group at pc.pushURL.
+func (pc *pushContext) deleteGroup(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, pc.pushURL.String(), nil)
+	if err != nil {
+		panic(fmt.Errorf("BUG: metrics.push: cannot initialize request for deleting group at %q: %w", pc.pushURLRedacted, err))
+	}
+	for name, values := range pc.headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if err := pc.setAuth(req); err != nil {
+		return err
+	}
+	resp, err := pc.client.Do(req)
+	if err != nil {
+		pc.pushErrors.Inc()
+		return fmt.Errorf("cannot delete group at %q: %w", pc.pushURLRedacted, err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		pc.pushErrors.Inc()
+		pc.invalidateAuth(req, resp.StatusCode)
+		return fmt.Errorf("unexpected status code in response from %q: %d; expecting 2xx; response body: %q", pc.pushURLRedacted, resp.StatusCode, body)
+	}
+	return nil
+}
+
+// setPushgatewayPath appends Pushgateway grouping path for the given job and groupingKey to pu path.
+func setPushgatewayPath(pu *url.URL, job, groupingKey string) error {
+	if err := validateTags(groupingKey); err != nil {
+		return fmt.Errorf("invalid PushgatewayGroupingKey=%q: %w", groupingKey, err)
+	}
+	var labels []Label
+	if len(groupingKey) > 0 {
+		var err error
+		labels, _, err = parseLabels(groupingKey + "}")
+		if err != nil {
+			return fmt.Errorf("cannot parse PushgatewayGroupingKey=%q: %w", groupingKey, err)
+		}
+	}
+	path := strings.TrimSuffix(pu.Path, "/") + "/metrics"
+	path = appendPushgatewayPathLabel(path, "job", job)
+	for _, label := range labels {
+		if label.Name == "job" {
+			return fmt.Errorf("PushgatewayGroupingKey=%q mustn't contain `job` label; use PushgatewayJob instead", groupingKey)
+		}
+		path = appendPushgatewayPathLabel(path, label.Name, label.Value)
+	}
+	pu.Path = path
+	pu.RawPath = ""
+	return nil
+}
+
+// appendPushgatewayPathLabel appends `/<name>/<value>` to path.
+//
+// Empty values and values with slashes are base64-encoded as `/<name>@base64/<encoded_value>`.
+func appendPushgatewayPathLabel(path, name, value string) string {
+	if value == "" {
+		// Pushgateway requires a single `=` for empty base64-encoded values.
+		return path + "/" + name + "@base64/="
+	}
+	if strings.IndexByte(value, '/') >= 0 {
+		return path + "/" + name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return path + "/" + name + "/" + value
+}
+
+// setInfluxQueryArgs sets query args for InfluxDB v1 and v2 write endpoints in pu unless they are already set.
+func setInfluxQueryArgs(pu *url.URL, opts *PushOptions) {
+	q := pu.Query()
+	setIfMissing := func(key, value string) {
+		if value != "" && q.Get(key) == "" {
+			q.Set(key, value)
+		}
+	}
+	switch {
+	case strings.HasSuffix(pu.Path, "/api/v2/write"):
+		setIfMissing("org", opts.InfluxOrg)
+		setIfMissing("bucket", opts.InfluxBucket)
+		setIfMissing("precision", "ns")
+	case strings.HasSuffix(pu.Path, "/write"):
+		setIfMissing("db", opts.InfluxBucket)
+		setIfMissing("precision", "n")
+	default:
+		return
+	}
+	pu.RawQuery = q.Encode()
+}
+
 var pushMetricsSet = NewSet()
 
 func writePushMetrics(w io.Writer) {
@@ -466,6 +1269,51 @@ func addExtraLabels(dst, src []byte, extraLabels string) []byte {
 	return dst
 }
 
+// addTimestamps appends lines from src with the given timestampMs to dst.
+//
+// Comment lines and samples, which already have timestamps, are copied as is.
+func addTimestamps(dst, src []byte, timestampMs int64) []byte {
+	for len(src) > 0 {
+		var line []byte
+		n := bytes.IndexByte(src, '\n')
+		if n >= 0 {
+			line = src[:n]
+			src = src[n+1:]
+		} else {
+			line = src
+			src = nil
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			// Skip empy lines
+			continue
+		}
+		dst = append(dst, line...)
+		if !bytes.HasPrefix(line, bashBytes) && !hasTimestamp(line) {
+			dst = append(dst, ' ')
+			dst = strconv.AppendInt(dst, timestampMs, 10)
+		}
+		dst = append(dst, '\n')
+	}
+	return dst
+}
+
+// hasTimestamp returns true if the given sample line in Prometheus text exposition format contains a timestamp.
+func hasTimestamp(line []byte) bool {
+	var tail []byte
+	if bytes.IndexByte(line, '{') >= 0 {
+		// The value and the timestamp cannot contain `}`, so the last `}` closes labels.
+		tail = line[bytes.LastIndexByte(line, '}')+1:]
+	} else {
+		n := bytes.IndexAny(line, " \t")
+		if n < 0 {
+			return false
+		}
+		tail = line[n:]
+	}
+	return len(bytes.Fields(tail)) > 1
+}
+
 var bashBytes = []byte("#")
 
 func getBytesBuffer() *bytesBuffer {
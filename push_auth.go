@@ -0,0 +1,279 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PushAuth sets authentication for requests sent to pushURL.
+//
+// See NewBasicAuth, NewBearerTokenFileAuth and NewOAuth2ClientCredentialsAuth.
+type PushAuth interface {
+	// SetAuth sets authentication for req. It is called before sending every request to pushURL.
+	//
+	// SetAuth may be called concurrently.
+	SetAuth(req *http.Request) error
+}
+
+// authInvalidator is implemented by PushAuth, which caches credentials.
+//
+// invalidateAuth is called when pushURL responds with 401 Unauthorized to the request with credentials set by SetAuth.
+type authInvalidator interface {
+	invalidateAuth(req *http.Request)
+}
+
+// NewBasicAuth returns PushAuth, which sets HTTP basic auth with the given username and password.
+func NewBasicAuth(username, password string) PushAuth {
+	return &basicAuth{
+		username: username,
+		password: password,
+	}
+}
+
+type basicAuth struct {
+	username string
+	password string
+}
+
+func (ba *basicAuth) SetAuth(req *http.Request) error {
+	req.SetBasicAuth(ba.username, ba.password)
+	return nil
+}
+
+// NewBearerTokenFileAuth returns PushAuth, which sets `Authorization: Bearer <token>` header with the token read from path.
+//
+// The file is re-read when it is changed, so the token may be rotated without restarting the application.
+// Leading and trailing whitespace is removed from the token.
+func NewBearerTokenFileAuth(path string) PushAuth {
+	return &bearerTokenFileAuth{
+		path: path,
+	}
+}
+
+type bearerTokenFileAuth struct {
+	path string
+
+	mu        sync.Mutex
+	token     string
+	fileState fileState
+}
+
+func (ba *bearerTokenFileAuth) SetAuth(req *http.Request) error {
+	token, err := ba.getToken()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (ba *bearerTokenFileAuth) getToken() (string, error) {
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+
+	fs, err := getFileState(ba.path)
+	if err != nil {
+		return "", fmt.Errorf("cannot access bearer token file: %w", err)
+	}
+	if ba.token != "" && fs == ba.fileState {
+		return ba.token, nil
+	}
+	data, err := os.ReadFile(ba.path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read bearer token file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("bearer token file %q is empty", ba.path)
+	}
+	ba.token = token
+	ba.fileState = fs
+	return ba.token, nil
+}
+
+// OAuth2Config is the configuration for OAuth2 client credentials flow.
+//
+// See https://datatracker.ietf.org/doc/html/rfc6749#section-4.4
+type OAuth2Config struct {
+	// TokenURL is the URL for obtaining access tokens.
+	TokenURL string
+
+	// ClientID is the client id.
+	ClientID string
+
+	// ClientSecret is the client secret.
+	ClientSecret string
+
+	// Scopes is an optional list of scopes to request.
+	Scopes []string
+
+	// EndpointParams is an optional list of additional params to pass to TokenURL in the form-encoded request body.
+	EndpointParams url.Values
+
+	// Client is an optional HTTP client for requests to TokenURL.
+	//
+	// By default http.DefaultClient is used.
+	Client *http.Client
+}
+
+// NewOAuth2ClientCredentialsAuth returns PushAuth, which sets `Authorization: Bearer <token>` header with the token
+// obtained via OAuth2 client credentials flow according to cfg.
+//
+// The token is cached until it expires. A new token is requested shortly before the expiration
+// or after pushURL responds with 401 Unauthorized status code.
+func NewOAuth2ClientCredentialsAuth(cfg *OAuth2Config) (PushAuth, error) {
+	if cfg.TokenURL == "" {
+		return nil, fmt.Errorf("missing TokenURL")
+	}
+	if _, err := url.Parse(cfg.TokenURL); err != nil {
+		return nil, fmt.Errorf("cannot parse TokenURL=%q: %w", cfg.TokenURL, err)
+	}
+	if cfg.ClientID == "" {
+		return nil, fmt.Errorf("missing ClientID")
+	}
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &oauth2Auth{
+		cfg:    *cfg,
+		client: client,
+	}, nil
+}
+
+type oauth2Auth struct {
+	cfg    OAuth2Config
+	client *http.Client
+
+	mu       sync.Mutex
+	token    string
+	deadline time.Time
+
+	// fetchCh is closed when the token request in progress is finished. It is nil if there is no token request in progress.
+	fetchCh chan struct{}
+}
+
+// oauth2ExpiryDelta is the maximum duration before the token expiration when a new token is requested.
+//
+// The duration is reduced to a half of the token lifetime for short-living tokens.
+const oauth2ExpiryDelta = 10 * time.Second
+
+func (oa *oauth2Auth) SetAuth(req *http.Request) error {
+	token, err := oa.getToken(req.Context())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// invalidateAuth drops the cached token if it has been used for req, so a new token is requested for the next request.
+func (oa *oauth2Auth) invalidateAuth(req *http.Request) {
+	oa.mu.Lock()
+	if oa.token != "" && req.Header.Get("Authorization") == "Bearer "+oa.token {
+		oa.token = ""
+		oa.deadline = time.Time{}
+	}
+	oa.mu.Unlock()
+}
+
+// getToken returns the cached token or requests a new token from TokenURL.
+//
+// Only a single token request is performed at a time. Concurrent callers wait for its result
+// without holding oa.mu, so they may give up when their ctx is canceled.
+func (oa *oauth2Auth) getToken(ctx context.Context) (string, error) {
+	for {
+		oa.mu.Lock()
+		if oa.token != "" && (oa.deadline.IsZero() || time.Now().Before(oa.deadline)) {
+			token := oa.token
+			oa.mu.Unlock()
+			return token, nil
+		}
+		if fetchCh := oa.fetchCh; fetchCh != nil {
+			oa.mu.Unlock()
+			select {
+			case <-fetchCh:
+				// Check the result of the finished token request.
+				continue
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+		fetchCh := make(chan struct{})
+		oa.fetchCh = fetchCh
+		oa.mu.Unlock()
+
+		token, expiresIn, err := oa.requestToken(ctx)
+
+		oa.mu.Lock()
+		oa.fetchCh = nil
+		if err == nil {
+			oa.token = token
+			oa.deadline = time.Time{}
+			if expiresIn > 0 {
+				delta := oauth2ExpiryDelta
+				if delta > expiresIn/2 {
+					delta = expiresIn / 2
+				}
+				oa.deadline = time.Now().Add(expiresIn - delta)
+			}
+		}
+		oa.mu.Unlock()
+		close(fetchCh)
+		return token, err
+	}
+}
+
+func (oa *oauth2Auth) requestToken(ctx context.Context) (string, time.Duration, error) {
+	args := url.Values{}
+	for k, vs := range oa.cfg.EndpointParams {
+		args[k] = append([]string{}, vs...)
+	}
+	args.Set("grant_type", "client_credentials")
+	if len(oa.cfg.Scopes) > 0 {
+		args.Set("scope", strings.Join(oa.cfg.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, oa.cfg.TokenURL, strings.NewReader(args.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot initialize request to TokenURL=%q: %w", oa.cfg.TokenURL, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(oa.cfg.ClientID), url.QueryEscape(oa.cfg.ClientSecret))
+
+	resp, err := oa.client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot obtain OAuth2 token from %q: %w", oa.cfg.TokenURL, err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot read OAuth2 token response from %q: %w", oa.cfg.TokenURL, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return "", 0, fmt.Errorf("unexpected status code in OAuth2 token response from %q: %d; expecting 2xx; response body: %q",
+			oa.cfg.TokenURL, resp.StatusCode, body)
+	}
+	var tr struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return "", 0, fmt.Errorf("cannot parse OAuth2 token response from %q: %w", oa.cfg.TokenURL, err)
+	}
+	if tr.AccessToken == "" {
+		return "", 0, fmt.Errorf("missing access_token in OAuth2 token response from %q", oa.cfg.TokenURL)
+	}
+	if tr.TokenType != "" && !strings.EqualFold(tr.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("unsupported token_type=%q in OAuth2 token response from %q; expecting bearer", tr.TokenType, oa.cfg.TokenURL)
+	}
+	return tr.AccessToken, time.Duration(tr.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,294 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPushBasicAuth(t *testing.T) {
+	var authHeader string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	s := NewSet()
+	s.NewCounter("foo").Inc()
+	if err := s.PushMetrics(context.Background(), srv.URL, &PushOptions{
+		Headers: []string{"Authorization: Custom foo"},
+		Auth:    NewBasicAuth("user", "pass"),
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if authHeader != "Basic dXNlcjpwYXNz" {
+		t.Fatalf("unexpected Authorization header: %q", authHeader)
+	}
+}
+
+func TestPushBearerTokenFileAuth(t *testing.T) {
+	var authHeader string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	s := NewSet()
+	s.NewCounter("foo").Inc()
+	pc, err := newPushContext(srv.URL, &PushOptions{
+		Auth: NewBearerTokenFileAuth(tokenFile),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// missing token file
+	if err := pc.pushMetrics(context.Background(), s.WritePrometheus); err == nil {
+		t.Fatalf("expecting non-nil error for missing token file")
+	}
+
+	f := func(token string) {
+		t.Helper()
+		writeTestFile(t, tokenFile, []byte(token+"\n"))
+		if err := pc.pushMetrics(context.Background(), s.WritePrometheus); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if authHeader != "Bearer "+token {
+			t.Fatalf("unexpected Authorization header; got %q; want %q", authHeader, "Bearer "+token)
+		}
+	}
+	f("token1")
+
+	// the token must be re-read after the file change
+	f("token2")
+}
+
+func TestPushOAuth2ClientCredentialsAuth(t *testing.T) {
+	var tokenRequests int32
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&tokenRequests, 1)
+		clientID, clientSecret, _ := r.BasicAuth()
+		if clientID != "id" || clientSecret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("cannot parse form: %s", err)
+		}
+		if grantType := r.PostForm.Get("grant_type"); grantType != "client_credentials" {
+			t.Errorf("unexpected grant_type: %q", grantType)
+		}
+		if scope := r.PostForm.Get("scope"); scope != "read write" {
+			t.Errorf("unexpected scope: %q", scope)
+		}
+		if audience := r.PostForm.Get("audience"); audience != "metrics" {
+			t.Errorf("unexpected audience: %q", audience)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token%d","token_type":"Bearer","expires_in":3600}`, n)
+	}))
+	defer tokenSrv.Close()
+
+	var authHeader string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	auth, err := NewOAuth2ClientCredentialsAuth(&OAuth2Config{
+		TokenURL:     tokenSrv.URL,
+		ClientID:     "id",
+		ClientSecret: "secret",
+		Scopes:       []string{"read", "write"},
+		EndpointParams: map[string][]string{
+			"audience": {"metrics"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s := NewSet()
+	s.NewCounter("foo").Inc()
+	for i := 0; i < 3; i++ {
+		if err := s.PushMetrics(context.Background(), srv.URL, &PushOptions{
+			Auth: auth,
+		}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if authHeader != "Bearer token1" {
+			t.Fatalf("unexpected Authorization header: %q", authHeader)
+		}
+	}
+	// The token must be cached.
+	if n := atomic.LoadInt32(&tokenRequests); n != 1 {
+		t.Fatalf("unexpected number of token requests; got %d; want 1", n)
+	}
+
+	// The token must be refreshed after the expiration.
+	oa := auth.(*oauth2Auth)
+	oa.mu.Lock()
+	oa.deadline = oa.deadline.Add(-2 * time.Hour)
+	oa.mu.Unlock()
+	if err := s.PushMetrics(context.Background(), srv.URL, &PushOptions{
+		Auth: auth,
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if authHeader != "Bearer token2" {
+		t.Fatalf("unexpected Authorization header after token expiration: %q", authHeader)
+	}
+
+	// invalid credentials
+	auth, err = NewOAuth2ClientCredentialsAuth(&OAuth2Config{
+		TokenURL: tokenSrv.URL,
+		ClientID: "id",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := s.PushMetrics(context.Background(), srv.URL, &PushOptions{
+		Auth: auth,
+	}); err == nil {
+		t.Fatalf("expecting non-nil error for invalid credentials")
+	}
+}
+
+func TestPushOAuth2ClientCredentialsAuthShortLivedToken(t *testing.T) {
+	var tokenRequests int32
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&tokenRequests, 1)
+		fmt.Fprintf(w, `{"access_token":"token%d","expires_in":10}`, n)
+	}))
+	defer tokenSrv.Close()
+
+	auth, err := NewOAuth2ClientCredentialsAuth(&OAuth2Config{
+		TokenURL: tokenSrv.URL,
+		ClientID: "id",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	oa := auth.(*oauth2Auth)
+	for i := 0; i < 3; i++ {
+		token, err := oa.getToken(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if token != "token1" {
+			t.Fatalf("unexpected token; got %q; want %q", token, "token1")
+		}
+	}
+	// The token living for less than oauth2ExpiryDelta must be cached too.
+	if n := atomic.LoadInt32(&tokenRequests); n != 1 {
+		t.Fatalf("unexpected number of token requests; got %d; want 1", n)
+	}
+}
+
+func TestPushOAuth2ClientCredentialsAuthUnauthorized(t *testing.T) {
+	var tokenRequests int32
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&tokenRequests, 1)
+		fmt.Fprintf(w, `{"access_token":"token%d","expires_in":3600}`, n)
+	}))
+	defer tokenSrv.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first token is revoked.
+		if r.Header.Get("Authorization") == "Bearer token1" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	auth, err := NewOAuth2ClientCredentialsAuth(&OAuth2Config{
+		TokenURL: tokenSrv.URL,
+		ClientID: "id",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s := NewSet()
+	s.NewCounter("foo").Inc()
+	opts := &PushOptions{
+		Auth: auth,
+	}
+	if err := s.PushMetrics(context.Background(), srv.URL, opts); err == nil {
+		t.Fatalf("expecting non-nil error for revoked token")
+	}
+	// The revoked token must be dropped, so the next push obtains a new token.
+	if err := s.PushMetrics(context.Background(), srv.URL, opts); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := atomic.LoadInt32(&tokenRequests); n != 2 {
+		t.Fatalf("unexpected number of token requests; got %d; want 2", n)
+	}
+}
+
+func TestOAuth2ClientCredentialsAuthSlowTokenURL(t *testing.T) {
+	requestCh := make(chan struct{}, 1)
+	releaseCh := make(chan struct{})
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCh <- struct{}{}
+		<-releaseCh
+		fmt.Fprintf(w, `{"access_token":"token","expires_in":3600}`)
+	}))
+	defer tokenSrv.Close()
+
+	auth, err := NewOAuth2ClientCredentialsAuth(&OAuth2Config{
+		TokenURL: tokenSrv.URL,
+		ClientID: "id",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	oa := auth.(*oauth2Auth)
+
+	resultCh := make(chan error, 1)
+	go func() {
+		_, err := oa.getToken(context.Background())
+		resultCh <- err
+	}()
+	<-requestCh
+
+	// Concurrent callers mustn't be blocked by the slow token request after their context is canceled.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := oa.getToken(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error; got %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	close(releaseCh)
+	if err := <-resultCh; err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	token, err := oa.getToken(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if token != "token" {
+		t.Fatalf("unexpected token; got %q; want %q", token, "token")
+	}
+}
+
+func TestNewOAuth2ClientCredentialsAuthInvalidConfig(t *testing.T) {
+	f := func(cfg *OAuth2Config) {
+		t.Helper()
+		if _, err := NewOAuth2ClientCredentialsAuth(cfg); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	f(&OAuth2Config{})
+	f(&OAuth2Config{
+		TokenURL: "http://localhost/token",
+	})
+	f(&OAuth2Config{
+		TokenURL: "http://[::1",
+		ClientID: "id",
+	})
+}
@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// pushDeltaState holds the last pushed values of cumulative series for a single pushURL.
+type pushDeltaState struct {
+	mu sync.Mutex
+
+	// prevValues contains the last successfully pushed cumulative values keyed by series name with labels.
+	prevValues map[string]float64
+}
+
+func newPushDeltaState() *pushDeltaState {
+	return &pushDeltaState{
+		prevValues: make(map[string]float64),
+	}
+}
+
+// appendDeltas converts cumulative series in Prometheus text exposition format from src to deltas
+// since the last successful push and appends the result to dst.
+//
+// It returns the cumulative values, which must be passed to commit after the successful push
+// and to forgetMissing after every push attempt.
+//
+// Cumulative series are detected with `# TYPE` metadata if it is present. Series without metadata
+// are considered cumulative if they have `_total`, `_bucket`, `_sum` or `_count` suffix.
+// Series, which are missing in the previous push, are sent with their full values, since they start from zero.
+// Series with decreased values are considered reset, so their current values are sent.
+func (ds *pushDeltaState) appendDeltas(dst, src []byte) ([]byte, map[string]float64) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	prevValues := ds.prevValues
+	currValues := make(map[string]float64)
+	familyTypes := make(map[string]string)
+	for len(src) > 0 {
+		var line []byte
+		n := bytes.IndexByte(src, '\n')
+		if n >= 0 {
+			line = src[:n]
+			src = src[n+1:]
+		} else {
+			line = src
+			src = nil
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			// Skip empy lines
+			continue
+		}
+		if bytes.HasPrefix(line, bashBytes) {
+			fields := strings.Fields(string(line))
+			if len(fields) >= 4 && fields[1] == "TYPE" {
+				familyTypes[fields[2]] = fields[3]
+			}
+			dst = append(dst, line...)
+			dst = append(dst, '\n')
+			continue
+		}
+		key, value, tail, ok := splitSampleLine(line)
+		if !ok || !isCumulativeSeries(key, familyTypes) {
+			dst = append(dst, line...)
+			dst = append(dst, '\n')
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			dst = append(dst, line...)
+			dst = append(dst, '\n')
+			continue
+		}
+		keyStr := string(key)
+		currValues[keyStr] = v
+		if prev, ok := prevValues[keyStr]; ok && v >= prev {
+			v -= prev
+		}
+		dst = append(dst, key...)
+		dst = append(dst, ' ')
+		dst = strconv.AppendFloat(dst, v, 'g', -1, 64)
+		dst = append(dst, tail...)
+		dst = append(dst, '\n')
+	}
+	return dst, currValues
+}
+
+// commit remembers currValues returned by appendDeltas as the last pushed values.
+func (ds *pushDeltaState) commit(currValues map[string]float64) {
+	ds.mu.Lock()
+	for key, v := range currValues {
+		ds.prevValues[key] = v
+	}
+	ds.mu.Unlock()
+}
+
+// forgetMissing forgets series missing in currValues, so they are sent with full values if they appear again.
+func (ds *pushDeltaState) forgetMissing(currValues map[string]float64) {
+	ds.mu.Lock()
+	for key := range ds.prevValues {
+		if _, ok := currValues[key]; !ok {
+			delete(ds.prevValues, key)
+		}
+	}
+	ds.mu.Unlock()
+}
+
+// getPrevValue returns the last pushed value for the series with the given key.
+func (ds *pushDeltaState) getPrevValue(key string) (float64, bool) {
+	ds.mu.Lock()
+	v, ok := ds.prevValues[key]
+	ds.mu.Unlock()
+	return v, ok
+}
+
+// splitSampleLine splits sample line in Prometheus text exposition format into series name with labels,
+// value and the tail with optional timestamp.
+func splitSampleLine(line []byte) ([]byte, string, []byte, bool) {
+	var n int
+	if bytes.IndexByte(line, '{') >= 0 {
+		// The value and the timestamp cannot contain `}`, so the last `}` closes labels.
+		n = bytes.LastIndexByte(line, '}') + 1
+	} else {
+		n = bytes.IndexAny(line, " \t")
+		if n < 0 {
+			return nil, "", nil, false
+		}
+	}
+	key := line[:n]
+	tail := bytes.TrimLeft(line[n:], " \t")
+	n = bytes.IndexAny(tail, " \t")
+	if n < 0 {
+		return key, string(tail), nil, len(tail) > 0
+	}
+	return key, string(tail[:n]), tail[n:], true
+}
+
+// isCumulativeSeries returns true if the series with the given key is cumulative.
+//
+// The series type is obtained from familyTypes. Name suffixes are used for series without `# TYPE` metadata.
+func isCumulativeSeries(key []byte, familyTypes map[string]string) bool {
+	name := getMetricFamily(string(key))
+	if metricType, ok := familyTypes[name]; ok {
+		return metricType == "counter"
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		metricType, ok := familyTypes[strings.TrimSuffix(name, suffix)]
+		if !ok {
+			return true
+		}
+		switch metricType {
+		case "histogram":
+			return true
+		case "summary":
+			return suffix != "_bucket"
+		default:
+			return false
+		}
+	}
+	return strings.HasSuffix(name, "_total")
+}
@@ -0,0 +1,269 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPushDeltaStateAppendDeltas(t *testing.T) {
+	ds := newPushDeltaState()
+	f := func(src, expectedResult string) {
+		t.Helper()
+		result, currValues := ds.appendDeltas(nil, []byte(src))
+		if string(result) != expectedResult {
+			t.Fatalf("unexpected result; got\n%s\nwant\n%s", result, expectedResult)
+		}
+		ds.commit(currValues)
+		ds.forgetMissing(currValues)
+	}
+
+	// the first push contains full values
+	f(`# HELP foo
+# TYPE foo counter
+foo{a="b"} 10
+# HELP g
+# TYPE g gauge
+g 5
+# HELP h
+# TYPE h histogram
+h_bucket{le="1"} 2
+h_bucket{le="+Inf"} 3
+h_sum 4.5
+h_count 3
+# HELP s
+# TYPE s summary
+s{quantile="0.5"} 7
+s_sum 20
+s_count 4
+requests_total 100
+temperature 21
+`, `# HELP foo
+# TYPE foo counter
+foo{a="b"} 10
+# HELP g
+# TYPE g gauge
+g 5
+# HELP h
+# TYPE h histogram
+h_bucket{le="1"} 2
+h_bucket{le="+Inf"} 3
+h_sum 4.5
+h_count 3
+# HELP s
+# TYPE s summary
+s{quantile="0.5"} 7
+s_sum 20
+s_count 4
+requests_total 100
+temperature 21
+`)
+
+	// the next push contains deltas for cumulative series only
+	f(`# HELP foo
+# TYPE foo counter
+foo{a="b"} 15
+# HELP g
+# TYPE g gauge
+g 3
+# HELP h
+# TYPE h histogram
+h_bucket{le="1"} 2
+h_bucket{le="+Inf"} 5
+h_sum 6
+h_count 5
+# HELP s
+# TYPE s summary
+s{quantile="0.5"} 8
+s_sum 25
+s_count 5
+requests_total 130 123
+temperature 22
+`, `# HELP foo
+# TYPE foo counter
+foo{a="b"} 5
+# HELP g
+# TYPE g gauge
+g 3
+# HELP h
+# TYPE h histogram
+h_bucket{le="1"} 0
+h_bucket{le="+Inf"} 2
+h_sum 1.5
+h_count 2
+# HELP s
+# TYPE s summary
+s{quantile="0.5"} 8
+s_sum 5
+s_count 1
+requests_total 30 123
+temperature 22
+`)
+
+	// counter reset and disappeared series
+	f(`requests_total 20
+`, `requests_total 20
+`)
+	f(`requests_total 25
+foo{a="b"} 17
+`, `requests_total 5
+foo{a="b"} 17
+`)
+}
+
+func TestPushMetricsDeltaTemporality(t *testing.T) {
+	var reqData []byte
+	statusCode := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqData, _ = io.ReadAll(r.Body)
+		w.WriteHeader(statusCode)
+	}))
+	defer srv.Close()
+
+	s := NewSet()
+	c := s.NewCounter("requests_total")
+	fc := s.NewFloatCounter("bytes_total")
+	s.NewGauge("temperature", nil).Set(21)
+
+	pc, err := newPushContext(srv.URL, &PushOptions{
+		DeltaTemporality:   true,
+		DisableCompression: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f := func(expectedData string, expectError bool) {
+		t.Helper()
+		err := pc.pushMetrics(context.Background(), s.WritePrometheus)
+		if expectError && err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		if !expectError && err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(reqData) != expectedData {
+			t.Fatalf("unexpected request body; got\n%s\nwant\n%s", reqData, expectedData)
+		}
+	}
+
+	c.Add(10)
+	fc.Add(1.5)
+	f("bytes_total 1.5\nrequests_total 10\ntemperature 21\n", false)
+
+	c.Add(5)
+	f("bytes_total 0\nrequests_total 5\ntemperature 21\n", false)
+
+	// deltas are accumulated until the successful push
+	c.Add(3)
+	statusCode = http.StatusBadGateway
+	f("bytes_total 0\nrequests_total 3\ntemperature 21\n", true)
+	c.Add(2)
+	statusCode = http.StatusOK
+	f("bytes_total 0\nrequests_total 5\ntemperature 21\n", false)
+}
+
+func TestPushMetricsDeltaTemporalityPartialFailure(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	failPrefix := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, string(data))
+		if failPrefix != "" && strings.HasPrefix(string(data), failPrefix) {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	s := NewSet()
+	a := s.NewCounter("aaa_total")
+	b := s.NewCounter("bbb_total")
+
+	pc, err := newPushContext(srv.URL, &PushOptions{
+		DeltaTemporality:   true,
+		DisableCompression: true,
+		MaxBodySize:        16,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f := func(expectedRequests []string, expectError bool) {
+		t.Helper()
+		mu.Lock()
+		requests = requests[:0]
+		mu.Unlock()
+		err := pc.pushMetrics(context.Background(), s.WritePrometheus)
+		if expectError && err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		if !expectError && err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !reflect.DeepEqual(requests, expectedRequests) {
+			t.Fatalf("unexpected requests; got %q; want %q", requests, expectedRequests)
+		}
+	}
+
+	a.Add(1)
+	b.Add(10)
+	f([]string{"aaa_total 1\n", "bbb_total 10\n"}, false)
+
+	// The failed part mustn't prevent committing deltas for the successfully pushed part.
+	a.Add(2)
+	b.Add(20)
+	failPrefix = "bbb_total"
+	f([]string{"aaa_total 2\n", "bbb_total 20\n"}, true)
+
+	a.Add(3)
+	b.Add(30)
+	failPrefix = ""
+	f([]string{"aaa_total 3\n", "bbb_total 50\n"}, false)
+}
+
+func TestPushMetricsDeltaTemporalityCanceled(t *testing.T) {
+	var reqData []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqData, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	s := NewSet()
+	c := s.NewCounter("requests_total")
+	pc, err := newPushContext(srv.URL, &PushOptions{
+		DeltaTemporality:   true,
+		DisableCompression: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c.Add(10)
+	if err := pc.pushMetrics(context.Background(), s.WritePrometheus); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The canceled push isn't logged as an error, but its deltas mustn't be committed.
+	c.Add(5)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := pc.pushMetrics(ctx, s.WritePrometheus); err != nil {
+		t.Fatalf("unexpected error for canceled push: %s", err)
+	}
+
+	c.Add(1)
+	if err := pc.pushMetrics(context.Background(), s.WritePrometheus); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(reqData) != "requests_total 6\n" {
+		t.Fatalf("unexpected request body; got %q; want %q", reqData, "requests_total 6\n")
+	}
+}
@@ -0,0 +1,275 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PushDestination is a destination for InitPushMultiWithOptions.
+type PushDestination struct {
+	// URL is the url to push metrics to.
+	URL string
+
+	// Options is an optional configuration for pushing metrics to URL.
+	//
+	// Options.WaitGroup, Options.FlushOnStop, Options.FlushTimeout and scheduling options are ignored.
+	// Use the corresponding fields from PushMultiOptions instead.
+	Options *PushOptions
+}
+
+// PushMultiOptions is the list of options, which may be applied to InitPushMultiWithOptions().
+type PushMultiOptions struct {
+	// FlushOnStop enables the final push of metrics to all the destinations when the periodic push is stopped.
+	//
+	// See PushOptions.FlushOnStop.
+	FlushOnStop bool
+
+	// FlushTimeout is the timeout for the final push when FlushOnStop is set.
+	//
+	// By default the FlushTimeout equals to the push interval plus one second.
+	FlushTimeout time.Duration
+
+	// StartJitter is an optional maximum random delay before the first push. See PushOptions.StartJitter.
+	StartJitter time.Duration
+
+	// AlignToInterval aligns pushes to wall-clock boundaries of the push interval. See PushOptions.AlignToInterval.
+	AlignToInterval bool
+
+	// SkipIfBusy skips the push to a destination if the previous push to this destination is still running.
+	//
+	// By default the push is started right after the previous push to the destination is finished.
+	// See also PushOptions.SkipIfBusy.
+	SkipIfBusy bool
+
+	// Optional WaitGroup for waiting until all the push workers created with this WaitGroup are stopped.
+	WaitGroup *sync.WaitGroup
+}
+
+// InitPushMultiWithOptions sets up periodic push for globally registered metrics to the given destinations with the given interval.
+//
+// See InitPushMultiExtWithOptions for details.
+func InitPushMultiWithOptions(ctx context.Context, destinations []PushDestination, interval time.Duration, pushProcessMetrics bool, opts *PushMultiOptions) error {
+	writeMetrics := func(w io.Writer) {
+		WritePrometheus(w, pushProcessMetrics)
+	}
+	return InitPushMultiExtWithOptions(ctx, destinations, interval, writeMetrics, opts)
+}
+
+// InitPushMultiWithOptions sets up periodic push for metrics from s to the given destinations with the given interval.
+//
+// See InitPushMultiExtWithOptions for details.
+func (s *Set) InitPushMultiWithOptions(ctx context.Context, destinations []PushDestination, interval time.Duration, opts *PushMultiOptions) error {
+	return InitPushMultiExtWithOptions(ctx, destinations, interval, s.WritePrometheus, opts)
+}
+
+// InitPushMultiExtWithOptions sets up periodic push for metrics obtained by calling writeMetrics to the given destinations
+// with the given interval.
+//
+// The writeMetrics callback must write metrics to w in Prometheus text exposition format without timestamps and trailing comments.
+// See https://github.com/prometheus/docs/blob/main/content/docs/instrumenting/exposition_formats.md#text-based-format
+//
+// writeMetrics is called once per interval, and the result is pushed concurrently to all the destinations.
+// Every destination has its own options, its own `metrics_push_*` metrics and its own push worker.
+// An error or a slow response from a single destination doesn't delay pushing metrics to other destinations.
+// If the previous push to a destination is still running, then only the most recently rendered metrics
+// are pushed to it after the previous push is finished.
+//
+// The periodic push is stopped when ctx is canceled.
+// It is possible to wait until the background metrics push worker is stopped on a WaitGroup passed via opts.WaitGroup.
+//
+// opts may contain additional configuration options if non-nil.
+func InitPushMultiExtWithOptions(ctx context.Context, destinations []PushDestination, interval time.Duration, writeMetrics func(w io.Writer), opts *PushMultiOptions) error {
+	if opts == nil {
+		opts = &PushMultiOptions{}
+	}
+	if len(destinations) == 0 {
+		return fmt.Errorf("destinations cannot be empty")
+	}
+	pcs := make([]*pushContext, len(destinations))
+	for i, d := range destinations {
+		pc, err := newPushContext(d.URL, d.Options)
+		if err != nil {
+			return fmt.Errorf("invalid destination #%d: %w", i, err)
+		}
+		pcs[i] = pc
+	}
+
+	// validate interval
+	if interval <= 0 {
+		return fmt.Errorf("interval must be positive; got %s", interval)
+	}
+	for _, pc := range pcs {
+		pushMetricsSet.GetOrCreateFloatCounter(fmt.Sprintf(`metrics_push_interval_seconds{url=%q}`, pc.pushURLRedacted)).Set(interval.Seconds())
+	}
+
+	// Jitter and alignment are applied to rendering, while pushes are scheduled by per-destination workers.
+	sched, err := newPushSchedule(opts.StartJitter, opts.AlignToInterval, false)
+	if err != nil {
+		return err
+	}
+
+	pws := make([]*pushMultiWorker, len(pcs))
+	var workersWG sync.WaitGroup
+	workersCtx, cancelWorkers := context.WithCancel(context.Background())
+	for i, pc := range pcs {
+		pw := newPushMultiWorker(pc, interval)
+		workersWG.Add(1)
+		go func() {
+			defer workersWG.Done()
+			pw.run(workersCtx)
+		}()
+		pws[i] = pw
+	}
+	stopWorkers := func() {
+		for _, pw := range pws {
+			close(pw.ch)
+		}
+		workersWG.Wait()
+		cancelWorkers()
+	}
+
+	push := func(_ context.Context) error {
+		renderMulti(pws, writeMetrics, opts.SkipIfBusy)
+		return nil
+	}
+	var onStop func()
+	if opts.FlushOnStop {
+		flushTimeout := opts.FlushTimeout
+		if flushTimeout <= 0 {
+			flushTimeout = interval + time.Second
+		}
+		onStop = func() {
+			renderMulti(pws, writeMetrics, false)
+			// Cancel pending pushes if they do not finish in flushTimeout.
+			t := time.AfterFunc(flushTimeout, cancelWorkers)
+			stopWorkers()
+			t.Stop()
+		}
+	} else {
+		onStop = func() {
+			cancelWorkers()
+			stopWorkers()
+
+			// ctx is already canceled, so use a separate context for deleting Pushgateway groups.
+			ctxLocal, cancel := context.WithTimeout(context.Background(), interval+time.Second)
+			defer cancel()
+			for _, pc := range pcs {
+				if !pc.isPushgateway {
+					continue
+				}
+				if err := pc.deleteGroup(ctxLocal); err != nil {
+					log.Printf("ERROR: metrics.push: %s", err)
+				}
+			}
+		}
+	}
+	startPeriodicPush(ctx, interval, sched, opts.WaitGroup, push, onStop)
+
+	return nil
+}
+
+// renderMulti renders metrics with writeMetrics once and passes them to all the pws.
+//
+// Busy workers skip the rendered metrics if skipIfBusy is set.
+func renderMulti(pws []*pushMultiWorker, writeMetrics func(w io.Writer), skipIfBusy bool) {
+	bb := getBytesBuffer()
+	defer putBytesBuffer(bb)
+
+	writeMetrics(bb)
+	ts := time.Now()
+	for _, pw := range pws {
+		pw.schedule(bb.B, ts, skipIfBusy)
+	}
+}
+
+// pushMultiWorker pushes metrics rendered by renderMulti to a single destination.
+//
+// Every destination has its own worker, so a slow or failing destination doesn't delay pushes to other destinations.
+type pushMultiWorker struct {
+	pc       *pushContext
+	interval time.Duration
+
+	// ch holds at most one pending push. The pending push is replaced with the fresh one if the worker is busy.
+	ch chan *pushMultiPayload
+
+	// isBusy is set to 1 while the push is running.
+	isBusy uint32
+
+	skippedTotal *Counter
+	lateTotal    *Counter
+}
+
+type pushMultiPayload struct {
+	bb *bytesBuffer
+	ts time.Time
+}
+
+func newPushMultiWorker(pc *pushContext, interval time.Duration) *pushMultiWorker {
+	return &pushMultiWorker{
+		pc:       pc,
+		interval: interval,
+		ch:       make(chan *pushMultiPayload, 1),
+
+		skippedTotal: pushMetricsSet.GetOrCreateCounter(fmt.Sprintf(`metrics_push_skipped_total{url=%q}`, pc.pushURLRedacted)),
+		lateTotal:    pushMetricsSet.GetOrCreateCounter(fmt.Sprintf(`metrics_push_late_total{url=%q}`, pc.pushURLRedacted)),
+	}
+}
+
+// schedule schedules pushing a copy of data rendered at ts.
+//
+// data is skipped if the worker is busy and skipIfBusy is set.
+// It never blocks. schedule must be called from a single goroutine.
+func (pw *pushMultiWorker) schedule(data []byte, ts time.Time, skipIfBusy bool) {
+	isBusy := atomic.LoadUint32(&pw.isBusy) != 0
+	if isBusy && skipIfBusy {
+		pw.skippedTotal.Inc()
+		return
+	}
+	// pushRendered modifies the buffer, so every destination needs its own copy.
+	bb := getBytesBuffer()
+	bb.B = append(bb.B[:0], data...)
+	p := &pushMultiPayload{
+		bb: bb,
+		ts: ts,
+	}
+	select {
+	case pw.ch <- p:
+		if isBusy {
+			// The push starts after the previous push is finished.
+			pw.lateTotal.Inc()
+		}
+		return
+	default:
+	}
+	// Replace the pending push with the fresh one. Deltas aren't lost, since they are calculated at push time.
+	select {
+	case pOld := <-pw.ch:
+		putBytesBuffer(pOld.bb)
+		pw.skippedTotal.Inc()
+	default:
+	}
+	pw.ch <- p
+	pw.lateTotal.Inc()
+}
+
+// run pushes scheduled metrics until pw.ch is closed.
+//
+// Every push receives a context with interval+1s timeout derived from ctx.
+func (pw *pushMultiWorker) run(ctx context.Context) {
+	for p := range pw.ch {
+		atomic.StoreUint32(&pw.isBusy, 1)
+		ctxLocal, cancel := context.WithTimeout(ctx, pw.interval+time.Second)
+		err := pw.pc.pushRendered(ctxLocal, p.bb, p.ts)
+		cancel()
+		putBytesBuffer(p.bb)
+		atomic.StoreUint32(&pw.isBusy, 0)
+		if err != nil {
+			log.Printf("ERROR: metrics.push: %s", err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInitPushMultiWithOptions(t *testing.T) {
+	type request struct {
+		header string
+		body   string
+	}
+	newServer := func(statusCode int) (*httptest.Server, chan request) {
+		ch := make(chan request, 100)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data, _ := io.ReadAll(r.Body)
+			ch <- request{
+				header: r.Header.Get("X-Dest"),
+				body:   string(data),
+			}
+			w.WriteHeader(statusCode)
+		}))
+		return srv, ch
+	}
+	srv1, ch1 := newServer(http.StatusOK)
+	defer srv1.Close()
+	srv2, ch2 := newServer(http.StatusInternalServerError)
+	defer srv2.Close()
+
+	var writeCalls int32
+	writeMetrics := func(w io.Writer) {
+		n := atomic.AddInt32(&writeCalls, 1)
+		fmt.Fprintf(w, "foo %d\n", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if err := InitPushMultiExtWithOptions(ctx, []PushDestination{
+		{
+			URL: srv1.URL,
+			Options: &PushOptions{
+				Headers:            []string{"X-Dest: first"},
+				ExtraLabels:        `dest="1"`,
+				DisableCompression: true,
+			},
+		},
+		{
+			URL: srv2.URL,
+			Options: &PushOptions{
+				Headers:            []string{"X-Dest: second"},
+				DisableCompression: true,
+			},
+		},
+	}, time.Hour, writeMetrics, &PushMultiOptions{
+		FlushOnStop: true,
+		WaitGroup:   &wg,
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cancel()
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&writeCalls); n != 1 {
+		t.Fatalf("unexpected number of writeMetrics calls; got %d; want 1", n)
+	}
+	f := func(ch chan request, expectedHeader, expectedBody string) {
+		t.Helper()
+		select {
+		case r := <-ch:
+			if r.header != expectedHeader {
+				t.Fatalf("unexpected header; got %q; want %q", r.header, expectedHeader)
+			}
+			if r.body != expectedBody {
+				t.Fatalf("unexpected body; got %q; want %q", r.body, expectedBody)
+			}
+		default:
+			t.Fatalf("missing request")
+		}
+	}
+	f(ch1, "first", "foo{dest=\"1\"} 1\n")
+	f(ch2, "second", "foo 1\n")
+
+	// The failed destination must have its own error counter.
+	pc2, err := newPushContext(srv2.URL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := pc2.pushErrors.Get(); n == 0 {
+		t.Fatalf("expecting non-zero errors for %s", srv2.URL)
+	}
+	pc1, err := newPushContext(srv1.URL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := pc1.pushErrors.Get(); n != 0 {
+		t.Fatalf("unexpected errors for %s: %d", srv1.URL, n)
+	}
+}
+
+func TestInitPushMultiInvalidDestinations(t *testing.T) {
+	f := func(destinations []PushDestination) {
+		t.Helper()
+		if err := InitPushMultiExtWithOptions(context.Background(), destinations, time.Second, func(w io.Writer) {}, nil); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	f(nil)
+	f([]PushDestination{
+		{
+			URL: "http://localhost:8428",
+		},
+		{
+			URL: "foobar",
+		},
+	})
+}
+
+func TestInitPushMultiSlowDestination(t *testing.T) {
+	releaseCh := make(chan struct{})
+	var slowRequests int32
+	slowSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&slowRequests, 1)
+		select {
+		case <-releaseCh:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slowSrv.Close()
+	var fastRequests int32
+	fastSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fastRequests, 1)
+	}))
+	defer fastSrv.Close()
+
+	s := NewSet()
+	s.NewCounter("foo").Inc()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if err := s.InitPushMultiWithOptions(ctx, []PushDestination{
+		{
+			URL: slowSrv.URL,
+		},
+		{
+			URL: fastSrv.URL,
+		},
+	}, 10*time.Millisecond, &PushMultiOptions{
+		WaitGroup: &wg,
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The blocked destination mustn't delay pushes to the fast destination.
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&fastRequests) < 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout when waiting for pushes to the fast destination; got %d pushes", atomic.LoadInt32(&fastRequests))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&slowRequests); n != 1 {
+		t.Fatalf("unexpected number of requests to the blocked destination; got %d; want 1", n)
+	}
+	slowURL := getRedactedURL(t, slowSrv.URL)
+	if n := pushMetricsSet.GetOrCreateCounter(fmt.Sprintf(`metrics_push_late_total{url=%q}`, slowURL)).Get(); n == 0 {
+		t.Fatalf("expecting non-zero late pushes for the blocked destination")
+	}
+	if n := pushMetricsSet.GetOrCreateCounter(fmt.Sprintf(`metrics_push_skipped_total{url=%q}`, slowURL)).Get(); n == 0 {
+		t.Fatalf("expecting non-zero skipped pushes for the blocked destination")
+	}
+
+	close(releaseCh)
+	cancel()
+	wg.Wait()
+}
+
+func getRedactedURL(t *testing.T, pushURL string) string {
+	t.Helper()
+	pc, err := newPushContext(pushURL, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return pc.pushURLRedacted
+}
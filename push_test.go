@@ -4,10 +4,17 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -40,6 +47,74 @@ foobar{x="y",a="b",c="d"} 4
 `)
 }
 
+func TestAddTimestamps(t *testing.T) {
+	f := func(s, expectedResult string) {
+		t.Helper()
+		result := addTimestamps(nil, []byte(s), 1700000000123)
+		if string(result) != expectedResult {
+			t.Fatalf("unexpected result; got\n%s\nwant\n%s", result, expectedResult)
+		}
+	}
+	f("", "")
+	f("a 123", "a 123 1700000000123\n")
+	f(`a{b="c"} 1.3`, `a{b="c"} 1.3 1700000000123`+"\n")
+	f(`a{b="c} 1 2"} 1.3`, `a{b="c} 1 2"} 1.3 1700000000123`+"\n")
+
+	// samples with timestamps are left as is
+	f("a 123 456", "a 123 456\n")
+	f(`a{b="c"} 1.3 456`, `a{b="c"} 1.3 456`+"\n")
+
+	// comments are copied as is
+	f(`
+# HELP foo some counter
+# TYPE foo counter
+	  foo{a="b"} 4
+bar 5`, `# HELP foo some counter
+# TYPE foo counter
+foo{a="b"} 4 1700000000123
+bar 5 1700000000123
+`)
+}
+
+func TestPushMetricsAppendTimestamps(t *testing.T) {
+	var reqData []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqData, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	s := NewSet()
+	s.NewCounter(`foo{bar="baz"}`).Set(1234)
+	tsMin := time.Now().UnixNano() / 1e6
+	if err := s.PushMetrics(context.Background(), srv.URL, &PushOptions{
+		AppendTimestamps:   true,
+		ExtraLabels:        `instance="x"`,
+		DisableCompression: true,
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tsMax := time.Now().UnixNano() / 1e6
+
+	prefix := `foo{instance="x",bar="baz"} 1234 `
+	if !strings.HasPrefix(string(reqData), prefix) || !strings.HasSuffix(string(reqData), "\n") {
+		t.Fatalf("unexpected request body: %q", reqData)
+	}
+	ts, err := strconv.ParseInt(strings.TrimSuffix(string(reqData[len(prefix):]), "\n"), 10, 64)
+	if err != nil {
+		t.Fatalf("cannot parse timestamp in %q: %s", reqData, err)
+	}
+	if ts < tsMin || ts > tsMax {
+		t.Fatalf("unexpected timestamp %d; want in the range [%d, %d]", ts, tsMin, tsMax)
+	}
+
+	if _, err := newPushContext("http://localhost:9091", &PushOptions{
+		PushgatewayJob:   "batch",
+		AppendTimestamps: true,
+	}); err == nil {
+		t.Fatalf("expecting non-nil error for AppendTimestamps in Pushgateway mode")
+	}
+}
+
 func TestInitPushFailure(t *testing.T) {
 	f := func(pushURL string, interval time.Duration, extraLabels string) {
 		t.Helper()
@@ -241,3 +316,438 @@ func TestPushMetrics(t *testing.T) {
 		Headers: []string{"Foo: Bar", "baz:aaaa-bbb"},
 	}, "Baz: aaaa-bbb\r\nContent-Encoding: gzip\r\nContent-Type: text/plain\r\nFoo: Bar\r\n", "bar 42.12\nfoo 1234\n")
 }
+
+func TestPushMetricsInfluxLine(t *testing.T) {
+	f := func(path string, opts *PushOptions, expectedQuery string) {
+		t.Helper()
+
+		var reqMethod, reqQuery, reqContentType string
+		var reqData []byte
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reqMethod = r.Method
+			reqQuery = r.URL.RawQuery
+			reqContentType = r.Header.Get("Content-Type")
+			reqData, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer srv.Close()
+
+		s := NewSet()
+		s.NewCounter(`foo{bar="baz"}`).Set(1234)
+		opts.Format = PushFormatInfluxLine
+		opts.DisableCompression = true
+		if err := s.PushMetrics(context.Background(), srv.URL+path, opts); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if reqMethod != http.MethodPost {
+			t.Fatalf("unexpected method; got %s; want %s", reqMethod, http.MethodPost)
+		}
+		if reqQuery != expectedQuery {
+			t.Fatalf("unexpected query; got %q; want %q", reqQuery, expectedQuery)
+		}
+		if reqContentType != "text/plain; charset=utf-8" {
+			t.Fatalf("unexpected Content-Type: %q", reqContentType)
+		}
+		if !bytes.HasPrefix(reqData, []byte("foo,bar=baz,job=test value=1234 ")) {
+			t.Fatalf("unexpected data: %q", reqData)
+		}
+	}
+
+	f("/api/v2/write", &PushOptions{
+		ExtraLabels:  `job="test"`,
+		InfluxOrg:    "my-org",
+		InfluxBucket: "my-bucket",
+	}, "bucket=my-bucket&org=my-org&precision=ns")
+	f("/write", &PushOptions{
+		ExtraLabels:  `job="test"`,
+		InfluxBucket: "db1",
+	}, "db=db1&precision=n")
+	f("/write?precision=n&db=foo", &PushOptions{
+		ExtraLabels:  `job="test"`,
+		InfluxBucket: "db1",
+	}, "db=foo&precision=n")
+	f("/influx/custom", &PushOptions{
+		ExtraLabels: `job="test"`,
+	}, "")
+}
+
+func TestSetPushgatewayPath(t *testing.T) {
+	f := func(pushURL, job, groupingKey, expectedURL string) {
+		t.Helper()
+		pu, err := url.Parse(pushURL)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", pushURL, err)
+		}
+		if err := setPushgatewayPath(pu, job, groupingKey); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if pu.String() != expectedURL {
+			t.Fatalf("unexpected url; got %q; want %q", pu.String(), expectedURL)
+		}
+	}
+	f("http://pgw:9091", "batch", "", "http://pgw:9091/metrics/job/batch")
+	f("http://pgw:9091/", "batch", `instance="host1"`, "http://pgw:9091/metrics/job/batch/instance/host1")
+	f("http://pgw:9091/prefix", "a/b", `instance="",path="/var/tmp",x="a b"`,
+		"http://pgw:9091/prefix/metrics/job@base64/YS9i/instance@base64/=/path@base64/L3Zhci90bXA/x/a%20b")
+
+	// invalid grouping key
+	pu, _ := url.Parse("http://pgw:9091")
+	if err := setPushgatewayPath(pu, "batch", `instance=host1`); err == nil {
+		t.Fatalf("expecting non-nil error for invalid grouping key")
+	}
+	if err := setPushgatewayPath(pu, "batch", `job="foo"`); err == nil {
+		t.Fatalf("expecting non-nil error for job in grouping key")
+	}
+}
+
+func TestInitPushPushgateway(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	s := NewSet()
+	s.NewCounter("foo").Inc()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if err := s.InitPushWithOptions(ctx, srv.URL, 10*time.Millisecond, &PushOptions{
+		PushgatewayJob:         "batch",
+		PushgatewayGroupingKey: `instance="host1"`,
+		WaitGroup:              &wg,
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(requests)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for push")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests[0] != "PUT /metrics/job/batch/instance/host1" {
+		t.Fatalf("unexpected first request: %q", requests[0])
+	}
+	if last := requests[len(requests)-1]; last != "DELETE /metrics/job/batch/instance/host1" {
+		t.Fatalf("unexpected last request: %q", last)
+	}
+}
+
+func TestPushgatewayInvalidOptions(t *testing.T) {
+	f := func(opts *PushOptions) {
+		t.Helper()
+		if _, err := newPushContext("http://pgw:9091", opts); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	f(&PushOptions{
+		PushgatewayJob: "batch",
+		Method:         http.MethodGet,
+	})
+	f(&PushOptions{
+		PushgatewayJob: "batch",
+		Format:         PushFormatInfluxLine,
+	})
+}
+
+func TestInitPushFlushOnStop(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, r.Method+" "+string(data))
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	s := NewSet()
+	c := s.NewCounter("foo")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	if err := s.InitPushWithOptions(ctx, srv.URL, time.Hour, &PushOptions{
+		PushgatewayJob:     "batch",
+		DisableCompression: true,
+		FlushOnStop:        true,
+		FlushTimeout:       5 * time.Second,
+		WaitGroup:          &wg,
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.Add(42)
+	cancel()
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The group mustn't be deleted when FlushOnStop is set.
+	expectedRequests := []string{"PUT foo 42\n"}
+	if !reflect.DeepEqual(requests, expectedRequests) {
+		t.Fatalf("unexpected requests; got %q; want %q", requests, expectedRequests)
+	}
+}
+
+func TestSplitPushBody(t *testing.T) {
+	f := func(src string, maxSize int, expectedParts []string) {
+		t.Helper()
+		var parts []string
+		for _, part := range splitPushBody([]byte(src), maxSize) {
+			parts = append(parts, string(part))
+		}
+		if !reflect.DeepEqual(parts, expectedParts) {
+			t.Fatalf("unexpected parts; got %q; want %q", parts, expectedParts)
+		}
+	}
+	f("foo 1\nbar 2\n", 100, []string{"foo 1\nbar 2\n"})
+	f("foo 1\nbar 2\nbaz 3\n", 12, []string{"foo 1\nbar 2\n", "baz 3\n"})
+	f("foo 1\nbar 2\nbaz 3", 6, []string{"foo 1\n", "bar 2\n", "baz 3"})
+
+	// histogram family is never split
+	src := `# TYPE foo counter
+foo 1
+# TYPE h histogram
+h_bucket{le="1"} 1
+h_bucket{le="+Inf"} 2
+h_sum 3
+h_count 2
+bar{x="y"} 1
+bar{x="z"} 2
+`
+	f(src, 40, []string{
+		"# TYPE foo counter\nfoo 1\n",
+		"# TYPE h histogram\nh_bucket{le=\"1\"} 1\nh_bucket{le=\"+Inf\"} 2\nh_sum 3\nh_count 2\n",
+		"bar{x=\"y\"} 1\nbar{x=\"z\"} 2\n",
+	})
+	f(src, 1000, []string{src})
+
+	// metadata isn't separated from a plain counter with `_count` suffix
+	src = `# HELP requests_count
+# TYPE requests_count counter
+requests_count 1
+# HELP requests
+# TYPE requests gauge
+requests 2
+`
+	f(src, 50, []string{
+		"# HELP requests_count\n# TYPE requests_count counter\nrequests_count 1\n",
+		"# HELP requests\n# TYPE requests gauge\nrequests 2\n",
+	})
+
+	// InfluxDB line protocol
+	f("foo,a=b value=1 1\nfoo,a=c value=2 1\nbar value=3 1\n", 20, []string{
+		"foo,a=b value=1 1\nfoo,a=c value=2 1\n",
+		"bar value=3 1\n",
+	})
+}
+
+func TestPushMetricsMaxBodySize(t *testing.T) {
+	f := func(opts *PushOptions, expectedRequests []string) {
+		t.Helper()
+		var mu sync.Mutex
+		var requests []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			requests = append(requests, r.Method+" "+string(data))
+			mu.Unlock()
+		}))
+		defer srv.Close()
+
+		s := NewSet()
+		s.NewCounter("aaa").Set(1)
+		s.NewCounter("bbb").Set(2)
+		s.NewCounter("ccc").Set(3)
+
+		opts.DisableCompression = true
+		opts.MaxBodySize = 12
+		if err := s.PushMetrics(context.Background(), srv.URL, opts); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		sort.Strings(requests)
+		if !reflect.DeepEqual(requests, expectedRequests) {
+			t.Fatalf("unexpected requests; got %q; want %q", requests, expectedRequests)
+		}
+	}
+	f(&PushOptions{}, []string{"GET aaa 1\nbbb 2\n", "GET ccc 3\n"})
+	f(&PushOptions{
+		MaxConcurrentRequests: 2,
+	}, []string{"GET aaa 1\nbbb 2\n", "GET ccc 3\n"})
+	f(&PushOptions{
+		PushgatewayJob:        "batch",
+		MaxConcurrentRequests: 2,
+	}, []string{"POST ccc 3\n", "PUT aaa 1\nbbb 2\n"})
+}
+
+func TestPushMetricsCompression(t *testing.T) {
+	f := func(compression PushCompression, expectedContentEncoding string, decode func(data []byte) ([]byte, error)) {
+		t.Helper()
+		var reqContentEncoding string
+		var reqData []byte
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reqContentEncoding = r.Header.Get("Content-Encoding")
+			reqData, _ = io.ReadAll(r.Body)
+		}))
+		defer srv.Close()
+
+		s := NewSet()
+		s.NewCounter(`foo{bar="baz"}`).Set(1234)
+		if err := s.PushMetrics(context.Background(), srv.URL, &PushOptions{
+			Compression: compression,
+		}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if reqContentEncoding != expectedContentEncoding {
+			t.Fatalf("unexpected Content-Encoding; got %q; want %q", reqContentEncoding, expectedContentEncoding)
+		}
+		data, err := decode(reqData)
+		if err != nil {
+			t.Fatalf("cannot decode request body: %s", err)
+		}
+		if string(data) != "foo{bar=\"baz\"} 1234\n" {
+			t.Fatalf("unexpected request body: %q", data)
+		}
+	}
+	f(PushCompressionGzip, "gzip", func(data []byte) ([]byte, error) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(zr)
+	})
+	f(PushCompressionNone, "", func(data []byte) ([]byte, error) {
+		return data, nil
+	})
+	f(PushCompressionSnappy, "snappy", decodeSnappyBlock)
+	f(PushCompressionZstd, "zstd", func(data []byte) ([]byte, error) {
+		// The body is too small for compression, so it is stored in a raw block after 16-byte frame header.
+		if !bytes.HasPrefix(data, []byte("\x28\xb5\x2f\xfd")) {
+			return nil, fmt.Errorf("missing zstd magic number")
+		}
+		return data[16:], nil
+	})
+
+	if _, err := newPushContext("http://localhost:8428", &PushOptions{
+		Compression: 100,
+	}); err == nil {
+		t.Fatalf("expecting non-nil error for unsupported Compression")
+	}
+}
+
+func TestPushScheduleFirstPushTime(t *testing.T) {
+	f := func(ps *pushSchedule, now time.Time, interval time.Duration, expectedMin, expectedMax time.Time) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			tm := ps.getFirstPushTime(now, interval)
+			if tm.Before(expectedMin) || !tm.Before(expectedMax) {
+				t.Fatalf("unexpected first push time %s; want in the range [%s, %s)", tm, expectedMin, expectedMax)
+			}
+		}
+	}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	f(&pushSchedule{}, now, 10*time.Second, now.Add(10*time.Second), now.Add(10*time.Second+1))
+	f(&pushSchedule{alignToInterval: true}, now, 10*time.Second, now.Add(5*time.Second), now.Add(5*time.Second+1))
+	f(&pushSchedule{startJitter: 3 * time.Second}, now, 10*time.Second, now.Add(10*time.Second), now.Add(13*time.Second))
+	f(&pushSchedule{alignToInterval: true, startJitter: time.Second}, now, time.Minute, now.Add(55*time.Second), now.Add(56*time.Second))
+}
+
+func TestInitPushInvalidStartJitter(t *testing.T) {
+	err := InitPushWithOptions(context.Background(), "http://foo", time.Second, false, &PushOptions{
+		StartJitter: -time.Second,
+	})
+	if err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+}
+
+func TestStartPeriodicPushSkipIfBusy(t *testing.T) {
+	s := NewSet()
+	skippedTotal := s.NewCounter("skipped_total")
+	lateTotal := s.NewCounter("late_total")
+	sched := &pushSchedule{
+		skipIfBusy:    true,
+		skippedTotals: []*Counter{skippedTotal},
+		lateTotals:    []*Counter{lateTotal},
+	}
+
+	var pushes uint32
+	releaseCh := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	startPeriodicPush(ctx, 10*time.Millisecond, sched, &wg, func(ctx context.Context) error {
+		atomic.AddUint32(&pushes, 1)
+		<-releaseCh
+		return nil
+	}, nil)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for skippedTotal.Get() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for skipped pushes")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	close(releaseCh)
+	wg.Wait()
+
+	if n := atomic.LoadUint32(&pushes); n != 1 {
+		t.Fatalf("unexpected number of pushes; got %d; want 1", n)
+	}
+	if n := lateTotal.Get(); n != 0 {
+		t.Fatalf("unexpected number of late pushes; got %d; want 0", n)
+	}
+}
+
+func TestStartPeriodicPushLate(t *testing.T) {
+	s := NewSet()
+	skippedTotal := s.NewCounter("skipped_total")
+	lateTotal := s.NewCounter("late_total")
+	sched := &pushSchedule{
+		skippedTotals: []*Counter{skippedTotal},
+		lateTotals:    []*Counter{lateTotal},
+	}
+
+	var pushes uint32
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	startPeriodicPush(ctx, 10*time.Millisecond, sched, &wg, func(ctx context.Context) error {
+		if atomic.AddUint32(&pushes, 1) == 1 {
+			// The first push takes more than the interval.
+			time.Sleep(50 * time.Millisecond)
+		}
+		return nil
+	}, nil)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint32(&pushes) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for pushes")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+
+	if n := lateTotal.Get(); n == 0 {
+		t.Fatalf("expecting non-zero number of late pushes")
+	}
+	if n := skippedTotal.Get(); n != 0 {
+		t.Fatalf("unexpected number of skipped pushes; got %d; want 0", n)
+	}
+}
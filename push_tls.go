@@ -0,0 +1,183 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// newPushTransport returns http.RoundTripper for the given opts.
+//
+// nil is returned if opts do not contain transport-related options, so the default transport must be used.
+func newPushTransport(opts *PushOptions) (http.RoundTripper, error) {
+	hasTLSFiles := opts.TLSCertFile != "" || opts.TLSKeyFile != "" || opts.TLSCAFile != ""
+	if opts.Transport != nil {
+		if opts.TLSConfig != nil || hasTLSFiles {
+			return nil, fmt.Errorf("Transport cannot be set together with TLSConfig, TLSCertFile, TLSKeyFile or TLSCAFile")
+		}
+		return opts.Transport, nil
+	}
+	if opts.TLSConfig == nil && !hasTLSFiles {
+		return nil, nil
+	}
+
+	var cfg *tls.Config
+	if opts.TLSConfig != nil {
+		cfg = opts.TLSConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	if opts.TLSCertFile != "" || opts.TLSKeyFile != "" {
+		if opts.TLSCertFile == "" || opts.TLSKeyFile == "" {
+			return nil, fmt.Errorf("both TLSCertFile and TLSKeyFile must be set")
+		}
+		cl := &tlsCertLoader{
+			certFile: opts.TLSCertFile,
+			keyFile:  opts.TLSKeyFile,
+		}
+		if _, err := cl.getCertificate(); err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cl.getCertificate()
+		}
+	}
+	if opts.TLSCAFile != "" && !cfg.InsecureSkipVerify {
+		cl := &tlsCALoader{
+			caFile: opts.TLSCAFile,
+		}
+		if _, err := cl.getCertPool(); err != nil {
+			return nil, err
+		}
+		// The standard verification cannot use dynamically reloaded root CAs,
+		// so disable it and verify the server certificate in VerifyConnection instead.
+		// VerifyConnection from TLSConfig is called after the successful verification.
+		cfg.InsecureSkipVerify = true
+		verifyConnection := cfg.VerifyConnection
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			chains, err := cl.verifyConnection(cs)
+			if err != nil {
+				return err
+			}
+			if verifyConnection == nil {
+				return nil
+			}
+			cs.VerifiedChains = chains
+			return verifyConnection(cs)
+		}
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = cfg
+	return tr, nil
+}
+
+// fileState holds the state of a file, which is used for detecting file changes.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func getFileState(path string) (fileState, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileState{}, err
+	}
+	return fileState{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+	}, nil
+}
+
+// tlsCertLoader loads client certificate from certFile and keyFile and reloads it when the files are changed.
+type tlsCertLoader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certState fileState
+	keyState  fileState
+}
+
+func (cl *tlsCertLoader) getCertificate() (*tls.Certificate, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	certState, err := getFileState(cl.certFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot access TLSCertFile: %w", err)
+	}
+	keyState, err := getFileState(cl.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot access TLSKeyFile: %w", err)
+	}
+	if cl.cert != nil && certState == cl.certState && keyState == cl.keyState {
+		return cl.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cl.certFile, cl.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load TLS client certificate from TLSCertFile=%q and TLSKeyFile=%q: %w", cl.certFile, cl.keyFile, err)
+	}
+	cl.cert = &cert
+	cl.certState = certState
+	cl.keyState = keyState
+	return cl.cert, nil
+}
+
+// tlsCALoader loads root CAs from caFile and reloads them when the file is changed.
+type tlsCALoader struct {
+	caFile string
+
+	mu      sync.Mutex
+	pool    *x509.CertPool
+	caState fileState
+}
+
+func (cl *tlsCALoader) getCertPool() (*x509.CertPool, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	caState, err := getFileState(cl.caFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot access TLSCAFile: %w", err)
+	}
+	if cl.pool != nil && caState == cl.caState {
+		return cl.pool, nil
+	}
+	data, err := os.ReadFile(cl.caFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read TLSCAFile: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("cannot find PEM-encoded certificates in TLSCAFile=%q", cl.caFile)
+	}
+	cl.pool = pool
+	cl.caState = caState
+	return cl.pool, nil
+}
+
+// verifyConnection verifies the server certificate from cs against root CAs from caFile and returns the verified chains.
+func (cl *tlsCALoader) verifyConnection(cs tls.ConnectionState) ([][]*x509.Certificate, error) {
+	if len(cs.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("missing server certificate")
+	}
+	pool, err := cl.getCertPool()
+	if err != nil {
+		return nil, err
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	return cs.PeerCertificates[0].Verify(opts)
+}
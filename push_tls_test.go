@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPushTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	s := NewSet()
+	s.NewCounter("foo").Inc()
+
+	// The server certificate isn't trusted by default.
+	if err := s.PushMetrics(context.Background(), srv.URL, nil); err == nil {
+		t.Fatalf("expecting non-nil error for untrusted server certificate")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	if err := s.PushMetrics(context.Background(), srv.URL, &PushOptions{
+		TLSConfig: &tls.Config{
+			RootCAs: pool,
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestPushTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	s := NewSet()
+	s.NewCounter("foo").Inc()
+
+	rt := &countingRoundTripper{}
+	if err := s.PushMetrics(context.Background(), srv.URL, &PushOptions{
+		Transport: rt,
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if rt.requests != 1 {
+		t.Fatalf("unexpected number of requests via Transport; got %d; want 1", rt.requests)
+	}
+
+	// Transport cannot be set together with TLS options.
+	if _, err := newPushContext(srv.URL, &PushOptions{
+		Transport: rt,
+		TLSConfig: &tls.Config{},
+	}); err == nil {
+		t.Fatalf("expecting non-nil error")
+	}
+}
+
+type countingRoundTripper struct {
+	requests int
+}
+
+func (rt *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.requests++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestPushTLSFiles(t *testing.T) {
+	var clientCertSubject string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCertSubject = r.TLS.PeerCertificates[0].Subject.CommonName
+	}))
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	// Start with the CA, which didn't issue the server certificate.
+	otherCert, _ := newTestCertificate(t, "other")
+	writeTestFile(t, caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: otherCert}))
+	certPEM, keyPEM := newTestCertificate(t, "client1")
+	writeTestFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certPEM}))
+	writeTestFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyPEM}))
+
+	s := NewSet()
+	s.NewCounter("foo").Inc()
+	pc, err := newPushContext(srv.URL, &PushOptions{
+		TLSCAFile:   caFile,
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := pc.pushMetrics(context.Background(), s.WritePrometheus); err == nil {
+		t.Fatalf("expecting non-nil error for untrusted server certificate")
+	}
+
+	// Replace the CA and the client certificate. They must be reloaded.
+	writeTestFile(t, caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	certPEM, keyPEM = newTestCertificate(t, "client2")
+	writeTestFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certPEM}))
+	writeTestFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyPEM}))
+	if err := pc.pushMetrics(context.Background(), s.WritePrometheus); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if clientCertSubject != "client2" {
+		t.Fatalf("unexpected client certificate subject; got %q; want %q", clientCertSubject, "client2")
+	}
+}
+
+func TestPushTLSCAFileVerifyConnection(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeTestFile(t, caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+
+	s := NewSet()
+	s.NewCounter("foo").Inc()
+	f := func(verifyErr error) {
+		t.Helper()
+		calls := 0
+		err := s.PushMetrics(context.Background(), srv.URL, &PushOptions{
+			TLSConfig: &tls.Config{
+				VerifyConnection: func(cs tls.ConnectionState) error {
+					calls++
+					if len(cs.VerifiedChains) == 0 {
+						t.Errorf("missing verified chains")
+					}
+					return verifyErr
+				},
+			},
+			TLSCAFile: caFile,
+		})
+		if calls == 0 {
+			t.Fatalf("VerifyConnection from TLSConfig must be called")
+		}
+		if verifyErr == nil && err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if verifyErr != nil && err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	f(nil)
+	f(fmt.Errorf("rejected by VerifyConnection"))
+}
+
+func TestPushTLSFilesInvalid(t *testing.T) {
+	f := func(opts *PushOptions) {
+		t.Helper()
+		if _, err := newPushContext("https://localhost:8428", opts); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	f(&PushOptions{
+		TLSCertFile: "cert.pem",
+	})
+	f(&PushOptions{
+		TLSCertFile: "missing-cert.pem",
+		TLSKeyFile:  "missing-key.pem",
+	})
+	f(&PushOptions{
+		TLSCAFile: "missing-ca.pem",
+	})
+}
+
+// newTestCertificate returns DER-encoded self-signed certificate and EC private key for the given commonName.
+func newTestCertificate(t *testing.T, commonName string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName: commonName,
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("cannot marshal key: %s", err)
+	}
+	return cert, keyDER
+}
+
+// writeTestFile writes data to path and moves its modification time forward, so the change is detected
+// even on filesystems with coarse timestamps.
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("cannot write %q: %s", path, err)
+	}
+	if !modTime.IsZero() {
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("cannot update modification time for %q: %s", path, err)
+		}
+	}
+}
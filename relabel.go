@@ -0,0 +1,413 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// RelabelConfig is Prometheus-style relabeling rule for metrics in Prometheus text exposition format.
+//
+// The metric name is available for relabeling in `__name__` label.
+//
+// See https://prometheus.io/docs/prometheus/latest/configuration/configuration/#relabel_config
+type RelabelConfig struct {
+	// Action is the relabeling action. The following actions are supported:
+	//
+	//   - replace - sets TargetLabel to Replacement if Regex matches SourceLabels values joined with Separator.
+	//     The TargetLabel is removed if the Replacement expands to an empty string. This is the default action.
+	//   - keep - drops samples, which do not match Regex.
+	//   - drop - drops samples, which match Regex.
+	//   - labeldrop - removes labels with names matching Regex.
+	//   - labelmap - copies labels with names matching Regex to labels with names obtained by expanding Replacement.
+	Action string
+
+	// SourceLabels is the list of labels, which values are joined with Separator and matched against Regex.
+	//
+	// SourceLabels are used by replace, keep and drop actions.
+	SourceLabels []string
+
+	// Separator is the separator for SourceLabels values. By default it is `;`.
+	Separator string
+
+	// Regex is the regular expression for matching. It is anchored on both ends. By default it is `(.*)`.
+	Regex string
+
+	// TargetLabel is the label to set by replace action. Use `__name__` for changing the metric name.
+	TargetLabel string
+
+	// Replacement is the replacement for replace and labelmap actions. It may refer to Regex capture groups
+	// such as `$1` or `${name}`. By default it is `$1`.
+	Replacement string
+}
+
+// RelabelConfigs is a compiled list of RelabelConfig rules.
+//
+// RelabelConfigs may be passed to WritePrometheusWithRelabeling, Set.WritePrometheusWithRelabeling,
+// PrometheusHandler and PushOptions.RelabelConfigs.
+// It is safe to use RelabelConfigs from concurrent goroutines.
+type RelabelConfigs struct {
+	prcs []*parsedRelabelConfig
+}
+
+type parsedRelabelConfig struct {
+	action       string
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+}
+
+// NewRelabelConfigs returns RelabelConfigs for the given configs.
+//
+// The configs are applied in the given order. An error is returned if some of the configs are invalid.
+func NewRelabelConfigs(configs []RelabelConfig) (*RelabelConfigs, error) {
+	var rcs RelabelConfigs
+	for i := range configs {
+		prc, err := parseRelabelConfig(&configs[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid relabel config #%d: %w", i+1, err)
+		}
+		rcs.prcs = append(rcs.prcs, prc)
+	}
+	return &rcs, nil
+}
+
+// MustNewRelabelConfigs returns RelabelConfigs for the given configs.
+//
+// It panics if some of the configs are invalid. See NewRelabelConfigs.
+func MustNewRelabelConfigs(configs []RelabelConfig) *RelabelConfigs {
+	rcs, err := NewRelabelConfigs(configs)
+	if err != nil {
+		panic(err)
+	}
+	return rcs
+}
+
+func parseRelabelConfig(rc *RelabelConfig) (*parsedRelabelConfig, error) {
+	prc := &parsedRelabelConfig{
+		action:       rc.Action,
+		sourceLabels: rc.SourceLabels,
+		separator:    rc.Separator,
+		targetLabel:  rc.TargetLabel,
+		replacement:  rc.Replacement,
+	}
+	if prc.action == "" {
+		prc.action = "replace"
+	}
+	if prc.separator == "" {
+		prc.separator = ";"
+	}
+	if prc.replacement == "" {
+		prc.replacement = "$1"
+	}
+	regex := rc.Regex
+	if regex == "" {
+		regex = "(.*)"
+	}
+	re, err := regexp.Compile("^(?:" + regex + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse regex %q: %w", regex, err)
+	}
+	prc.regex = re
+	for _, label := range prc.sourceLabels {
+		if err := validateIdent(label); err != nil {
+			return nil, fmt.Errorf("invalid source label: %w", err)
+		}
+	}
+	switch prc.action {
+	case "replace":
+		if err := validateIdent(prc.targetLabel); err != nil {
+			return nil, fmt.Errorf("invalid target label for replace action: %w", err)
+		}
+	case "keep", "drop":
+		if len(prc.sourceLabels) == 0 {
+			return nil, fmt.Errorf("missing source labels for %s action", prc.action)
+		}
+	case "labeldrop", "labelmap":
+	default:
+		return nil, fmt.Errorf("unsupported action %q; supported actions: replace, keep, drop, labeldrop, labelmap", prc.action)
+	}
+	return prc, nil
+}
+
+// apply applies rcs to labels, which must contain `__name__` label, and returns the result.
+//
+// nil is returned if the sample must be dropped.
+func (rcs *RelabelConfigs) apply(labels []Label) []Label {
+	for _, prc := range rcs.prcs {
+		labels = prc.apply(labels)
+		if labels == nil {
+			return nil
+		}
+	}
+	return labels
+}
+
+func (prc *parsedRelabelConfig) apply(labels []Label) []Label {
+	switch prc.action {
+	case "replace":
+		value := prc.getSourceValue(labels)
+		match := prc.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return labels
+		}
+		result := string(prc.regex.ExpandString(nil, prc.replacement, value, match))
+		return setLabel(labels, prc.targetLabel, result)
+	case "keep":
+		if !prc.regex.MatchString(prc.getSourceValue(labels)) {
+			return nil
+		}
+		return labels
+	case "drop":
+		if prc.regex.MatchString(prc.getSourceValue(labels)) {
+			return nil
+		}
+		return labels
+	case "labeldrop":
+		dst := labels[:0]
+		for _, label := range labels {
+			if label.Name == "__name__" || !prc.regex.MatchString(label.Name) {
+				dst = append(dst, label)
+			}
+		}
+		return dst
+	case "labelmap":
+		var mapped []Label
+		for _, label := range labels {
+			match := prc.regex.FindStringSubmatchIndex(label.Name)
+			if match == nil {
+				continue
+			}
+			name := string(prc.regex.ExpandString(nil, prc.replacement, label.Name, match))
+			if name == "__name__" || validateIdent(name) != nil {
+				continue
+			}
+			mapped = append(mapped, Label{
+				Name:  name,
+				Value: label.Value,
+			})
+		}
+		for _, label := range mapped {
+			labels = setLabel(labels, label.Name, label.Value)
+		}
+		return labels
+	default:
+		panic(fmt.Errorf("BUG: unexpected action %q", prc.action))
+	}
+}
+
+func (prc *parsedRelabelConfig) getSourceValue(labels []Label) string {
+	values := make([]string, len(prc.sourceLabels))
+	for i, name := range prc.sourceLabels {
+		values[i] = getLabelValue(labels, name)
+	}
+	return strings.Join(values, prc.separator)
+}
+
+func getLabelValue(labels []Label, name string) string {
+	for _, label := range labels {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+// setLabel sets the label with the given name to value. The label is removed if value is empty.
+func setLabel(labels []Label, name, value string) []Label {
+	for i, label := range labels {
+		if label.Name != name {
+			continue
+		}
+		if value == "" {
+			return append(labels[:i], labels[i+1:]...)
+		}
+		labels[i].Value = value
+		return labels
+	}
+	if value == "" {
+		return labels
+	}
+	return append(labels, Label{
+		Name:  name,
+		Value: value,
+	})
+}
+
+// WritePrometheusWithRelabeling writes metrics in Prometheus format to w like WritePrometheus does,
+// after applying rcs to them.
+func WritePrometheusWithRelabeling(w io.Writer, exposeProcessMetrics bool, rcs *RelabelConfigs) {
+	writeRelabeled(w, rcs, func(w io.Writer) {
+		WritePrometheus(w, exposeProcessMetrics)
+	})
+}
+
+// WritePrometheusWithRelabeling writes all the metrics from s to w in Prometheus format after applying rcs to them.
+func (s *Set) WritePrometheusWithRelabeling(w io.Writer, rcs *RelabelConfigs) {
+	writeRelabeled(w, rcs, s.WritePrometheus)
+}
+
+func writeRelabeled(w io.Writer, rcs *RelabelConfigs, writeMetrics func(w io.Writer)) {
+	if rcs == nil {
+		writeMetrics(w)
+		return
+	}
+	bb := getBytesBuffer()
+	defer putBytesBuffer(bb)
+
+	writeMetrics(bb)
+	dst := getBytesBuffer()
+	defer putBytesBuffer(dst)
+
+	dst.B = relabelLines(dst.B[:0], bb.B, rcs)
+	w.Write(dst.B)
+}
+
+// relabelLines applies rcs to metrics in Prometheus text exposition format from src and appends the result to dst.
+//
+// Comment lines are copied before the first remaining sample of the metric family and are dropped
+// if all the samples for the family are dropped. Metric family names in `# HELP` and `# TYPE` lines
+// are renamed together with the first remaining sample.
+func relabelLines(dst, src []byte, rcs *RelabelConfigs) []byte {
+	var comments [][]byte
+	commentsFamily := ""
+	prevIsComment := false
+	for len(src) > 0 {
+		var line []byte
+		n := bytes.IndexByte(src, '\n')
+		if n >= 0 {
+			line = src[:n]
+			src = src[n+1:]
+		} else {
+			line = src
+			src = nil
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			// Skip empy lines
+			continue
+		}
+		if bytes.HasPrefix(line, bashBytes) {
+			if !prevIsComment {
+				// Comments for the previous family without remaining samples.
+				comments = comments[:0]
+				commentsFamily = ""
+			}
+			prevIsComment = true
+			comments = append(comments, line)
+			if family := getCommentFamily(line); family != "" {
+				commentsFamily = family
+			}
+			continue
+		}
+		prevIsComment = false
+
+		name, labels, tail, err := parseSampleLineWithTail(string(line))
+		if err != nil {
+			log.Printf("ERROR: metrics: cannot apply relabeling: %s", err)
+			continue
+		}
+		labels = append([]Label{{Name: "__name__", Value: name}}, labels...)
+		labels = rcs.apply(labels)
+		if labels == nil {
+			continue
+		}
+		newName := getLabelValue(labels, "__name__")
+		if err := validateIdent(newName); err != nil {
+			log.Printf("ERROR: metrics: invalid metric name after relabeling %q: %s", line, err)
+			continue
+		}
+		if len(comments) > 0 {
+			if commentsFamily == "" {
+				// Comments without metadata are copied as is.
+				for _, comment := range comments {
+					dst = append(dst, comment...)
+					dst = append(dst, '\n')
+				}
+			} else if suffix, ok := getFamilySuffix(name, commentsFamily); ok {
+				newFamily := strings.TrimSuffix(newName, suffix)
+				for _, comment := range comments {
+					dst = appendRenamedComment(dst, comment, commentsFamily, newFamily)
+				}
+			}
+			comments = comments[:0]
+			commentsFamily = ""
+		}
+		dst = append(dst, marshalMetricName(newName, setLabel(labels, "__name__", ""))...)
+		dst = append(dst, tail...)
+		dst = append(dst, '\n')
+	}
+	return dst
+}
+
+// parseSampleLineWithTail parses sample line in Prometheus text exposition format.
+//
+// It returns the metric name, labels and the tail with the value and optional timestamp.
+func parseSampleLineWithTail(line string) (string, []Label, string, error) {
+	n := strings.IndexAny(line, "{ \t")
+	if n < 0 {
+		return "", nil, "", fmt.Errorf("missing value in %q", line)
+	}
+	name := line[:n]
+	if err := validateIdent(name); err != nil {
+		return "", nil, "", fmt.Errorf("cannot parse %q: %w", line, err)
+	}
+	tail := line[n:]
+	var labels []Label
+	if tail[0] == '{' {
+		var err error
+		labels, tail, err = parseLabels(tail[1:])
+		if err != nil {
+			return "", nil, "", fmt.Errorf("cannot parse labels in %q: %w", line, err)
+		}
+	}
+	return name, labels, " " + strings.TrimSpace(tail), nil
+}
+
+// getCommentFamily returns metric family name from `# HELP` or `# TYPE` comment line.
+func getCommentFamily(line []byte) string {
+	fields := strings.Fields(string(line))
+	if len(fields) < 3 || fields[0] != "#" || (fields[1] != "HELP" && fields[1] != "TYPE") {
+		return ""
+	}
+	return fields[2]
+}
+
+// getFamilySuffix returns the suffix of the metric name for the given family.
+//
+// false is returned if name doesn't belong to family.
+func getFamilySuffix(name, family string) (string, bool) {
+	if family == "" || !strings.HasPrefix(name, family) {
+		return "", false
+	}
+	suffix := name[len(family):]
+	switch suffix {
+	case "", "_bucket", "_sum", "_count":
+		return suffix, true
+	default:
+		return "", false
+	}
+}
+
+// appendRenamedComment appends comment to dst after renaming family in `# HELP` and `# TYPE` lines to newFamily.
+func appendRenamedComment(dst, comment []byte, family, newFamily string) []byte {
+	if getCommentFamily(comment) != family || family == newFamily {
+		dst = append(dst, comment...)
+		return append(dst, '\n')
+	}
+	fields := strings.Fields(string(comment))
+	dst = append(dst, "# "...)
+	dst = append(dst, fields[1]...)
+	dst = append(dst, ' ')
+	dst = append(dst, newFamily...)
+	for _, field := range fields[3:] {
+		dst = append(dst, ' ')
+		dst = append(dst, field...)
+	}
+	return append(dst, '\n')
+}
@@ -0,0 +1,239 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRelabelLines(t *testing.T) {
+	f := func(configs []RelabelConfig, src, expectedResult string) {
+		t.Helper()
+		rcs, err := NewRelabelConfigs(configs)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		result := relabelLines(nil, []byte(src), rcs)
+		if string(result) != expectedResult {
+			t.Fatalf("unexpected result; got\n%s\nwant\n%s", result, expectedResult)
+		}
+	}
+
+	// no configs
+	f(nil, `foo{a="b"} 1
+bar 2 123
+`, `foo{a="b"} 1
+bar 2 123
+`)
+
+	// drop by name together with metadata
+	f([]RelabelConfig{
+		{
+			Action:       "drop",
+			SourceLabels: []string{"__name__"},
+			Regex:        "go_memstats_.+",
+		},
+	}, `# HELP go_memstats_alloc_bytes
+# TYPE go_memstats_alloc_bytes gauge
+go_memstats_alloc_bytes 123
+# HELP foo
+# TYPE foo counter
+foo 1
+`, `# HELP foo
+# TYPE foo counter
+foo 1
+`)
+
+	// keep by label value
+	f([]RelabelConfig{
+		{
+			Action:       "keep",
+			SourceLabels: []string{"__name__", "path"},
+			Separator:    ":",
+			Regex:        "requests_total:/api/.*",
+		},
+	}, `requests_total{path="/api/foo"} 1
+requests_total{path="/bar"} 2
+requests_total 3
+`, `requests_total{path="/api/foo"} 1
+`)
+
+	// rename histogram family
+	f([]RelabelConfig{
+		{
+			SourceLabels: []string{"__name__"},
+			Regex:        "request_duration_(.+)",
+			TargetLabel:  "__name__",
+			Replacement:  "http_request_duration_$1",
+		},
+	}, `# HELP request_duration_seconds
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="1"} 1
+request_duration_seconds_bucket{le="+Inf"} 2
+request_duration_seconds_sum 3
+request_duration_seconds_count 2
+`, `# HELP http_request_duration_seconds
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{le="1"} 1
+http_request_duration_seconds_bucket{le="+Inf"} 2
+http_request_duration_seconds_sum 3
+http_request_duration_seconds_count 2
+`)
+
+	// replace label
+	f([]RelabelConfig{
+		{
+			SourceLabels: []string{"instance"},
+			Regex:        "([^:]+):.+",
+			TargetLabel:  "host",
+		},
+		{
+			SourceLabels: []string{"missing"},
+			TargetLabel:  "instance",
+		},
+	}, `foo{instance="host1:8080",job="x"} 1
+bar{job="y"} 2
+`, `foo{job="x",host="host1"} 1
+bar{job="y"} 2
+`)
+
+	// labeldrop and labelmap
+	f([]RelabelConfig{
+		{
+			Action: "labelmap",
+			Regex:  "__meta_(.+)",
+		},
+		{
+			Action: "labeldrop",
+			Regex:  "__meta_.+|tmp",
+		},
+	}, `foo{__meta_zone="a",tmp="1",x="y"} 1 123
+`, `foo{x="y",zone="a"} 1 123
+`)
+
+	// comments without metadata are preserved
+	f([]RelabelConfig{
+		{
+			Action:       "drop",
+			SourceLabels: []string{"__name__"},
+			Regex:        "bar",
+		},
+	}, `# some comment
+foo 1
+bar 2
+`, `# some comment
+foo 1
+`)
+}
+
+func TestNewRelabelConfigsFailure(t *testing.T) {
+	f := func(rc RelabelConfig) {
+		t.Helper()
+		if _, err := NewRelabelConfigs([]RelabelConfig{rc}); err == nil {
+			t.Fatalf("expecting non-nil error for %#v", rc)
+		}
+	}
+	f(RelabelConfig{Action: "unknown"})
+	f(RelabelConfig{Regex: "(", TargetLabel: "foo"})
+	f(RelabelConfig{Action: "replace"})
+	f(RelabelConfig{TargetLabel: "foo-bar"})
+	f(RelabelConfig{Action: "keep"})
+	f(RelabelConfig{Action: "drop", SourceLabels: []string{"a b"}})
+}
+
+func TestSetWritePrometheusWithRelabeling(t *testing.T) {
+	s := NewSet()
+	s.NewCounter(`foo_total{path="/a"}`).Set(1)
+	s.NewCounter(`bar_total`).Set(2)
+	rcs := MustNewRelabelConfigs([]RelabelConfig{
+		{
+			Action:       "drop",
+			SourceLabels: []string{"__name__"},
+			Regex:        "bar_.+",
+		},
+		{
+			SourceLabels: []string{"path"},
+			TargetLabel:  "handler",
+		},
+	})
+	var bb bytes.Buffer
+	s.WritePrometheusWithRelabeling(&bb, rcs)
+	expected := `foo_total{path="/a",handler="/a"} 1` + "\n"
+	if bb.String() != expected {
+		t.Fatalf("unexpected output; got\n%s\nwant\n%s", bb.String(), expected)
+	}
+
+	bb.Reset()
+	s.WritePrometheusWithRelabeling(&bb, nil)
+	expected = "bar_total 2\n" + `foo_total{path="/a"} 1` + "\n"
+	if bb.String() != expected {
+		t.Fatalf("unexpected output; got\n%s\nwant\n%s", bb.String(), expected)
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	name := "relabel_handler_test_total"
+	c := NewCounter(name)
+	defer UnregisterMetric(name)
+	c.Set(5)
+
+	rcs := MustNewRelabelConfigs([]RelabelConfig{
+		{
+			Action:       "keep",
+			SourceLabels: []string{"__name__"},
+			Regex:        name,
+		},
+	})
+	srv := httptest.NewServer(PrometheusHandler(true, rcs))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("unexpected Content-Type: %q", resp.Header.Get("Content-Type"))
+	}
+	if string(data) != name+" 5\n" {
+		t.Fatalf("unexpected response: %q", data)
+	}
+}
+
+func TestPushMetricsRelabeling(t *testing.T) {
+	var reqData []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqData, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	s := NewSet()
+	s.NewCounter(`foo{bar="baz"}`).Set(1234)
+	s.NewCounter(`noisy`).Set(1)
+	if err := s.PushMetrics(context.Background(), srv.URL, &PushOptions{
+		ExtraLabels: `instance="x"`,
+		RelabelConfigs: MustNewRelabelConfigs([]RelabelConfig{
+			{
+				Action:       "drop",
+				SourceLabels: []string{"__name__"},
+				Regex:        "noisy",
+			},
+			{
+				Action: "labeldrop",
+				Regex:  "bar",
+			},
+		}),
+		DisableCompression: true,
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `foo{instance="x"} 1234` + "\n"
+	if string(reqData) != expected {
+		t.Fatalf("unexpected request body; got %q; want %q", reqData, expected)
+	}
+}
@@ -21,6 +21,7 @@ type Set struct {
 	summaries []*Summary
 
 	metricsWriters []func(w io.Writer)
+	collectors     []func(dst []Sample) []Sample
 }
 
 // NewSet creates new set of metrics.
@@ -36,17 +37,8 @@ func NewSet() *Set {
 func (s *Set) WritePrometheus(w io.Writer) {
 	// Collect all the metrics in in-memory buffer in order to prevent from long locking due to slow w.
 	var bb bytes.Buffer
-	lessFunc := func(i, j int) bool {
-		return s.a[i].name < s.a[j].name
-	}
+	sa := s.getSortedMetrics()
 	s.mu.Lock()
-	for _, sm := range s.summaries {
-		sm.updateQuantiles()
-	}
-	if !sort.SliceIsSorted(s.a, lessFunc) {
-		sort.Slice(s.a, lessFunc)
-	}
-	sa := append([]*namedMetric(nil), s.a...)
 	metricsWriters := s.metricsWriters
 	s.mu.Unlock()
 
@@ -486,6 +478,61 @@ func (s *Set) GetOrCreateSummaryExt(name string, window time.Duration, quantiles
 	return sm
 }
 
+// RegisterMetric registers user-defined metric m with the given name in s.
+//
+// name must be valid Prometheus-compatible metric with possible labels.
+// For instance,
+//
+//   - foo
+//   - foo{bar="baz"}
+//   - foo{bar="baz",aaa="b"}
+//
+// m must be safe for concurrent calls.
+func (s *Set) RegisterMetric(name string, m Metric) {
+	cm := newCustomMetric(m)
+	s.registerMetric(name, cm)
+}
+
+// GetOrCreateMetric returns registered user-defined metric with the given name in s
+// or registers the metric returned by newMetric if s doesn't contain metric with the given name.
+//
+// name must be valid Prometheus-compatible metric with possible labels.
+// For instance,
+//
+//   - foo
+//   - foo{bar="baz"}
+//   - foo{bar="baz",aaa="b"}
+//
+// Performance tip: prefer RegisterMetric instead of GetOrCreateMetric.
+func (s *Set) GetOrCreateMetric(name string, newMetric func() Metric) Metric {
+	s.mu.Lock()
+	nm := s.m[name]
+	s.mu.Unlock()
+	if nm == nil {
+		// Slow path - create and register missing metric.
+		if err := validateMetric(name); err != nil {
+			panic(fmt.Errorf("BUG: invalid metric name %q: %s", name, err))
+		}
+		nmNew := &namedMetric{
+			name:   name,
+			metric: newCustomMetric(newMetric()),
+		}
+		s.mu.Lock()
+		nm = s.m[name]
+		if nm == nil {
+			nm = nmNew
+			s.m[name] = nm
+			s.a = append(s.a, nm)
+		}
+		s.mu.Unlock()
+	}
+	cm, ok := nm.metric.(*customMetric)
+	if !ok {
+		panic(fmt.Errorf("BUG: metric %q isn't a user-defined Metric. It is %T", name, nm.metric))
+	}
+	return cm.m
+}
+
 func (s *Set) registerSummaryQuantilesLocked(name string, sm *Summary) {
 	for i, q := range sm.quantiles {
 		quantileValueName := addTag(name, fmt.Sprintf(`quantile="%g"`, q))
@@ -595,7 +642,8 @@ func (s *Set) unregisterMetricLocked(nm *namedMetric) bool {
 
 // UnregisterAllMetrics de-registers all metrics registered in s.
 //
-// It also de-registers writeMetrics callbacks passed to RegisterMetricsWriter.
+// It also de-registers writeMetrics callbacks passed to RegisterMetricsWriter
+// and collect callbacks passed to RegisterCollector.
 func (s *Set) UnregisterAllMetrics() {
 	metricNames := s.ListMetricNames()
 	for _, name := range metricNames {
@@ -604,12 +652,14 @@ func (s *Set) UnregisterAllMetrics() {
 
 	s.mu.Lock()
 	s.metricsWriters = nil
+	s.collectors = nil
 	s.mu.Unlock()
 }
 
 // ListMetricNames returns sorted list of all the metrics in s.
 //
-// The returned list doesn't include metrics generated by metricsWriter passed to RegisterMetricsWriter.
+// The returned list doesn't include metrics generated by metricsWriter passed to RegisterMetricsWriter
+// and samples returned by collect callbacks passed to RegisterCollector.
 func (s *Set) ListMetricNames() []string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -637,3 +687,20 @@ func (s *Set) RegisterMetricsWriter(writeMetrics func(w io.Writer)) {
 
 	s.metricsWriters = append(s.metricsWriters, writeMetrics)
 }
+
+// RegisterCollector registers collect callback for including samples in the output generated by s.WritePrometheus.
+//
+// collect must append the samples to dst and return the result.
+// It is called on every s.WritePrometheus call, so it may return dynamic list of samples.
+// Samples are validated and merged into the sorted output of s.
+// Invalid samples and samples clashing with metrics registered in s are skipped.
+//
+// collect must be safe for concurrent calls.
+//
+// It is OK to register multiple collect callbacks - all of them will be called at s.WritePrometheus.
+func (s *Set) RegisterCollector(collect func(dst []Sample) []Sample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.collectors = append(s.collectors, collect)
+}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// appendSnappyCompressed appends src compressed in snappy block format to dst.
+//
+// See https://github.com/google/snappy/blob/main/format_description.txt
+func appendSnappyCompressed(dst, src []byte) []byte {
+	dst = appendUvarint(dst, uint64(len(src)))
+	se := getSnappyEncoder()
+	for len(src) > 0 {
+		n := len(src)
+		if n > snappyMaxBlockSize {
+			n = snappyMaxBlockSize
+		}
+		dst = se.appendBlock(dst, src[:n])
+		src = src[n:]
+	}
+	putSnappyEncoder(se)
+	return dst
+}
+
+// snappyMaxBlockSize is the maximum size of a block, which is compressed independently.
+//
+// It guarantees that copy offsets fit 2 bytes.
+const snappyMaxBlockSize = 64 * 1024
+
+const (
+	snappyTableBits = 14
+	snappyMinMatch  = 4
+)
+
+type snappyEncoder struct {
+	table [1 << snappyTableBits]int32
+}
+
+func (se *snappyEncoder) appendBlock(dst, src []byte) []byte {
+	if len(src) < snappyMinMatch+1 {
+		return appendSnappyLiteral(dst, src)
+	}
+	for i := range se.table {
+		se.table[i] = -1
+	}
+	litStart := 0
+	i := 0
+	for i+snappyMinMatch <= len(src) {
+		cur := binary.LittleEndian.Uint32(src[i:])
+		h := hashUint32(cur, snappyTableBits)
+		candidate := int(se.table[h])
+		se.table[h] = int32(i)
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != cur {
+			i++
+			continue
+		}
+		matchLen := snappyMinMatch
+		for i+matchLen < len(src) && src[candidate+matchLen] == src[i+matchLen] {
+			matchLen++
+		}
+		dst = appendSnappyLiteral(dst, src[litStart:i])
+		dst = appendSnappyCopy(dst, i-candidate, matchLen)
+		i += matchLen
+		litStart = i
+	}
+	return appendSnappyLiteral(dst, src[litStart:])
+}
+
+func appendSnappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n<<2))
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// appendSnappyCopy appends copy elements with 2-byte offsets to dst.
+func appendSnappyCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+		}
+		dst = append(dst, byte((n-1)<<2|2), byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
+
+// hashUint32 returns hash for v with the given number of bits.
+func hashUint32(v uint32, bits uint) uint32 {
+	return (v * 0x1e35a7bd) >> (32 - bits)
+}
+
+func getSnappyEncoder() *snappyEncoder {
+	v := snappyEncoderPool.Get()
+	if v == nil {
+		return &snappyEncoder{}
+	}
+	return v.(*snappyEncoder)
+}
+
+func putSnappyEncoder(se *snappyEncoder) {
+	snappyEncoderPool.Put(se)
+}
+
+var snappyEncoderPool sync.Pool
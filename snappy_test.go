@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestAppendSnappyCompressed(t *testing.T) {
+	f := func(src []byte) {
+		t.Helper()
+		compressed := appendSnappyCompressed(nil, src)
+		result, err := decodeSnappyBlock(compressed)
+		if err != nil {
+			t.Fatalf("cannot decode compressed data: %s", err)
+		}
+		if !bytes.Equal(result, src) {
+			t.Fatalf("unexpected decoded data; got %d bytes; want %d bytes", len(result), len(src))
+		}
+	}
+	f(nil)
+	f([]byte("a"))
+	f([]byte("foo bar baz"))
+	f([]byte(strings.Repeat(`foo{bar="baz"} 123`+"\n", 10000)))
+
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, 200000)
+	r.Read(data)
+	f(data)
+
+	var sb strings.Builder
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&sb, "metric_%d{label=%q} %d\n", r.Intn(100), strings.Repeat("x", r.Intn(10)), r.Intn(1000))
+	}
+	f([]byte(sb.String()))
+
+	// Verify compression ratio for typical metrics.
+	src := []byte(sb.String())
+	compressed := appendSnappyCompressed(nil, src)
+	if len(compressed) > len(src)/2 {
+		t.Fatalf("too low compression ratio; compressed %d bytes into %d bytes", len(src), len(compressed))
+	}
+}
+
+// decodeSnappyBlock decodes src in snappy block format.
+func decodeSnappyBlock(src []byte) ([]byte, error) {
+	n, m := binary.Uvarint(src)
+	if m <= 0 {
+		return nil, fmt.Errorf("cannot read decoded length")
+	}
+	src = src[m:]
+	dst := make([]byte, 0, n)
+	for len(src) > 0 {
+		tag := src[0]
+		switch tag & 3 {
+		case 0:
+			litLen := int(tag >> 2)
+			src = src[1:]
+			if litLen >= 60 {
+				sizeLen := litLen - 59
+				if len(src) < sizeLen {
+					return nil, fmt.Errorf("too short literal length")
+				}
+				litLen = 0
+				for i := 0; i < sizeLen; i++ {
+					litLen |= int(src[i]) << (8 * i)
+				}
+				src = src[sizeLen:]
+			}
+			litLen++
+			if len(src) < litLen {
+				return nil, fmt.Errorf("too short literal")
+			}
+			dst = append(dst, src[:litLen]...)
+			src = src[litLen:]
+		case 2:
+			if len(src) < 3 {
+				return nil, fmt.Errorf("too short copy")
+			}
+			length := int(tag>>2) + 1
+			offset := int(src[1]) | int(src[2])<<8
+			src = src[3:]
+			if offset == 0 || offset > len(dst) {
+				return nil, fmt.Errorf("invalid offset %d", offset)
+			}
+			for i := 0; i < length; i++ {
+				dst = append(dst, dst[len(dst)-offset])
+			}
+		default:
+			return nil, fmt.Errorf("unexpected tag %d", tag&3)
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, fmt.Errorf("unexpected decoded length; got %d; want %d", len(dst), n)
+	}
+	return dst, nil
+}
@@ -0,0 +1,304 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetricSnapshot is a point-in-time view of a single metric.
+//
+// See Set.Snapshot.
+type MetricSnapshot struct {
+	// Name is the metric name with labels. For example, `foo{bar="baz"}`.
+	Name string
+
+	// Family is the metric name without labels. For example, `foo`.
+	Family string
+
+	// Labels contains labels from Name.
+	Labels []Label
+
+	// Type is the metric type: counter, gauge, histogram, summary or untyped.
+	Type string
+
+	// Value is the metric value for counter, gauge and untyped metrics.
+	Value float64
+
+	// BucketLabel is the label used for exposing histogram buckets in Prometheus text exposition format.
+	//
+	// It is `le` for HistogramStatic and `vmrange` for Histogram.
+	BucketLabel string
+
+	// Buckets contains histogram buckets ordered by their bounds.
+	//
+	// Histogram contains only non-empty buckets, while HistogramStatic contains all the buckets including +Inf.
+	Buckets []BucketSnapshot
+
+	// Quantiles contains quantile values for summary metrics.
+	Quantiles []QuantileSnapshot
+
+	// Sum is the sum of observed values for histogram and summary metrics.
+	Sum float64
+
+	// Count is the number of observed values for histogram and summary metrics.
+	Count uint64
+}
+
+// BucketSnapshot is a histogram bucket in MetricSnapshot.
+type BucketSnapshot struct {
+	// Range is the `le` or `vmrange` label value for the bucket. See MetricSnapshot.BucketLabel.
+	Range string
+
+	// Lower is the lower bound of the bucket. It isn't included in the bucket.
+	Lower float64
+
+	// Upper is the upper bound of the bucket. It is included in the bucket.
+	Upper float64
+
+	// Count is the number of values, which hit the bucket.
+	//
+	// Count isn't cumulative, e.g. it doesn't include values from the previous buckets.
+	Count uint64
+}
+
+// QuantileSnapshot is a summary quantile in MetricSnapshot.
+type QuantileSnapshot struct {
+	// Quantile is the quantile in the range [0..1].
+	Quantile float64
+
+	// Value is the quantile value.
+	Value float64
+}
+
+// Snapshot returns a point-in-time view of metrics from the default set and all the sets registered via RegisterSet.
+//
+// The returned metrics are sorted by set and then by name.
+// Metrics written by callbacks passed to RegisterMetricsWriter aren't included in the snapshot.
+func Snapshot() []MetricSnapshot {
+	var dst []MetricSnapshot
+	for _, s := range getRegisteredSets() {
+		dst = s.appendSnapshot(dst)
+	}
+	return dst
+}
+
+// Snapshot returns a point-in-time view of all the metrics from s sorted by name.
+//
+// Samples returned by collect callbacks passed to RegisterCollector are included in the snapshot,
+// while metrics written by callbacks passed to RegisterMetricsWriter aren't included.
+//
+// Every user-defined metric registered via RegisterMetric is represented by a separate MetricSnapshot
+// per every sample exposed by it. Such snapshots have `untyped` type unless the metric has counter or gauge type.
+func (s *Set) Snapshot() []MetricSnapshot {
+	return s.appendSnapshot(nil)
+}
+
+func (s *Set) appendSnapshot(dst []MetricSnapshot) []MetricSnapshot {
+	for _, nm := range s.getSortedMetrics() {
+		if nm.isAux {
+			// Auxiliary metrics such as summary quantiles are included in the parent metric snapshot.
+			continue
+		}
+		dst = nm.metric.appendSnapshot(dst, nm.name)
+	}
+	return dst
+}
+
+// getSortedMetrics returns sorted list of metrics from s including samples returned by collectors.
+func (s *Set) getSortedMetrics() []*namedMetric {
+	lessFunc := func(i, j int) bool {
+		return s.a[i].name < s.a[j].name
+	}
+	s.mu.Lock()
+	for _, sm := range s.summaries {
+		sm.updateQuantiles()
+	}
+	if !sort.SliceIsSorted(s.a, lessFunc) {
+		sort.Slice(s.a, lessFunc)
+	}
+	sa := append([]*namedMetric(nil), s.a...)
+	collectors := s.collectors
+	s.mu.Unlock()
+
+	if len(collectors) > 0 {
+		// Call collectors without the global lock, since they may call s methods.
+		sa = append(sa, collectSamples(collectors, sa)...)
+		sort.Slice(sa, func(i, j int) bool {
+			return sa[i].name < sa[j].name
+		})
+	}
+	return sa
+}
+
+// newMetricSnapshot returns MetricSnapshot with the given name and metricType.
+//
+// An error is returned if labels cannot be parsed from name. The caller must skip such a metric.
+func newMetricSnapshot(name, metricType string) (MetricSnapshot, error) {
+	family, labels, err := parseMetricName(name)
+	if err != nil {
+		return MetricSnapshot{}, fmt.Errorf("cannot create snapshot for metric %q: %w", name, err)
+	}
+	return MetricSnapshot{
+		Name:   name,
+		Family: family,
+		Labels: labels,
+		Type:   metricType,
+	}, nil
+}
+
+func (c *Counter) appendSnapshot(dst []MetricSnapshot, name string) []MetricSnapshot {
+	ms, err := newMetricSnapshot(name, c.metricType())
+	if err != nil {
+		log.Printf("ERROR: metrics: %s", err)
+		return dst
+	}
+	ms.Value = float64(c.Get())
+	return append(dst, ms)
+}
+
+func (fc *FloatCounter) appendSnapshot(dst []MetricSnapshot, name string) []MetricSnapshot {
+	ms, err := newMetricSnapshot(name, fc.metricType())
+	if err != nil {
+		log.Printf("ERROR: metrics: %s", err)
+		return dst
+	}
+	ms.Value = fc.Get()
+	return append(dst, ms)
+}
+
+func (g *Gauge) appendSnapshot(dst []MetricSnapshot, name string) []MetricSnapshot {
+	ms, err := newMetricSnapshot(name, g.metricType())
+	if err != nil {
+		log.Printf("ERROR: metrics: %s", err)
+		return dst
+	}
+	ms.Value = g.Get()
+	return append(dst, ms)
+}
+
+func (sv *sampleValue) appendSnapshot(dst []MetricSnapshot, name string) []MetricSnapshot {
+	ms, err := newMetricSnapshot(name, sv.metricType())
+	if err != nil {
+		log.Printf("ERROR: metrics: %s", err)
+		return dst
+	}
+	ms.Value = sv.value
+	return append(dst, ms)
+}
+
+func (h *Histogram) appendSnapshot(dst []MetricSnapshot, name string) []MetricSnapshot {
+	ms, err := newMetricSnapshot(name, h.metricType())
+	if err != nil {
+		log.Printf("ERROR: metrics: %s", err)
+		return dst
+	}
+	ms.BucketLabel = "vmrange"
+	h.mu.Lock()
+	h.visitNonZeroBucketsLocked(func(vmrange string, count uint64) {
+		n := strings.Index(vmrange, "...")
+		lower, _ := strconv.ParseFloat(vmrange[:n], 64)
+		upper, _ := strconv.ParseFloat(vmrange[n+len("..."):], 64)
+		ms.Buckets = append(ms.Buckets, BucketSnapshot{
+			Range: vmrange,
+			Lower: lower,
+			Upper: upper,
+			Count: count,
+		})
+		ms.Count += count
+	})
+	ms.Sum = h.sum
+	h.mu.Unlock()
+	return append(dst, ms)
+}
+
+func (h *HistogramStatic) appendSnapshot(dst []MetricSnapshot, name string) []MetricSnapshot {
+	ms, err := newMetricSnapshot(name, h.metricType())
+	if err != nil {
+		log.Printf("ERROR: metrics: %s", err)
+		return dst
+	}
+	ms.BucketLabel = "le"
+	h.mu.Lock()
+	lower := float64(0)
+	for _, b := range h.buckets {
+		ms.Buckets = append(ms.Buckets, BucketSnapshot{
+			Range: fmt.Sprintf("%.3e", b.le),
+			Lower: lower,
+			Upper: b.le,
+			Count: b.count,
+		})
+		ms.Count += b.count
+		lower = b.le
+	}
+	ms.Buckets = append(ms.Buckets, BucketSnapshot{
+		Range: "+Inf",
+		Lower: lower,
+		Upper: math.Inf(1),
+		Count: h.upper,
+	})
+	ms.Count += h.upper
+	ms.Sum = h.sum
+	h.mu.Unlock()
+	return append(dst, ms)
+}
+
+func (sm *Summary) appendSnapshot(dst []MetricSnapshot, name string) []MetricSnapshot {
+	ms, err := newMetricSnapshot(name, sm.metricType())
+	if err != nil {
+		log.Printf("ERROR: metrics: %s", err)
+		return dst
+	}
+	sm.mu.Lock()
+	for i, q := range sm.quantiles {
+		v := sm.quantileValues[i]
+		if math.IsNaN(v) {
+			continue
+		}
+		ms.Quantiles = append(ms.Quantiles, QuantileSnapshot{
+			Quantile: q,
+			Value:    v,
+		})
+	}
+	ms.Sum = sm.sum
+	ms.Count = sm.count
+	sm.mu.Unlock()
+	return append(dst, ms)
+}
+
+func (qv *quantileValue) appendSnapshot(dst []MetricSnapshot, name string) []MetricSnapshot {
+	// Quantile values are included in the parent Summary snapshot.
+	return dst
+}
+
+func (cm *customMetric) appendSnapshot(dst []MetricSnapshot, name string) []MetricSnapshot {
+	metricType := cm.metricType()
+	if metricType != "counter" && metricType != "gauge" {
+		metricType = "untyped"
+	}
+	var bb bytes.Buffer
+	cm.marshalTo(name, &bb)
+	for _, line := range strings.Split(bb.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ps, err := parseSampleLine(line)
+		if err != nil {
+			log.Printf("ERROR: metrics: cannot parse sample exposed by metric %q: %s", name, err)
+			continue
+		}
+		dst = append(dst, MetricSnapshot{
+			Name:   marshalMetricName(ps.name, ps.labels),
+			Family: ps.name,
+			Labels: ps.labels,
+			Type:   metricType,
+			Value:  ps.value,
+		})
+	}
+	return dst
+}
@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetSnapshot(t *testing.T) {
+	s := NewSet()
+	s.NewCounter(`counter_total{a="b"}`).Set(10)
+	s.NewFloatCounter("float_counter_total").Set(1.5)
+	s.NewGauge("gauge", func() float64 { return -2 })
+	h := s.NewHistogram(`histogram{x="y"}`)
+	h.Update(1)
+	h.Update(1)
+	h.Update(0)
+	hs := s.NewHistogramStatic("histogram_static", []float64{1, 5})
+	hs.Update(0.5)
+	hs.Update(3)
+	hs.Update(10)
+	sm := s.NewSummaryExt("summary", time.Minute, []float64{0.5, 1})
+	sm.Update(3)
+	s.RegisterMetric(`state{name="foo"}`, &testStateSet{
+		states: []string{"running", "stopped"},
+		curr:   "stopped",
+	})
+	s.RegisterCollector(func(dst []Sample) []Sample {
+		return append(dst, Sample{
+			Name:   "collected",
+			Labels: []Label{{Name: "pool", Value: "main"}},
+			Type:   "gauge",
+			Value:  7,
+		})
+	})
+
+	result := s.Snapshot()
+	expected := []MetricSnapshot{
+		{
+			Name:   `collected{pool="main"}`,
+			Family: "collected",
+			Labels: []Label{{Name: "pool", Value: "main"}},
+			Type:   "gauge",
+			Value:  7,
+		},
+		{
+			Name:   `counter_total{a="b"}`,
+			Family: "counter_total",
+			Labels: []Label{{Name: "a", Value: "b"}},
+			Type:   "counter",
+			Value:  10,
+		},
+		{
+			Name:   "float_counter_total",
+			Family: "float_counter_total",
+			Type:   "counter",
+			Value:  1.5,
+		},
+		{
+			Name:   "gauge",
+			Family: "gauge",
+			Type:   "gauge",
+			Value:  -2,
+		},
+		{
+			Name:        "histogram_static",
+			Family:      "histogram_static",
+			Type:        "histogram",
+			BucketLabel: "le",
+			Buckets: []BucketSnapshot{
+				{Range: "1.000e+00", Lower: 0, Upper: 1, Count: 1},
+				{Range: "5.000e+00", Lower: 1, Upper: 5, Count: 1},
+				{Range: "+Inf", Lower: 5, Upper: math.Inf(1), Count: 1},
+			},
+			Sum:   13.5,
+			Count: 3,
+		},
+		{
+			Name:        `histogram{x="y"}`,
+			Family:      "histogram",
+			Labels:      []Label{{Name: "x", Value: "y"}},
+			Type:        "histogram",
+			BucketLabel: "vmrange",
+			Buckets: []BucketSnapshot{
+				{Range: "0...1.000e-09", Lower: 0, Upper: 1e-9, Count: 1},
+				{Range: "8.799e-01...1.000e+00", Lower: 0.8799, Upper: 1, Count: 2},
+			},
+			Sum:   2,
+			Count: 3,
+		},
+		{
+			Name:   `state{name="foo",state="running"}`,
+			Family: "state",
+			Labels: []Label{{Name: "name", Value: "foo"}, {Name: "state", Value: "running"}},
+			Type:   "gauge",
+			Value:  0,
+		},
+		{
+			Name:   `state{name="foo",state="stopped"}`,
+			Family: "state",
+			Labels: []Label{{Name: "name", Value: "foo"}, {Name: "state", Value: "stopped"}},
+			Type:   "gauge",
+			Value:  1,
+		},
+		{
+			Name:   "summary",
+			Family: "summary",
+			Type:   "summary",
+			Quantiles: []QuantileSnapshot{
+				{Quantile: 0.5, Value: 3},
+				{Quantile: 1, Value: 3},
+			},
+			Sum:   3,
+			Count: 1,
+		},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("unexpected snapshot;\ngot\n%+v\nwant\n%+v", result, expected)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s := NewSet()
+	s.NewCounter("snapshot_registered_set_total").Inc()
+	RegisterSet(s)
+	defer UnregisterSet(s, true)
+
+	found := false
+	for _, ms := range Snapshot() {
+		if ms.Name == "snapshot_registered_set_total" {
+			found = true
+			if ms.Value != 1 {
+				t.Fatalf("unexpected value; got %v; want 1", ms.Value)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("missing metric from the registered set in Snapshot")
+	}
+}
+
+func TestSetSnapshotUnknownEscape(t *testing.T) {
+	s := NewSet()
+	s.NewCounter(`foo{bar="a\z",baz="b\"c\\d\ne"}`).Inc()
+
+	a := s.Snapshot()
+	if len(a) != 1 {
+		t.Fatalf("unexpected number of snapshots; got %d; want 1", len(a))
+	}
+	ms := a[0]
+	if ms.Family != "foo" || ms.Value != 1 {
+		t.Fatalf("unexpected snapshot: %+v", ms)
+	}
+	expected := []Label{{Name: "bar", Value: `a\z`}, {Name: "baz", Value: "b\"c\\d\ne"}}
+	if fmt.Sprintf("%q", ms.Labels) != fmt.Sprintf("%q", expected) {
+		t.Fatalf("unexpected labels; got %q; want %q", ms.Labels, expected)
+	}
+
+	var bb bytes.Buffer
+	s.WriteJSON(&bb)
+	if !strings.Contains(bb.String(), `"bar":"a\\z"`) {
+		t.Fatalf("missing label in JSON output: %s", bb.String())
+	}
+}
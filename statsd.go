@@ -0,0 +1,351 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsdOptions is the list of options, which may be applied to InitStatsdWithOptions().
+type StatsdOptions struct {
+	// Prefix is an optional prefix to add to all the metric names. For example, `myapp.`.
+	Prefix string
+
+	// Tags is an optional list of `key:value` tags to add to all the metrics.
+	Tags []string
+
+	// DisableTags disables DogStatsD tags. Metric labels are appended to metric names as `.<label_name>.<label_value>` instead.
+	//
+	// This may be needed for plain StatsD servers, which do not support DogStatsD tags.
+	DisableTags bool
+
+	// MaxPacketSize is the maximum size of UDP datagram with metrics.
+	//
+	// By default the MaxPacketSize is 1432 bytes, which fits Ethernet MTU.
+	MaxPacketSize int
+
+	// Optional WaitGroup for waiting until all the push workers created with this WaitGroup are stopped.
+	WaitGroup *sync.WaitGroup
+}
+
+// InitStatsdWithOptions sets up periodic push for globally registered metrics to StatsD server at the given UDP addr with the given interval.
+//
+// See Set.InitStatsdWithOptions for details.
+func InitStatsdWithOptions(ctx context.Context, addr string, interval time.Duration, opts *StatsdOptions) error {
+	return initStatsd(ctx, addr, interval, Snapshot, opts)
+}
+
+// InitStatsdWithOptions sets up periodic push for metrics from s to StatsD server at the given UDP addr with the given interval.
+//
+// Metrics are sent in DogStatsD format with tags derived from metric labels.
+// See https://docs.datadoghq.com/developers/dogstatsd/datagram_shell/
+//
+// Counters are sent as deltas since the previous push with `c` type. Gauges are sent with `g` type.
+// Histogram buckets are sent as `h` samples for bucket upper bounds with the sample rate derived from the bucket count delta.
+// Summary quantiles are sent as gauges with `quantile` tag, while summary sum and count are sent as counters.
+//
+// Metrics are batched into UDP datagrams of up to opts.MaxPacketSize bytes.
+//
+// The periodic push is stopped when ctx is canceled.
+// It is possible to wait until the background metrics push worker is stopped on a WaitGroup passed via opts.WaitGroup.
+//
+// opts may contain additional configuration options if non-nil.
+func (s *Set) InitStatsdWithOptions(ctx context.Context, addr string, interval time.Duration, opts *StatsdOptions) error {
+	return initStatsd(ctx, addr, interval, s.Snapshot, opts)
+}
+
+func initStatsd(ctx context.Context, addr string, interval time.Duration, snapshot func() []MetricSnapshot, opts *StatsdOptions) error {
+	// validate interval before creating statsdContext, since it opens UDP connection
+	if interval <= 0 {
+		return fmt.Errorf("interval must be positive; got %s", interval)
+	}
+
+	sc, err := newStatsdContext(addr, opts)
+	if err != nil {
+		return err
+	}
+	pushMetricsSet.GetOrCreateFloatCounter(fmt.Sprintf(`metrics_push_interval_seconds{url=%q}`, sc.pushURL)).Set(interval.Seconds())
+
+	var wg *sync.WaitGroup
+	if opts != nil {
+		wg = opts.WaitGroup
+	}
+	startPeriodicPush(ctx, interval, nil, wg, func(ctx context.Context) error {
+		return sc.pushMetrics(snapshot())
+	}, sc.close)
+
+	return nil
+}
+
+type statsdContext struct {
+	pushURL       string
+	prefix        string
+	tags          []string
+	disableTags   bool
+	maxPacketSize int
+
+	conn net.Conn
+
+	// mu protects prevValues
+	mu sync.Mutex
+
+	// prevValues contains values for counters and histogram buckets seen at the previous push.
+	prevValues map[string]float64
+
+	pushesTotal      *Counter
+	bytesPushedTotal *Counter
+	pushErrors       *Counter
+}
+
+func newStatsdContext(addr string, opts *StatsdOptions) (*statsdContext, error) {
+	if opts == nil {
+		opts = &StatsdOptions{}
+	}
+
+	// validate addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid StatsD addr=%q; expecting `host:port`: %w", addr, err)
+	}
+
+	// validate Tags
+	for _, tag := range opts.Tags {
+		if strings.ContainsAny(tag, ",|#\n") {
+			return nil, fmt.Errorf("invalid tag %q; it mustn't contain `,`, `|`, `#` and newline chars", tag)
+		}
+	}
+
+	maxPacketSize := opts.MaxPacketSize
+	if maxPacketSize <= 0 {
+		maxPacketSize = 1432
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot initialize UDP connection to %q: %w", addr, err)
+	}
+
+	pushURL := "udp://" + addr
+	return &statsdContext{
+		pushURL:       pushURL,
+		prefix:        opts.Prefix,
+		tags:          append([]string{}, opts.Tags...),
+		disableTags:   opts.DisableTags,
+		maxPacketSize: maxPacketSize,
+
+		conn:       conn,
+		prevValues: make(map[string]float64),
+
+		pushesTotal:      pushMetricsSet.GetOrCreateCounter(fmt.Sprintf(`metrics_push_total{url=%q}`, pushURL)),
+		bytesPushedTotal: pushMetricsSet.GetOrCreateCounter(fmt.Sprintf(`metrics_push_bytes_pushed_total{url=%q}`, pushURL)),
+		pushErrors:       pushMetricsSet.GetOrCreateCounter(fmt.Sprintf(`metrics_push_errors_total{url=%q}`, pushURL)),
+	}, nil
+}
+
+func (sc *statsdContext) pushMetrics(mss []MetricSnapshot) error {
+	bb := getBytesBuffer()
+	defer putBytesBuffer(bb)
+
+	sc.pushesTotal.Inc()
+	var firstErr error
+	flush := func() {
+		if len(bb.B) == 0 {
+			return
+		}
+		sc.bytesPushedTotal.Add(len(bb.B))
+		if _, err := sc.conn.Write(bb.B); err != nil {
+			sc.pushErrors.Inc()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("cannot send metrics to %q: %w", sc.pushURL, err)
+			}
+		}
+		bb.B = bb.B[:0]
+	}
+
+	sc.mu.Lock()
+	sc.writeLines(mss, func(line []byte) {
+		if len(bb.B) > 0 && len(bb.B)+1+len(line) > sc.maxPacketSize {
+			flush()
+		}
+		if len(bb.B) > 0 {
+			bb.B = append(bb.B, '\n')
+		}
+		bb.B = append(bb.B, line...)
+	})
+	sc.mu.Unlock()
+	flush()
+
+	return firstErr
+}
+
+// writeLines calls writeLine for every StatsD line generated from mss.
+//
+// It updates sc.prevValues, so it must be called under sc.mu lock.
+func (sc *statsdContext) writeLines(mss []MetricSnapshot, writeLine func(line []byte)) {
+	var dst []byte
+	prevValues := sc.prevValues
+	currValues := make(map[string]float64, len(prevValues))
+	counterDelta := func(key string, v float64) float64 {
+		currValues[key] = v
+		prev := prevValues[key]
+		if v < prev {
+			// The counter has been reset.
+			return v
+		}
+		return v - prev
+	}
+
+	for i := range mss {
+		ms := &mss[i]
+		switch ms.Type {
+		case "counter":
+			d := counterDelta(ms.Name, ms.Value)
+			if d == 0 {
+				continue
+			}
+			dst = sc.appendLine(dst[:0], ms.Family, ms.Labels, "", "", d, "c", 1)
+			writeLine(dst)
+		case "histogram":
+			for _, b := range ms.Buckets {
+				d := counterDelta(ms.Name+" "+b.Range, float64(b.Count))
+				if d == 0 {
+					continue
+				}
+				v := b.Upper
+				if math.IsInf(v, 1) {
+					v = b.Lower
+				}
+				dst = sc.appendLine(dst[:0], ms.Family, ms.Labels, "", "", v, "h", d)
+				writeLine(dst)
+			}
+		case "summary":
+			for _, q := range ms.Quantiles {
+				dst = sc.appendLine(dst[:0], ms.Family, ms.Labels, "quantile", strconv.FormatFloat(q.Quantile, 'g', -1, 64), q.Value, "g", 1)
+				writeLine(dst)
+			}
+			if d := counterDelta(ms.Name+" sum", ms.Sum); d != 0 {
+				dst = sc.appendLine(dst[:0], ms.Family+"_sum", ms.Labels, "", "", d, "c", 1)
+				writeLine(dst)
+			}
+			if d := counterDelta(ms.Name+" count", float64(ms.Count)); d != 0 {
+				dst = sc.appendLine(dst[:0], ms.Family+"_count", ms.Labels, "", "", d, "c", 1)
+				writeLine(dst)
+			}
+		default:
+			if math.IsNaN(ms.Value) || math.IsInf(ms.Value, 0) {
+				continue
+			}
+			dst = sc.appendLine(dst[:0], ms.Family, ms.Labels, "", "", ms.Value, "g", 1)
+			writeLine(dst)
+		}
+	}
+	sc.prevValues = currValues
+}
+
+// appendLine appends StatsD line for the given metric to dst.
+//
+// The optional extraLabelName with extraLabelValue is added to labels.
+// The sample rate is set to 1/count if count is bigger than 1.
+func (sc *statsdContext) appendLine(dst []byte, name string, labels []Label, extraLabelName, extraLabelValue string, v float64, typ string, count float64) []byte {
+	if typ == "g" {
+		if v == 0 {
+			// Convert -0 to 0, since the leading sign has special meaning for gauges.
+			v = 0
+		} else if v < 0 {
+			// StatsD treats gauge values with the leading sign as relative changes,
+			// so the gauge must be set to 0 before setting it to negative value.
+			// Both lines are appended to dst, so they are sent in the same packet in the right order.
+			// See https://github.com/statsd/statsd/blob/master/docs/metric_types.md#gauges
+			dst = sc.appendLine(dst, name, labels, extraLabelName, extraLabelValue, 0, typ, count)
+			dst = append(dst, '\n')
+		}
+	}
+	dst = append(dst, sc.prefix...)
+	dst = appendStatsdName(dst, name)
+	if sc.disableTags {
+		for _, label := range labels {
+			dst = appendStatsdPathNode(dst, label.Name, label.Value)
+		}
+		if extraLabelName != "" {
+			dst = appendStatsdPathNode(dst, extraLabelName, extraLabelValue)
+		}
+	}
+	dst = append(dst, ':')
+	dst = strconv.AppendFloat(dst, v, 'g', -1, 64)
+	dst = append(dst, '|')
+	dst = append(dst, typ...)
+	if count > 1 {
+		dst = append(dst, "|@"...)
+		dst = strconv.AppendFloat(dst, 1/count, 'g', -1, 64)
+	}
+	if sc.disableTags {
+		return dst
+	}
+	n := 0
+	addTag := func() {
+		if n == 0 {
+			dst = append(dst, "|#"...)
+		} else {
+			dst = append(dst, ',')
+		}
+		n++
+	}
+	for _, tag := range sc.tags {
+		addTag()
+		dst = append(dst, tag...)
+	}
+	for _, label := range labels {
+		addTag()
+		dst = appendStatsdName(dst, label.Name)
+		dst = append(dst, ':')
+		dst = appendStatsdTagValue(dst, label.Value)
+	}
+	if extraLabelName != "" {
+		addTag()
+		dst = appendStatsdName(dst, extraLabelName)
+		dst = append(dst, ':')
+		dst = appendStatsdTagValue(dst, extraLabelValue)
+	}
+	return dst
+}
+
+func (sc *statsdContext) close() {
+	_ = sc.conn.Close()
+}
+
+// appendStatsdName appends metric name, path node or tag name to dst, replacing chars reserved by StatsD protocol with underscores.
+//
+// `:` is replaced too, since it separates the name from the value and the tag name from the tag value.
+func appendStatsdName(dst []byte, name string) []byte {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == ':' || c == '|' || c == '@' || c == '#' {
+			c = '_'
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+func appendStatsdPathNode(dst []byte, labelName, labelValue string) []byte {
+	dst = append(dst, '.')
+	dst = appendStatsdName(dst, labelName)
+	dst = append(dst, '.')
+	return appendStatsdName(dst, sanitizeGraphitePathNode(labelValue))
+}
+
+// appendStatsdTagValue appends tag value to dst, replacing chars reserved by DogStatsD protocol with underscores.
+func appendStatsdTagValue(dst []byte, v string) []byte {
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c == ',' || c == '|' || c == '#' || c == '\n' {
+			c = '_'
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
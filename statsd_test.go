@@ -0,0 +1,187 @@
+package metrics
+
+import (
+	"context"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatsdWriteLines(t *testing.T) {
+	s := NewSet()
+	c := s.NewCounter(`requests_total{path="/a,b"}`)
+	s.NewGauge(`temperature`, nil).Set(21.5)
+	h := s.NewHistogramStatic(`duration_seconds`, []float64{0.1, 1})
+	sm := s.NewSummaryExt(`response_size`, time.Hour, []float64{0.5})
+
+	sc, err := newStatsdContext("127.0.0.1:8125", &StatsdOptions{
+		Prefix: "app.",
+		Tags:   []string{"env:prod"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer sc.close()
+
+	f := func(expectedLines string) {
+		t.Helper()
+		var lines []string
+		sc.writeLines(s.Snapshot(), func(line []byte) {
+			lines = append(lines, string(line))
+		})
+		result := strings.Join(lines, "\n")
+		if result != expectedLines {
+			t.Fatalf("unexpected lines; got\n%s\nwant\n%s", result, expectedLines)
+		}
+	}
+
+	c.Add(5)
+	h.Update(0.05)
+	h.Update(0.07)
+	h.Update(5)
+	sm.Update(10)
+	f(`app.duration_seconds:0.1|h|@0.5|#env:prod
+app.duration_seconds:1|h|#env:prod
+app.requests_total:5|c|#env:prod,path:/a_b
+app.response_size:10|g|#env:prod,quantile:0.5
+app.response_size_sum:10|c|#env:prod
+app.response_size_count:1|c|#env:prod
+app.temperature:21.5|g|#env:prod`)
+
+	// Only deltas are sent for counters and histograms.
+	c.Add(2)
+	h.Update(0.5)
+	f(`app.duration_seconds:1|h|#env:prod
+app.requests_total:2|c|#env:prod,path:/a_b
+app.response_size:10|g|#env:prod,quantile:0.5
+app.temperature:21.5|g|#env:prod`)
+
+	// Counter reset
+	c.Set(1)
+	f(`app.requests_total:1|c|#env:prod,path:/a_b
+app.response_size:10|g|#env:prod,quantile:0.5
+app.temperature:21.5|g|#env:prod`)
+}
+
+func TestStatsdWriteLinesDisableTags(t *testing.T) {
+	s := NewSet()
+	s.NewCounter(`requests_total{path="/a"}`).Inc()
+
+	sc, err := newStatsdContext("127.0.0.1:8125", &StatsdOptions{
+		DisableTags: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer sc.close()
+
+	var lines []string
+	sc.writeLines(s.Snapshot(), func(line []byte) {
+		lines = append(lines, string(line))
+	})
+	result := strings.Join(lines, "\n")
+	if result != "requests_total.path._a:1|c" {
+		t.Fatalf("unexpected lines: %q", result)
+	}
+}
+
+func TestStatsdWriteLinesNegativeGaugeAndColonLabels(t *testing.T) {
+	s := NewSet()
+	s.NewGauge(`balance{acc:id="a:b"}`, nil).Set(-5)
+	s.NewGauge(`zero`, nil).Set(math.Copysign(0, -1))
+
+	f := func(opts *StatsdOptions, expectedLines []string) {
+		t.Helper()
+		sc, err := newStatsdContext("127.0.0.1:8125", opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer sc.close()
+
+		var lines []string
+		sc.writeLines(s.Snapshot(), func(line []byte) {
+			lines = append(lines, string(line))
+		})
+		if strings.Join(lines, "\n---\n") != strings.Join(expectedLines, "\n---\n") {
+			t.Fatalf("unexpected lines; got\n%q\nwant\n%q", lines, expectedLines)
+		}
+	}
+
+	// The negative gauge is reset to 0 in the same line batch, `:` is replaced in tag names.
+	f(nil, []string{
+		"balance:0|g|#acc_id:a:b\nbalance:-5|g|#acc_id:a:b",
+		"zero:0|g",
+	})
+	f(&StatsdOptions{
+		DisableTags: true,
+	}, []string{
+		"balance.acc_id.a_b:0|g\nbalance.acc_id.a_b:-5|g",
+		"zero:0|g",
+	})
+}
+
+func TestStatsdInvalidOptions(t *testing.T) {
+	f := func(addr string, opts *StatsdOptions) {
+		t.Helper()
+		if _, err := newStatsdContext(addr, opts); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	}
+	f("", nil)
+	f("localhost", nil)
+	f("localhost:8125", &StatsdOptions{
+		Tags: []string{"foo|bar"},
+	})
+
+	// invalid interval
+	if err := InitStatsdWithOptions(context.Background(), "localhost:8125", 0, nil); err == nil {
+		t.Fatalf("expecting non-nil error for zero interval")
+	}
+}
+
+func TestInitStatsdWithOptions(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer conn.Close()
+
+	s := NewSet()
+	for i := 0; i < 100; i++ {
+		s.NewGauge(`some_long_gauge_name_for_filling_the_packet{index="`+strings.Repeat("x", i)+`"}`, nil).Set(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	const maxPacketSize = 512
+	if err := s.InitStatsdWithOptions(ctx, conn.LocalAddr().String(), 10*time.Millisecond, &StatsdOptions{
+		MaxPacketSize: maxPacketSize,
+		WaitGroup:     &wg,
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	lines := 0
+	buf := make([]byte, 64*1024)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for lines < 100 {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("cannot read packet: %s", err)
+		}
+		if n > maxPacketSize {
+			t.Fatalf("too big packet size: %d bytes; mustn't exceed %d bytes", n, maxPacketSize)
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if !strings.HasPrefix(line, "some_long_gauge_name_for_filling_the_packet:1|g|#index:") {
+				t.Fatalf("unexpected line: %q", line)
+			}
+			lines++
+		}
+	}
+	cancel()
+	wg.Wait()
+}
@@ -0,0 +1,423 @@
+package metrics
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sync"
+)
+
+// appendZstdCompressed appends src compressed into a single zstd frame to dst.
+//
+// The encoder finds matches with a simple hash table and encodes them with predefined FSE tables,
+// while literals are stored as is. This gives lower compression ratio than the reference implementation,
+// but it is fast and simple.
+//
+// See https://datatracker.ietf.org/doc/html/rfc8878
+func appendZstdCompressed(dst, src []byte) []byte {
+	// Frame header: magic number, frame header descriptor with Single_Segment_flag and 8-byte Frame_Content_Size.
+	dst = append(dst, 0x28, 0xb5, 0x2f, 0xfd, 0xe0)
+	dst = appendUint64LE(dst, uint64(len(src)))
+
+	ze := getZstdEncoder()
+	for {
+		n := len(src)
+		if n > zstdMaxBlockSize {
+			n = zstdMaxBlockSize
+		}
+		dst = ze.appendBlock(dst, src[:n], n == len(src))
+		src = src[n:]
+		if len(src) == 0 {
+			break
+		}
+	}
+	putZstdEncoder(ze)
+	return dst
+}
+
+const zstdMaxBlockSize = 128 * 1024
+
+const (
+	zstdBlockTypeRaw        = 0
+	zstdBlockTypeCompressed = 2
+)
+
+const (
+	zstdTableBits = 15
+	zstdMinMatch  = 4
+)
+
+type zstdSequence struct {
+	litLen   uint32
+	matchLen uint32
+	offset   uint32
+}
+
+type zstdEncoder struct {
+	table     [1 << zstdTableBits]int32
+	sequences []zstdSequence
+	literals  []byte
+	bw        zstdBitWriter
+	block     []byte
+}
+
+// appendBlock appends src as a single zstd block to dst.
+//
+// The block is stored as raw block if it cannot be compressed.
+func (ze *zstdEncoder) appendBlock(dst, src []byte, isLast bool) []byte {
+	block := ze.compressBlock(src)
+	blockType := zstdBlockTypeCompressed
+	if len(block) >= len(src) {
+		block = src
+		blockType = zstdBlockTypeRaw
+	}
+	header := uint32(len(block))<<3 | uint32(blockType)<<1
+	if isLast {
+		header |= 1
+	}
+	dst = append(dst, byte(header), byte(header>>8), byte(header>>16))
+	return append(dst, block...)
+}
+
+// compressBlock returns the content of compressed block for src.
+func (ze *zstdEncoder) compressBlock(src []byte) []byte {
+	ze.findSequences(src)
+
+	// Literals section with raw literals.
+	b := ze.block[:0]
+	n := uint32(len(ze.literals))
+	switch {
+	case n < 1<<5:
+		b = append(b, byte(n<<3))
+	case n < 1<<12:
+		b = append(b, byte(n<<4|1<<2), byte(n>>4))
+	default:
+		b = append(b, byte(n<<4|3<<2), byte(n>>4), byte(n>>12))
+	}
+	b = append(b, ze.literals...)
+
+	// Sequences section.
+	nbSeq := len(ze.sequences)
+	switch {
+	case nbSeq < 128:
+		b = append(b, byte(nbSeq))
+	case nbSeq < 0x7f00:
+		b = append(b, byte(nbSeq>>8+128), byte(nbSeq))
+	default:
+		b = append(b, 255, byte(nbSeq-0x7f00), byte((nbSeq-0x7f00)>>8))
+	}
+	if nbSeq > 0 {
+		// Predefined mode for literal lengths, offsets and match lengths.
+		b = append(b, 0)
+		b = ze.appendSequences(b)
+	}
+	ze.block = b
+	return b
+}
+
+// findSequences fills ze.sequences and ze.literals for src.
+func (ze *zstdEncoder) findSequences(src []byte) {
+	ze.sequences = ze.sequences[:0]
+	ze.literals = ze.literals[:0]
+	for i := range ze.table {
+		ze.table[i] = -1
+	}
+	litStart := 0
+	i := 0
+	for i+zstdMinMatch <= len(src) {
+		cur := binary.LittleEndian.Uint32(src[i:])
+		h := hashUint32(cur, zstdTableBits)
+		candidate := int(ze.table[h])
+		ze.table[h] = int32(i)
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != cur {
+			i++
+			continue
+		}
+		matchLen := zstdMinMatch
+		for i+matchLen < len(src) && src[candidate+matchLen] == src[i+matchLen] {
+			matchLen++
+		}
+		ze.literals = append(ze.literals, src[litStart:i]...)
+		ze.sequences = append(ze.sequences, zstdSequence{
+			litLen:   uint32(i - litStart),
+			matchLen: uint32(matchLen),
+			offset:   uint32(i - candidate),
+		})
+		i += matchLen
+		litStart = i
+	}
+	ze.literals = append(ze.literals, src[litStart:]...)
+}
+
+// appendSequences appends FSE-encoded ze.sequences to dst.
+//
+// Sequences are encoded in the reverse order, since the decoder reads the bitstream backwards.
+func (ze *zstdEncoder) appendSequences(dst []byte) []byte {
+	zstdTablesOnce.Do(initZstdTables)
+
+	bw := &ze.bw
+	bw.reset(dst)
+	seqs := ze.sequences
+	last := len(seqs) - 1
+
+	llCode, llExtra, llBits := getZstdLitLenCode(seqs[last].litLen)
+	mlCode, mlExtra, mlBits := getZstdMatchLenCode(seqs[last].matchLen)
+	ofCode, ofExtra := getZstdOffsetCode(seqs[last].offset)
+	llState := zstdLitLenTable.initState(llCode)
+	mlState := zstdMatchLenTable.initState(mlCode)
+	ofState := zstdOffsetTable.initState(ofCode)
+	bw.addBits(llExtra, llBits)
+	bw.addBits(mlExtra, mlBits)
+	bw.addBits(ofExtra, ofCode)
+
+	for n := last - 1; n >= 0; n-- {
+		llCode, llExtra, llBits = getZstdLitLenCode(seqs[n].litLen)
+		mlCode, mlExtra, mlBits = getZstdMatchLenCode(seqs[n].matchLen)
+		ofCode, ofExtra = getZstdOffsetCode(seqs[n].offset)
+		ofState = zstdOffsetTable.encode(bw, ofState, ofCode)
+		mlState = zstdMatchLenTable.encode(bw, mlState, mlCode)
+		llState = zstdLitLenTable.encode(bw, llState, llCode)
+		bw.addBits(llExtra, llBits)
+		bw.addBits(mlExtra, mlBits)
+		bw.addBits(ofExtra, ofCode)
+	}
+
+	zstdMatchLenTable.flushState(bw, mlState)
+	zstdOffsetTable.flushState(bw, ofState)
+	zstdLitLenTable.flushState(bw, llState)
+	return bw.close()
+}
+
+var (
+	zstdLitLenBaselines = [...]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	zstdLitLenBits = [...]uint32{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	zstdMatchLenBaselines = [...]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	zstdMatchLenBits = [...]uint32{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+)
+
+// getZstdLitLenCode returns literal length code, extra bits value and the number of extra bits for litLen.
+func getZstdLitLenCode(litLen uint32) (uint32, uint32, uint32) {
+	code := uint32(len(zstdLitLenBaselines) - 1)
+	for code > 0 && zstdLitLenBaselines[code] > litLen {
+		code--
+	}
+	return code, litLen - zstdLitLenBaselines[code], zstdLitLenBits[code]
+}
+
+// getZstdMatchLenCode returns match length code, extra bits value and the number of extra bits for matchLen.
+func getZstdMatchLenCode(matchLen uint32) (uint32, uint32, uint32) {
+	code := uint32(len(zstdMatchLenBaselines) - 1)
+	for code > 0 && zstdMatchLenBaselines[code] > matchLen {
+		code--
+	}
+	return code, matchLen - zstdMatchLenBaselines[code], zstdMatchLenBits[code]
+}
+
+// getZstdOffsetCode returns offset code and extra bits value for offset. The number of extra bits equals to the code.
+//
+// Repeat offsets aren't used, so offset is always encoded as offset+3.
+func getZstdOffsetCode(offset uint32) (uint32, uint32) {
+	v := offset + 3
+	code := uint32(bits.Len32(v) - 1)
+	return code, v - 1<<code
+}
+
+// zstdFSETable is FSE encoding table built from the predefined distribution.
+type zstdFSETable struct {
+	tableLog   uint32
+	stateTable []uint16
+	symbolTT   []zstdSymbolTransform
+}
+
+type zstdSymbolTransform struct {
+	deltaNbBits    uint32
+	deltaFindState int32
+}
+
+// newZstdFSETable builds FSE encoding table for the given normalized distribution.
+//
+// -1 in the distribution stands for symbols with "less than 1" probability.
+func newZstdFSETable(norm []int16, tableLog uint32) *zstdFSETable {
+	tableSize := uint32(1) << tableLog
+	tableSymbol := make([]byte, tableSize)
+	highThreshold := tableSize - 1
+
+	cumul := make([]uint32, len(norm)+1)
+	for s, n := range norm {
+		if n == -1 {
+			cumul[s+1] = cumul[s] + 1
+			tableSymbol[highThreshold] = byte(s)
+			highThreshold--
+		} else {
+			cumul[s+1] = cumul[s] + uint32(n)
+		}
+	}
+
+	// Spread symbols in the same way as the decoder does.
+	step := tableSize>>1 + tableSize>>3 + 3
+	mask := tableSize - 1
+	pos := uint32(0)
+	for s, n := range norm {
+		for i := int16(0); i < n; i++ {
+			tableSymbol[pos] = byte(s)
+			pos = (pos + step) & mask
+			for pos > highThreshold {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+
+	stateTable := make([]uint16, tableSize)
+	for u := uint32(0); u < tableSize; u++ {
+		s := tableSymbol[u]
+		stateTable[cumul[s]] = uint16(tableSize + u)
+		cumul[s]++
+	}
+
+	symbolTT := make([]zstdSymbolTransform, len(norm))
+	total := int32(0)
+	for s, n := range norm {
+		switch n {
+		case 0:
+		case -1, 1:
+			symbolTT[s] = zstdSymbolTransform{
+				deltaNbBits:    tableLog<<16 - tableSize,
+				deltaFindState: total - 1,
+			}
+			total++
+		default:
+			maxBitsOut := tableLog - uint32(bits.Len32(uint32(n-1))-1)
+			minStatePlus := uint32(n) << maxBitsOut
+			symbolTT[s] = zstdSymbolTransform{
+				deltaNbBits:    maxBitsOut<<16 - minStatePlus,
+				deltaFindState: total - int32(n),
+			}
+			total += int32(n)
+		}
+	}
+	return &zstdFSETable{
+		tableLog:   tableLog,
+		stateTable: stateTable,
+		symbolTT:   symbolTT,
+	}
+}
+
+// initState returns the initial encoder state for the given symbol without writing bits.
+func (t *zstdFSETable) initState(symbol uint32) uint32 {
+	tt := t.symbolTT[symbol]
+	nbBitsOut := (tt.deltaNbBits + 1<<15) >> 16
+	v := nbBitsOut<<16 - tt.deltaNbBits
+	return uint32(t.stateTable[int32(v>>nbBitsOut)+tt.deltaFindState])
+}
+
+// encode writes bits for the transition from state to the given symbol and returns the new state.
+func (t *zstdFSETable) encode(bw *zstdBitWriter, state, symbol uint32) uint32 {
+	tt := t.symbolTT[symbol]
+	nbBitsOut := (state + tt.deltaNbBits) >> 16
+	bw.addBits(state, nbBitsOut)
+	return uint32(t.stateTable[int32(state>>nbBitsOut)+tt.deltaFindState])
+}
+
+// flushState writes the final state.
+func (t *zstdFSETable) flushState(bw *zstdBitWriter, state uint32) {
+	bw.addBits(state, t.tableLog)
+}
+
+var (
+	zstdLitLenTable   *zstdFSETable
+	zstdMatchLenTable *zstdFSETable
+	zstdOffsetTable   *zstdFSETable
+	zstdTablesOnce    sync.Once
+)
+
+func initZstdTables() {
+	// Predefined distributions from https://datatracker.ietf.org/doc/html/rfc8878#section-3.1.1.3.2.2
+	zstdLitLenTable = newZstdFSETable([]int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}, 6)
+	zstdMatchLenTable = newZstdFSETable([]int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}, 6)
+	zstdOffsetTable = newZstdFSETable([]int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}, 5)
+}
+
+// zstdBitWriter writes bits in little-endian order.
+type zstdBitWriter struct {
+	dst   []byte
+	bits  uint64
+	nbits uint32
+}
+
+func (bw *zstdBitWriter) reset(dst []byte) {
+	bw.dst = dst
+	bw.bits = 0
+	bw.nbits = 0
+}
+
+// addBits adds the lower n bits of v. n mustn't exceed 32.
+func (bw *zstdBitWriter) addBits(v, n uint32) {
+	if n == 0 {
+		return
+	}
+	bw.bits |= uint64(v&(1<<n-1)) << bw.nbits
+	bw.nbits += n
+	if bw.nbits >= 32 {
+		bw.dst = append(bw.dst, byte(bw.bits), byte(bw.bits>>8), byte(bw.bits>>16), byte(bw.bits>>24))
+		bw.bits >>= 32
+		bw.nbits -= 32
+	}
+}
+
+// close writes the end mark and the remaining bits and returns the result.
+func (bw *zstdBitWriter) close() []byte {
+	bw.addBits(1, 1)
+	for bw.nbits > 0 {
+		bw.dst = append(bw.dst, byte(bw.bits))
+		bw.bits >>= 8
+		if bw.nbits < 8 {
+			bw.nbits = 0
+		} else {
+			bw.nbits -= 8
+		}
+	}
+	return bw.dst
+}
+
+func getZstdEncoder() *zstdEncoder {
+	v := zstdEncoderPool.Get()
+	if v == nil {
+		return &zstdEncoder{}
+	}
+	return v.(*zstdEncoder)
+}
+
+func putZstdEncoder(ze *zstdEncoder) {
+	zstdEncoderPool.Put(ze)
+}
+
+var zstdEncoderPool sync.Pool
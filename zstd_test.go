@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestAppendZstdCompressed(t *testing.T) {
+	f := func(src, expectedResult string) {
+		t.Helper()
+		result := appendZstdCompressed(nil, []byte(src))
+		if string(result) != expectedResult {
+			t.Fatalf("unexpected result; got\n%q\nwant\n%q", result, expectedResult)
+		}
+	}
+
+	// empty frame
+	f("", "\x28\xb5\x2f\xfd\xe0\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00")
+
+	// raw block
+	f("foo", "\x28\xb5\x2f\xfd\xe0\x03\x00\x00\x00\x00\x00\x00\x00\x19\x00\x00foo")
+
+	// compressed block with a single sequence
+	f("foo 1\nfoo 1\nfoo 1\nbar 2\n", "\x28\xb5\x2f\xfd\xe0\x18\x00\x00\x00\x00\x00\x00\x00\x95\x00\x00"+
+		"\x60foo 1\nbar 2\n"+
+		"\x01\x00\xe1\x4a\x11")
+}
+
+func TestAppendZstdCompressedRoundtrip(t *testing.T) {
+	zstdPath, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skipf("skipping the test, since zstd binary is missing: %s", err)
+	}
+	f := func(src []byte) {
+		t.Helper()
+		compressed := appendZstdCompressed(nil, src)
+		cmd := exec.Command(zstdPath, "-d", "-q", "-c")
+		cmd.Stdin = bytes.NewReader(compressed)
+		result, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("cannot decompress data with zstd: %s", err)
+		}
+		if !bytes.Equal(result, src) {
+			t.Fatalf("unexpected decompressed data; got %d bytes; want %d bytes", len(result), len(src))
+		}
+	}
+	f([]byte(strings.Repeat(`foo{bar="baz"} 123`+"\n", 20000)))
+
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, 300000)
+	r.Read(data)
+	f(data)
+
+	var sb strings.Builder
+	for i := 0; i < 50000; i++ {
+		fmt.Fprintf(&sb, "metric_%d{label=%q} %d\n", r.Intn(100), strings.Repeat("x", r.Intn(10)), r.Intn(1000))
+	}
+	f([]byte(sb.String()))
+}
+
+func TestAppendZstdCompressedRatio(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var sb strings.Builder
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&sb, "metric_%d{label=%q} %d\n", r.Intn(100), strings.Repeat("x", r.Intn(10)), r.Intn(1000))
+	}
+	src := []byte(sb.String())
+	compressed := appendZstdCompressed(nil, src)
+	if len(compressed) > len(src)/2 {
+		t.Fatalf("too low compression ratio; compressed %d bytes into %d bytes", len(src), len(compressed))
+	}
+}